@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	documentMetadata string // the --document-metadata value: the keys of \DocumentMetadata (tagging...)
+	mustCheckTagging bool   // check the tagging of the .pdf after the compilation
+)
+
+// the \DocumentMetadata command, that must be before \documentclass
+var reDocumentMetadata = regexp.MustCompile(`\\DocumentMetadata\s*\{`)
+
+// documentMetadataCode return the \DocumentMetadata line to add before \documentclass,
+// or an empty string if not asked, or if the source already has one.
+func documentMetadataCode(texdata []byte) string {
+	if len(documentMetadata) == 0 || reDocumentMetadata.Match(texdata) {
+		return ""
+	}
+	return `\DocumentMetadata{` + documentMetadata + `}`
+}
+
+// addDocumentMetadata add the \DocumentMetadata line at the start of the source
+// (on the first line, to keep the line numbers).
+func addDocumentMetadata(texdata []byte) []byte {
+	code := documentMetadataCode(texdata)
+	if len(code) == 0 {
+		return texdata
+	}
+	return append([]byte(code), texdata...)
+}
+
+// the marks of a tagged .pdf, with their descriptions
+var taggingMarks = []struct {
+	re          *regexp.Regexp
+	description string
+}{
+	{regexp.MustCompile(`/StructTreeRoot\s`), "structure tree (/StructTreeRoot)"},
+	{regexp.MustCompile(`/MarkInfo\s*<<[^>]*/Marked\s+true`), "marked content (/MarkInfo with /Marked true)"},
+	{regexp.MustCompile(`/Lang\s*\(`), "language (/Lang)"},
+}
+
+// reStream find the streams of a .pdf, as the dictionaries can be compressed in object streams
+var reStream = regexp.MustCompile(`(?s)stream\r?\n(.*?)endstream`)
+
+// pdfContent return the raw .pdf followed by its decompressed streams (the ones that can be).
+func pdfContent(pdf []byte) []byte {
+	content := append([]byte{}, pdf...)
+	for _, match := range reStream.FindAllSubmatch(pdf, -1) {
+		reader, err := zlib.NewReader(bytes.NewReader(match[1]))
+		if err != nil {
+			continue
+		}
+		if data, err := ioutil.ReadAll(reader); err == nil || len(data) > 0 {
+			content = append(content, data...)
+		}
+		reader.Close()
+	}
+	return content
+}
+
+// checkTagging warn if the .pdf lacks the basic marks of a tagged PDF.
+// This is not a validation (use a PDF/UA checker for that), only a quick check that the tagging works.
+func checkTagging() error {
+	if !mustCheckTagging {
+		return nil
+	}
+	pdfName := outputBase + ".pdf"
+	pdf, err := ioutil.ReadFile(pdfName)
+	if err != nil {
+		return atStage("tagging", err)
+	}
+	content := pdfContent(pdf)
+	var missing []string
+	for _, mark := range taggingMarks {
+		if !mark.re.Match(content) {
+			missing = append(missing, mark.description)
+		}
+	}
+	if len(missing) == 0 {
+		info("The tagging of", pdfName, "looks fine.")
+	} else if infoLevel >= infoErrors {
+		warning("%s is not tagged, it has no %s.", pdfName, strings.Join(missing, ", no "))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// the --badge value: the SVG file showing the result of the last build ("" for none)
+var badgeFile string
+
+// the colors of the badge, like the usual shields
+const (
+	badgeLabelColor   = "#555"
+	badgeSuccessColor = "#4c1"
+	badgeFailureColor = "#e05d44"
+)
+
+// badgeTemplate is a flat badge: the label, then the message on the status color.
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="%[7]s"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[8]d" y="14">%[4]s</text><text x="%[9]d" y="14">%[5]s</text>
+</g>
+</svg>
+`
+
+// checkBadge check the --badge path, made absolute to survive the switch to the isolated folder.
+func checkBadge() error {
+	if len(badgeFile) == 0 {
+		return nil
+	}
+	var err error
+	badgeFile, err = userPath(badgeFile)
+	return err
+}
+
+// badgeWidth estimate the width of the text in the badge font (about 7px by character),
+// with the margins.
+func badgeWidth(text string) int {
+	return 7*len([]rune(text)) + 10
+}
+
+// badgeMessage return the message of the badge: passing with the number of pages,
+// or failing with the stage of the error.
+func badgeMessage(err error) (message, color string) {
+	if err != nil {
+		var se *stageError
+		if errors.As(err, &se) {
+			return "failing at " + se.stage, badgeFailureColor
+		}
+		return "failing", badgeFailureColor
+	}
+	message = "passing"
+	switch pages := logPages(outBase + ".log"); {
+	case pages == 1:
+		message += ", 1 page"
+	case pages > 1:
+		message += ", " + strconv.Itoa(pages) + " pages"
+	}
+	return message, badgeSuccessColor
+}
+
+// writeBadge write the --badge SVG with the result of the build (if asked).
+// The badge is renamed over the old one, so it is never seen half written.
+// A problem with the badge is only a warning, it never fails the build.
+func writeBadge(buildErr error) {
+	if len(badgeFile) == 0 {
+		return
+	}
+	label := "build"
+	message, color := badgeMessage(buildErr)
+	label, message = html.EscapeString(label), html.EscapeString(message)
+	labelWidth, messageWidth := badgeWidth(label), badgeWidth(message)
+	svg := fmt.Sprintf(badgeTemplate, labelWidth+messageWidth, labelWidth, messageWidth, label, message,
+		color, badgeLabelColor, labelWidth/2, labelWidth+messageWidth/2)
+	// the side by side builds (--engines) write it concurrently
+	temp := badgeFile + "." + strconv.Itoa(os.Getpid()) + ".part"
+	err := ioutil.WriteFile(temp, []byte(svg), 0644)
+	if err == nil {
+		err = os.Rename(temp, badgeFile)
+	}
+	if err != nil {
+		os.Remove(temp)
+		if infoLevel >= infoErrors {
+			warning("Can't write the badge %s: %v", badgeFile, err)
+		}
+		return
+	}
+	info(" write badge", badgeFile, "("+message+")")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the --battery-saver value: "" (off), on, or the battery percent under which the watching is paused
+var batterySaver string
+
+// the battery percent of --battery-saver=N, 0 to never pause
+var batteryThreshold int
+
+// the time to wait after a change with --battery-saver, so the saves in a row give one compilation
+const batterySettleDelay = time.Second
+
+// the interval of the reading of the power state with --battery-saver=N
+const batteryPollInterval = 30 * time.Second
+
+// checkBatterySaver check the --battery-saver value, and skip the draft compilations.
+func checkBatterySaver() error {
+	batteryThreshold = 0
+	switch batterySaver {
+	case "":
+		return nil
+	case "on":
+	default:
+		percent, err := strconv.Atoi(strings.TrimSuffix(batterySaver, "%"))
+		if err != nil || percent < 1 || percent > 100 {
+			return errors.New("Invalid --battery-saver value " + batterySaver + " (use on or a battery percent like 20).")
+		}
+		batteryThreshold = percent
+	}
+	if numCompilesAtStart > 1 {
+		info("Battery saver: no draft compilation at start.")
+		numCompilesAtStart = 1
+	}
+	return nil
+}
+
+// watchSettleDelay return the time to wait after a change before to compile.
+func watchSettleDelay() time.Duration {
+	if len(batterySaver) > 0 {
+		return batterySettleDelay
+	}
+	return settleDelay
+}
+
+// rePmsetBattery match the battery line of `pmset -g batt` (macOS)
+var rePmsetBattery = regexp.MustCompile(`(\d+)%;\s*(\w[\w ]*);`)
+
+// powerState return if the system runs on battery, and the battery percent.
+// An error is returned if the power state can't be read (like on a desktop without battery).
+func powerState() (onBattery bool, percent int, err error) {
+	switch runtime.GOOS {
+	case "windows":
+		script := `$b = Get-CimInstance Win32_Battery | Select-Object -First 1; if ($b) { "$($b.BatteryStatus) $($b.EstimatedChargeRemaining)" }`
+		output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+		if err != nil {
+			return false, 0, err
+		}
+		var status int
+		if _, err := fmt.Sscan(string(output), &status, &percent); err != nil {
+			return false, 0, errors.New("no battery")
+		}
+		// the status 1 is "discharging"
+		return status == 1, percent, nil
+	case "darwin":
+		output, err := exec.Command("pmset", "-g", "batt").Output()
+		if err != nil {
+			return false, 0, err
+		}
+		match := rePmsetBattery.FindSubmatch(output)
+		if match == nil {
+			return false, 0, errors.New("no battery")
+		}
+		percent, _ = strconv.Atoi(string(match[1]))
+		return strings.Contains(string(output), "'Battery Power'"), percent, nil
+	}
+	// the power supplies of Linux (and of the other systems with a sysfs)
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	found := false
+	for _, supply := range supplies {
+		kind, _ := ioutil.ReadFile(filepath.Join(supply, "type"))
+		if strings.TrimSpace(string(kind)) != "Battery" {
+			continue
+		}
+		capacity, err := ioutil.ReadFile(filepath.Join(supply, "capacity"))
+		if err != nil {
+			continue
+		}
+		status, _ := ioutil.ReadFile(filepath.Join(supply, "status"))
+		percent, _ = strconv.Atoi(strings.TrimSpace(string(capacity)))
+		found = true
+		if strings.TrimSpace(string(status)) == "Discharging" {
+			return true, percent, nil
+		}
+	}
+	if !found {
+		return false, 0, errors.New("no battery")
+	}
+	return false, percent, nil
+}
+
+// startBatteryWatch pause the watching when the system runs on battery under the --battery-saver percent,
+// and resume it when the power is back (or the battery charged above it).
+// The power state is read every batteryPollInterval.
+func startBatteryWatch() {
+	if batteryThreshold == 0 {
+		return
+	}
+	if _, _, err := powerState(); err != nil {
+		if infoLevel >= infoErrors {
+			warning("Can't read the battery state (%v), the watching is never paused by --battery-saver.", err)
+		}
+		return
+	}
+	go func() {
+		paused := false
+		for ; ; time.Sleep(batteryPollInterval) {
+			onBattery, percent, err := powerState()
+			if err != nil {
+				continue
+			}
+			low := onBattery && percent < batteryThreshold
+			trace("watch", "Power state: on battery", onBattery, "at", strconv.Itoa(percent)+"%")
+			switch {
+			case low && !paused:
+				info(fmt.Sprintf("Battery saver: on battery at %d%% (under %d%%).", percent, batteryThreshold))
+				if !sendCommand(cmdBatteryPause) {
+					return
+				}
+				paused = true
+			case !low && paused:
+				info(fmt.Sprintf("Battery saver: on power or charged at %d%%.", percent))
+				if !sendCommand(cmdBatteryResume) {
+					return
+				}
+				paused = false
+			}
+		}
+	}()
+}
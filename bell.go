@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	bellMode      string // the --bell value: "error", "always" or "never"
+	mustFlashBell bool   // also flash the terminal
+)
+
+// checkBellMode check the --bell value.
+func checkBellMode() error {
+	switch bellMode {
+	case "error", "always", "never":
+		return nil
+	default:
+		return errors.New("Invalid --bell value " + bellMode + ".")
+	}
+}
+
+// ringBell emit the terminal bell at the end of a build, depending on the --bell mode.
+// The flash (reverse video for a moment) is for the terminals with a silent bell.
+func ringBell(err error) {
+	if bellMode == "never" || bellMode == "error" && err == nil {
+		return
+	}
+	fmt.Print("\a")
+	if mustFlashBell {
+		fmt.Print("\033[?5h")
+		time.Sleep(100 * time.Millisecond)
+		fmt.Print("\033[?5l")
+	}
+}
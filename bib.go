@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the --no-bibliography value: never run biber or bibtex
+var mustNoBibliography bool
+
+// the maximum number of bibliography passes after a compilation, if the log always asks for more
+const maxBibPasses = 2
+
+var (
+	// the messages of biblatex asking for biber (or bibtex with backend=bibtex)
+	reRunBib = regexp.MustCompile(`Please \(re\)run (Biber|BibTeX)`)
+	// the lines of the .aux read by bibtex
+	reBibtexAux = regexp.MustCompile(`(?m)^\\(?:citation|bibdata|bibstyle)\{.*$`)
+	// the .aux of the \include files, read by bibtex too
+	reAuxInput = regexp.MustCompile(`(?m)^\\@input\{([^}]+)\}`)
+)
+
+// the bibliography and index tools already reported as missing
+var toolMissing = map[string]bool{}
+
+// the references of the included .tex files (see texReferences) and the hashes of the .bib files, by file name.
+// While watching they are forgotten when the files change (see forgetChangedFile),
+// so the bibliography checks of a rebuild read only the changed files, and the source.
+var (
+	bibCacheMu      sync.Mutex
+	referencesCache = map[string]texFileReferences{}
+	bibHashCache    = map[string]string{}
+)
+
+// texFileReferences is the cached result of texReferences.
+type texFileReferences struct {
+	bibs, inputs []string
+}
+
+// cachedReferences return the texReferences of the file, from the cache for the included files.
+func cachedReferences(fileName string) (bibs, inputs []string, err error) {
+	name := filepath.Clean(fileName)
+	if name == filepath.Clean(inBaseOriginal+".tex") {
+		return texReferences(fileName)
+	}
+	bibCacheMu.Lock()
+	references, found := referencesCache[name]
+	bibCacheMu.Unlock()
+	if found {
+		return references.bibs, references.inputs, nil
+	}
+	if bibs, inputs, err = texReferences(fileName); err == nil {
+		bibCacheMu.Lock()
+		referencesCache[name] = texFileReferences{bibs, inputs}
+		bibCacheMu.Unlock()
+	}
+	return bibs, inputs, err
+}
+
+// bibHash return the hash of the .bib file, from the cache if it didn't change.
+func bibHash(fileName string) (string, error) {
+	name := filepath.Clean(fileName)
+	bibCacheMu.Lock()
+	hash, found := bibHashCache[name]
+	bibCacheMu.Unlock()
+	if found {
+		return hash, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	hash = fmt.Sprintf("%x", sha256.Sum256(data))
+	bibCacheMu.Lock()
+	bibHashCache[name] = hash
+	bibCacheMu.Unlock()
+	return hash, nil
+}
+
+// forgetChangedFile forget what is cached about the changed file, or about all the files if the name is "".
+func forgetChangedFile(fileName string) {
+	bibCacheMu.Lock()
+	defer bibCacheMu.Unlock()
+	if len(fileName) == 0 {
+		referencesCache = map[string]texFileReferences{}
+		bibHashCache = map[string]string{}
+		return
+	}
+	delete(referencesCache, filepath.Clean(fileName))
+	delete(bibHashCache, filepath.Clean(fileName))
+}
+
+// bibState return the names and the hashes of the .bib files of the document.
+func bibState() string {
+	files, err := bibFiles(inBaseOriginal+".tex", 0)
+	if err != nil {
+		return ""
+	}
+	sort.Strings(files)
+	var state strings.Builder
+	for _, fileName := range files {
+		hash, err := bibHash(fileName)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&state, "%s %s\n", fileName, hash)
+	}
+	return state.String()
+}
+
+// bibtexAux return the lines of the .aux (and of the .aux of the \include files) read by bibtex.
+func bibtexAux() []byte {
+	aux, err := ioutil.ReadFile(outBase + ".aux")
+	if err != nil {
+		return nil
+	}
+	lines := reBibtexAux.FindAll(aux, -1)
+	for _, match := range reAuxInput.FindAllSubmatch(aux, -1) {
+		if included, err := ioutil.ReadFile(filepath.Join(filepath.Dir(outBase), string(match[1]))); err == nil {
+			lines = append(lines, reBibtexAux.FindAll(included, -1)...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// bibTool return the tool that builds the .bbl of the last compilation, and the hash of what it reads:
+// biber for biblatex (that writes a .bcf), bibtex if the .aux has a \bibdata, "" if none.
+func bibTool() (tool, inputs string) {
+	var data []byte
+	if bcf, err := ioutil.ReadFile(outBase + ".bcf"); err == nil {
+		tool, data = "biber", bcf
+	} else if aux := bibtexAux(); bytes.Contains(aux, []byte(`\bibdata`)) {
+		tool, data = "bibtex", aux
+	} else {
+		return "", ""
+	}
+	sum := sha256.Sum256(append(data, bibState()...))
+	return tool, fmt.Sprintf("%x", sum[:8])
+}
+
+// bibNeeded return the tool to run before the next compilation, and why ("" if none):
+// the .bbl is missing, the citations or the .bib files changed since the last run, or the log asks for it.
+func bibNeeded() (tool, inputs, reason string) {
+	if mustNoBibliography || usesTectonic() {
+		return "", "", ""
+	}
+	tool, inputs = bibTool()
+	if len(tool) == 0 {
+		return "", "", ""
+	}
+	switch {
+	case isFileMissing(outBase + ".bbl"):
+		reason = "The bibliography is missing"
+	case inputs != loadState().Bibliography:
+		reason = "The citations or the .bib files changed"
+	default:
+		if log, err := ioutil.ReadFile(engineLog()); err == nil && reRunBib.Match(log) {
+			reason = "The log asks for " + tool
+		} else {
+			return "", "", ""
+		}
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		if !toolMissing[tool] && infoLevel >= infoErrors {
+			warning("%s: %s is needed, but it is not in the path.", reason, tool)
+		}
+		toolMissing[tool] = true
+		return "", "", ""
+	}
+	return tool, inputs, reason
+}
+
+// auxLabels return the .aux (and the .aux of the \include files), with the labels, the pages and the citations.
+func auxLabels() []byte {
+	aux, err := ioutil.ReadFile(outBase + ".aux")
+	if err != nil {
+		return nil
+	}
+	for _, match := range reAuxInput.FindAllSubmatch(aux, -1) {
+		if included, err := ioutil.ReadFile(filepath.Join(filepath.Dir(outBase), string(match[1]))); err == nil {
+			aux = append(aux, included...)
+		}
+	}
+	return aux
+}
+
+// bibliographyPasses run biber or bibtex after the compilation if the bibliography is outdated,
+// then a compilation reads the new .bbl. Only if it changes the .aux (labels, pages or \bibcite)
+// another compilation fixes the citations: a change of the entries only needs one.
+// The inputs of the run are kept in the state file, so the next starts know if the .bbl is up to date.
+func bibliographyPasses() error {
+	for pass := 0; pass < maxBibPasses; pass++ {
+		tool, inputs, reason := bibNeeded()
+		if len(tool) == 0 {
+			return nil
+		}
+		info(reason + ", run " + tool + ".")
+		if err := runTool("Build the bibliography with "+tool, tool, outBase); err != nil {
+			return atStage("bibliography", err)
+		}
+		state := loadState()
+		state.Bibliography = inputs
+		if err := saveState(state); err != nil && infoLevel >= infoErrors {
+			warning("Problem saving %s: %v", stateFileName(), err)
+		}
+		labels := auxLabels()
+		if err := compile(false); err != nil {
+			return err
+		}
+		if bytes.Equal(labels, auxLabels()) {
+			continue
+		}
+		info("The labels changed, compile again.")
+		if err := compile(false); err != nil {
+			return err
+		}
+	}
+	if _, _, reason := bibNeeded(); len(reason) > 0 && infoLevel >= infoErrors {
+		warning("%s after %d bibliography passes, no more pass.", reason, maxBibPasses)
+	}
+	return nil
+}
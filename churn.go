@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+)
+
+// auxSnapshot is the hash of the auxiliary files content, by file name.
+type auxSnapshot map[string][sha256.Size]byte
+
+// auxFileNames return the names of the auxiliary files of the document (the .fmt excepted).
+func auxFileNames() (names []string) {
+	for _, ext := range strings.Split(auxExtensions, ",") {
+		ext = strings.TrimSpace(ext)
+		if len(ext) > 0 && ext != "fmt" {
+			names = append(names, outBase+"."+ext)
+		}
+	}
+	return names
+}
+
+// takeAuxSnapshot hash the existing auxiliary files.
+func takeAuxSnapshot() auxSnapshot {
+	snapshot := make(auxSnapshot)
+	for _, name := range auxFileNames() {
+		if data, err := ioutil.ReadFile(name); err == nil {
+			snapshot[name] = sha256.Sum256(data)
+		}
+	}
+	return snapshot
+}
+
+// auxChanges return the auxiliary files created, modified or removed since the snapshot.
+func (before auxSnapshot) auxChanges() (changed []string) {
+	after := takeAuxSnapshot()
+	for _, name := range auxFileNames() {
+		hashBefore, existedBefore := before[name]
+		hashAfter, existsAfter := after[name]
+		if existedBefore != existsAfter || hashBefore != hashAfter {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reportAuxChurn print the auxiliary files changed by the compilation, and return if there are some.
+// They are read by the next compilation, so after the last one they mean that
+// the document may need another pass (cross references, table of contents...).
+func reportAuxChurn(before auxSnapshot, draft bool) bool {
+	changed := before.auxChanges()
+	if infoLevel < infoActions {
+		return len(changed) > 0
+	}
+	if len(changed) == 0 {
+		if infoLevel >= infoDebug {
+			info("No auxiliary file changed.")
+		}
+		return false
+	}
+	info(" changed", strings.Join(changed, ", "))
+	if !draft {
+		info("The auxiliary files changed: another compilation may be needed.")
+	}
+	return true
+}
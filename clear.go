@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+// the files that are never cleared, whatever the --aux-extensions list
+var defaultProtected = []string{"*.tex", "*.ltx", "*.md", "*.bib", "*.sty", "*.cls", "*.bst", "*.bbx", "*.cbx", "*.dtx", "*.ins", "*.csv", "*.conf"}
+
+var (
+	protectPatterns []string // the --protect values: more file patterns that are never cleared
+	mustConfirm     bool     // ask before clearing (--clear-confirm)
+)
+
+// the answer of a confirmation, when the standard input is read by readStdinRequests
+var pendingAnswer struct {
+	sync.Mutex
+	answer chan string
+}
+
+// isProtected check if the file matches a protected pattern (by its name, or by its path).
+// The generated .preamble.tex, .body.tex and .full.tex are not protected.
+func isProtected(fileName string) bool {
+	for _, suffix := range []string{".preamble.tex", ".body.tex", ".full.tex"} {
+		if strings.HasSuffix(fileName, suffix) {
+			return false
+		}
+	}
+	for _, pattern := range append(append([]string{}, defaultProtected...), protectPatterns...) {
+		pattern = nativePath(pattern)
+		if ok, _ := filepath.Match(pattern, filepath.Base(fileName)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Clean(fileName)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// safeExtensions return the extensions of the files that can be cleared:
+// the protected files are kept (with a warning), and with --clear-confirm the user is asked first.
+func safeExtensions(base, extensions string) string {
+	var safe, existing []string
+	for _, ext := range strings.Split(extensions, ",") {
+		ext = strings.TrimSpace(ext)
+		fileName := base + "." + ext
+		if len(ext) == 0 || isFileMissing(fileName) {
+			continue
+		}
+		if isProtected(fileName) {
+			if infoLevel >= infoErrors {
+				warning("The file %s is protected, it is not cleared (see --aux-extensions).", fileName)
+			}
+			continue
+		}
+		safe = append(safe, ext)
+		existing = append(existing, fileName)
+	}
+	if mustConfirm && len(existing) > 0 && !confirm(fmt.Sprintf("Clear %s? [y/N] ", strings.Join(existing, ", "))) {
+		info("Nothing cleared.")
+		return ""
+	}
+	return strings.Join(safe, ",")
+}
+
+// confirm ask the question on the terminal and return true if the answer is yes.
+// Without terminal the answer is no.
+func confirm(question string) bool {
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		info("No terminal to confirm: " + strings.TrimSuffix(question, " [y/N] ") + " No.")
+		return false
+	}
+	fmt.Print(question)
+	var answer string
+	if readsStdin {
+		// the next line read by readStdinRequests is the answer
+		ch := make(chan string)
+		pendingAnswer.Lock()
+		pendingAnswer.answer = ch
+		pendingAnswer.Unlock()
+		answer = <-ch
+	} else {
+		answer, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// answerPending send the line to the waiting confirmation, if any.
+func answerPending(line string) bool {
+	pendingAnswer.Lock()
+	ch := pendingAnswer.answer
+	pendingAnswer.answer = nil
+	pendingAnswer.Unlock()
+	if ch == nil {
+		return false
+	}
+	ch <- line
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// commandError is the failure of an engine or of a tool, with its cause:
+// the exit status or the signal, and the first error of its log (or of its output).
+type commandError struct {
+	command string // the program name
+	status  int    // the exit status, -1 if killed by a signal
+	signal  string // the signal that killed the program, if any
+	cause   string // the first error of the log or of the output, if any
+	hasLog  bool   // a log is written by the program (so it did not crash before)
+	err     error
+}
+
+func (e *commandError) Error() string {
+	message := e.command + " exited with status " + strconv.Itoa(e.status)
+	if len(e.signal) > 0 {
+		message = e.command + " was killed by the signal " + e.signal
+	}
+	if len(e.cause) > 0 {
+		message += ": " + e.cause
+	}
+	return message
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// newCommandError add to the error of the finished command its exit status (or signal) and the cause.
+// The errors of the commands that did not run (like a missing program) are kept as they are.
+func newCommandError(cmd *exec.Cmd, err error, cause string, hasLog bool) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	ce := &commandError{command: filepath.Base(cmd.Args[0]), status: exitErr.ExitCode(), cause: cause, hasLog: hasLog, err: err}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		ce.signal = status.Signal().String()
+	}
+	return ce
+}
+
+// firstLogError return the first error of the TeX log, with its line in the source if known.
+func firstLogError(log []byte) string {
+	messages := parseErrors(unwrapLog(log))
+	if len(messages) == 0 {
+		return ""
+	}
+	cause := "! " + messages[0].Message
+	if messages[0].Line > 0 {
+		cause += " (line " + strconv.Itoa(messages[0].Line) + ")"
+	}
+	return cause
+}
+
+// lastOutputLine return the last non empty line of the output of a program (usually its error message).
+func lastOutputLine(output []byte) string {
+	lines := strings.Split(string(bytes.TrimSpace(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// the name of the project configuration file (searched in the current folder)
+const configFileName = "latex-fast-compile.conf"
+
+// configLine is a `name = value` line from a configuration file.
+type configLine struct {
+	name    string
+	value   string
+	file    string
+	line    int
+	section string // the preset where the line is defined ("" at the top of the file)
+}
+
+// the presets defined in the configuration files (by name),
+// and the built-in ones (that the configuration files can replace)
+var presets = map[string][]configLine{
+	// tagged PDF (accessibility): the LaTeX tagging code and the check of the output
+	"accessible": {
+		{name: "document-metadata", value: "testphase=phase-III,lang=en", file: "the built-in presets"},
+		{name: "check-tagging", value: "true", file: "the built-in presets"},
+	},
+}
+
+// userConfigFile return the name of the user configuration file (that may not exist),
+// or an empty string if there is no user configuration folder.
+func userConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "latex-fast-compile", configFileName)
+}
+
+// readConfig read the configuration file and return its `name = value` lines.
+// Empty lines and lines starting with `#` are ignored.
+// A line without `=` is a boolean flag set to true.
+// The lines after `[name]` belong to the preset name.
+func readConfig(fileName string) (lines []configLine, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			value = "true"
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "--")
+		value = strings.TrimSpace(value)
+		lines = append(lines, configLine{name: name, value: value, file: fileName, line: num, section: section})
+	}
+
+	return lines, scanner.Err()
+}
+
+// applyConfig set the flags from the configuration lines.
+func applyConfig(lines []configLine) (err error) {
+	for _, l := range lines {
+		if flag.Lookup(l.name) == nil {
+			err = errors.New("Unknown option " + l.name + ".")
+		} else {
+			err = flag.Set(l.name, l.value)
+		}
+		if err != nil {
+			return fmt.Errorf("Problem in %s at line %d: %w", l.file, l.line, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig set the flags from the configuration file (if it exists), and keep its presets.
+// It is called before the command line parsing, so the command line flags take precedence.
+// A preset defined again replaces the previous one (the project presets replace the user ones).
+func loadConfig(fileName string) error {
+	if len(fileName) == 0 || isFileMissing(fileName) {
+		return nil
+	}
+	lines, err := readConfig(fileName)
+	if err != nil {
+		return atStage("configuration", fmt.Errorf("Problem reading %s: %w", fileName, err))
+	}
+	var topLines []configLine
+	fromFile := make(map[string][]configLine)
+	for _, l := range lines {
+		if len(l.section) == 0 {
+			topLines = append(topLines, l)
+		} else {
+			fromFile[l.section] = append(fromFile[l.section], l)
+		}
+	}
+	for name, presetLines := range fromFile {
+		presets[name] = presetLines
+	}
+	return atStage("configuration", applyConfig(topLines))
+}
+
+// presetValue is the --preset flag: setting it sets the options of the preset.
+type presetValue struct {
+	names    []string
+	applying map[string]bool // the presets being set (to stop the loops)
+}
+
+// the --preset flag
+var presetFlag = presetValue{applying: make(map[string]bool)}
+
+func (p *presetValue) String() string {
+	return strings.Join(p.names, ",")
+}
+
+func (p *presetValue) Type() string {
+	return "string"
+}
+
+// Set the options of the preset, at the place of the --preset flag.
+// So the options given after it take precedence.
+func (p *presetValue) Set(name string) error {
+	lines, ok := presets[name]
+	if !ok {
+		return errors.New("Unknown preset " + name + ".")
+	}
+	if p.applying[name] {
+		return errors.New("The preset " + name + " uses itself.")
+	}
+	p.applying[name] = true
+	defer delete(p.applying, name)
+	p.names = append(p.names, name)
+	return applyConfig(lines)
+}
+
+// the environment variable with the personal default options
+const optionsEnvVar = "LATEX_FAST_COMPILE_OPTS"
+
+// loadEnvOptions parse the options of the LATEX_FAST_COMPILE_OPTS variable
+// (like "--temp-folder=build --xelatex"), before the project configuration and the command line (see loadDefaultOptions).
+func loadEnvOptions() error {
+	value := os.Getenv(optionsEnvVar)
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil
+	}
+	args, err := splitWords(value, false)
+	if err == nil {
+		err = flag.CommandLine.Parse(args)
+	}
+	if err == nil && flag.NArg() > 0 {
+		err = errors.New("The file name " + flag.Arg(0) + " can't be set here.")
+	}
+	if err != nil {
+		return atStage("configuration", fmt.Errorf("Problem in %s: %w", optionsEnvVar, err))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "path/filepath"
+
+var (
+	dataFiles    []string // the --data patterns: the data files (CSV, JSON...) read by the body
+	preambleData []string // the --preamble-data patterns: the data files read by the preamble
+)
+
+// watchPattern is a glob pattern of additional files to watch, with the option that gives it.
+type watchPattern struct {
+	option  string
+	pattern string
+}
+
+// extraPatterns return the patterns of the additional files to watch
+// (--watch-also, --data and --preamble-data).
+func extraPatterns() (patterns []watchPattern) {
+	for _, pattern := range watchAlso {
+		patterns = append(patterns, watchPattern{"watch-also", pattern})
+	}
+	for _, pattern := range dataFiles {
+		patterns = append(patterns, watchPattern{"data", pattern})
+	}
+	for _, pattern := range preambleData {
+		patterns = append(patterns, watchPattern{"preamble-data", pattern})
+	}
+	return patterns
+}
+
+// matchesPattern check if the file matches one of the glob patterns.
+func matchesPattern(patterns []string, fileName string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), filepath.Clean(fileName)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isDataFile check if the file is a data file of the document (--data or --preamble-data).
+func isDataFile(fileName string) bool {
+	return matchesPattern(dataFiles, fileName) || matchesPattern(preambleData, fileName)
+}
+
+// isPreambleData check if the file is read by the preamble, so its changes rebuild the .fmt.
+func isPreambleData(fileName string) bool {
+	return matchesPattern(preambleData, fileName)
+}
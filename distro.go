@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// texDistribution describe how a TeX distribution differs from the others.
+// The code should ask the current distribution (distro) instead of testing its name.
+type texDistribution struct {
+	name            string // the name printed by --version
+	family          string // the distribution it is based on (texlive for MacTeX, TinyTeX...)
+	marker          string // found in the `--version` output of the engine
+	noShellEscape   string // the option disabling the shell escape
+	shellRestricted string // the option allowing only the restricted shell escape
+	kpathseaEnv     bool   // the texmf.cnf variables (max_print_line, shell_escape_commands...) are read from the environment
+	auxDirectory    bool   // has -aux-directory: the .pdf and .synctex stay in the main folder
+	formatOption    string // the option that loads a format by its path
+	note            string // an advice shown by the doctor subcommand
+}
+
+// the distributions based on the web2c implementation (with kpathsea)
+var web2cDistribution = texDistribution{
+	noShellEscape:   "-no-shell-escape",
+	shellRestricted: "-shell-restricted",
+	kpathseaEnv:     true,
+	formatOption:    "-fmt=",
+}
+
+var miktexDistribution = texDistribution{
+	name:            "miktex",
+	family:          "miktex",
+	marker:          "MiKTeX",
+	noShellEscape:   "-disable-write18",
+	shellRestricted: "-restrict-write18",
+	auxDirectory:    true,
+	formatOption:    "-undump=",
+	note:            "The missing packages are installed on the fly if allowed in the MiKTeX Console.",
+}
+
+var texliveDistribution = web2cVariant("texlive", "texlive", "TeX Live", "")
+
+// tectonicDistribution is the self-contained tectonic engine (see tectonic.go).
+var tectonicDistribution = texDistribution{
+	name:          "tectonic",
+	family:        "tectonic",
+	marker:        "Tectonic",
+	noShellEscape: "--untrusted",
+	note:          "The packages are downloaded from the tectonic bundle on their first use.",
+}
+
+var w32texDistribution = web2cVariant("w32tex", "w32tex", "W32TeX", "The packages are not managed: the missing ones should be added by hand.")
+
+// the distributions recognized by the `--version` output of the engine
+var distributions = []texDistribution{miktexDistribution, texliveDistribution, w32texDistribution, tectonicDistribution}
+
+// unknownDistribution is used when the distribution is not recognized.
+// It behaves like TeX Live (the web2c options are the most common), but with an empty name.
+var unknownDistribution = web2cVariant("", "", "", "The distribution is unknown, the TeX Live options are used.")
+
+// the distribution of the current engine
+var distro = unknownDistribution
+
+// web2cVariant return a web2c based distribution with the given name.
+func web2cVariant(name, family, marker, note string) texDistribution {
+	d := web2cDistribution
+	d.name, d.family, d.marker, d.note = name, family, marker, note
+	return d
+}
+
+// the TeX Live installation folders: TeX Live and MacTeX in texlive/YYYY, BasicTeX in texlive/YYYYbasic
+var reTeXLiveFolder = regexp.MustCompile(`[/\\]texlive[/\\]\d{4}(basic)?[/\\]`)
+
+// detectDistribution return the distribution recognized in the engine version.
+// The TeX Live variants (MacTeX, BasicTeX, TinyTeX) are recognized by the engine location.
+func detectDistribution(versionStr, enginePath string) texDistribution {
+	for _, d := range distributions {
+		if !strings.Contains(versionStr, d.marker) {
+			continue
+		}
+		if d.family != "texlive" {
+			return d
+		}
+		if resolved, err := filepath.EvalSymlinks(enginePath); err == nil {
+			enginePath = resolved
+		}
+		if strings.Contains(strings.ToLower(enginePath), "tinytex") {
+			return web2cVariant("tinytex", "texlive", d.marker, "A small TeX Live: the missing packages can be installed with `tlmgr install` (or automatically by the tinytex R package).")
+		}
+		if m := reTeXLiveFolder.FindStringSubmatch(enginePath); m != nil && runtime.GOOS == "darwin" {
+			if len(m[1]) > 0 {
+				return web2cVariant("basictex", "texlive", d.marker, "A small TeX Live: the missing packages can be installed with `sudo tlmgr install`.")
+			}
+			return web2cVariant("mactex", "texlive", d.marker, "")
+		}
+		return d
+	}
+	return unknownDistribution
+}
+
+// enginePath return the location of the engine, or an empty string if it is not in the path.
+func enginePath(engine string) string {
+	path, err := exec.LookPath(engine)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// usesAuxDirectory check if the temp folder is given with -aux-directory.
+// Then the .pdf and .synctex are written in the main folder under the job name,
+// so it is used only when the job name is the source name
+// (otherwise they are moved and renamed from the temp folder anyway).
+func usesAuxDirectory() bool {
+	return distro.auxDirectory && inBase == inBaseOriginal
+}
+
+// collectFormat move the new .fmt to the temp folder, if the engine wrote it
+// in the main folder (MiKTeX writes the format in the output directory, not in the aux one).
+func collectFormat() {
+	if len(outFolder) == 0 || !isFileMissing(outBase+".fmt") || isFileMissing(inBase+".fmt") {
+		return
+	}
+	info(" move", inBase+".fmt", "to", outBase+".fmt")
+	if err := moveFile(inBase+".fmt", outBase+".fmt"); err != nil && infoLevel >= infoErrors {
+		warning("The .fmt stays in the main folder: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// the tools used by some options, with the reason
+var optionalTools = []struct {
+	name   string
+	reason string
+}{
+	{"pdftotext", "--verify-against-full compares the text"},
+	{"pandoc", "Markdown sources, --via-pandoc and --target"},
+	{"tectonic", "--engine=tectonic, without precompiled preamble"},
+	{"kpsewhich", "the TeX Live and W32TeX file lookup"},
+	{"tlmgr", "the TeX Live package manager"},
+	{"mpm", "the MiKTeX package manager"},
+}
+
+// doctor is the `doctor` subcommand.
+// It shows the distribution recognized for each engine, and the tools found in the path.
+func doctor(args []string) error {
+	if len(args) > 0 {
+		return errors.New("The doctor subcommand has no parameters.")
+	}
+
+	found := 0
+	notes := []string{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "engine\tdistribution\tbased on\tlocation\tversion")
+	for _, engine := range []string{"pdftex", "xetex"} {
+		path := enginePath(engine)
+		if len(path) == 0 {
+			fmt.Fprintln(w, engine+"\t-\t-\tnot found\t-")
+			continue
+		}
+		found++
+		version := getTeXVersion(engine)
+		d := detectDistribution(version, path)
+		name, family := d.name, d.family
+		if len(name) == 0 {
+			name, family = "unknown", "-"
+		}
+		fmt.Fprintln(w, engine+"\t"+name+"\t"+family+"\t"+path+"\t"+version)
+		if len(d.note) > 0 {
+			notes = append(notes, engine+": "+d.note)
+		}
+	}
+	w.Flush()
+	for _, note := range notes {
+		fmt.Println(note)
+	}
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "tool\tlocation\tused for")
+	for _, tool := range optionalTools {
+		path := enginePath(tool.name)
+		if len(path) == 0 {
+			path = "not found"
+		}
+		fmt.Fprintln(w, tool.name+"\t"+path+"\t"+tool.reason)
+	}
+	w.Flush()
+	fmt.Println()
+
+	if found == 0 {
+		return errors.New("No TeX engine (pdftex or xetex) found in the current path.")
+	}
+	return nil
+}
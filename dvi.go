@@ -0,0 +1,20 @@
+package main
+
+// the program converting the .dvi of the DVI engines to .pdf
+const dviDriver = "dvipdfmx"
+
+// writesDVI check if the engine writes a .dvi instead of a .pdf, like the pTeX engines
+// of the Japanese toolchain (platex, uplatex). The .pdf is made by dvipdfmx.
+func writesDVI() bool {
+	for _, e := range knownEngines {
+		if e.name == texCompiler {
+			return e.dvi
+		}
+	}
+	return false
+}
+
+// dviToPDF convert the .dvi of the job to a .pdf with the same base name (the .synctex still matches).
+func dviToPDF(base string) error {
+	return runTool("Convert "+base+".dvi with "+dviDriver, dviDriver, "-q", "-o", base+".pdf", base+".dvi")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the --edit-page value: "report" the page of the last edit after each rebuild,
+// "preview" also extract it to a -page.pdf ("" for none)
+var editPageMode string
+
+var (
+	lastSourceLines []string // the source lines of the previous build, to locate the edit
+	editedLine      int      // the first line changed by the last edit (0 if unknown)
+)
+
+// checkEditPage check the --edit-page value. The page is found with the .synctex.
+func checkEditPage() error {
+	switch editPageMode {
+	case "", "report", "preview":
+	default:
+		return errors.New("Invalid --edit-page value " + editPageMode + " (use report or preview).")
+	}
+	if len(editPageMode) == 0 {
+		return nil
+	}
+	if mustNotSync {
+		return errors.New("The --edit-page option needs the .synctex, it can't be used with --no-synctex.")
+	}
+	if mustUsePandoc {
+		return errors.New("The --edit-page option needs a .tex source, it can't be used with --via-pandoc.")
+	}
+	if editPageMode == "preview" {
+		if outputFormat != "pdf" {
+			return errors.New("The --edit-page=preview option needs a .pdf output.")
+		}
+		if _, err := exec.LookPath("qpdf"); err != nil {
+			return errors.New("Can't find qpdf in the current path (needed by --edit-page=preview).")
+		}
+	}
+	return nil
+}
+
+// noteEditedLine compare the source with the one of the previous build to locate the last edit.
+// Without change (like a --every rebuild) the previous location is kept.
+func noteEditedLine() {
+	if len(editPageMode) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(inBaseOriginal + ".tex")
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if lastSourceLines != nil {
+		if line := firstChangedLine(lastSourceLines, lines); line > 0 {
+			editedLine = line
+		}
+	}
+	lastSourceLines = lines
+}
+
+// firstChangedLine return the first line (from 1) that differs between the old and the new lines, 0 if none.
+func firstChangedLine(before, after []string) int {
+	for i := range after {
+		if i >= len(before) || before[i] != after[i] {
+			return i + 1
+		}
+	}
+	if len(before) > len(after) {
+		// the end of the source was removed
+		return len(after)
+	}
+	return 0
+}
+
+// synctexPage return the page of the .synctex with the closest record to the line of the source, 0 if none.
+// The records are like "[tag,line:..." or "htag,line:...", inside the "{page" ... "}page" blocks,
+// and the tag is the one of the "Input:tag:path" of the source.
+func synctexPage(syncName, source string, line int) (int, error) {
+	file, err := os.Open(syncName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	tag := ""
+	page, bestPage, bestDistance := 0, 0, -1
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := scanner.Text()
+		if len(record) < 2 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(record, "Input:"):
+			if inTag, path, found := strings.Cut(record[len("Input:"):], ":"); found && filepath.Base(path) == filepath.Base(source) {
+				tag = inTag
+			}
+		case record[0] == '{':
+			page, _ = strconv.Atoi(record[1:])
+		case len(tag) > 0 && strings.IndexByte("[(hvxkg$", record[0]) >= 0:
+			recordTag, rest, found := strings.Cut(record[1:], ",")
+			if !found || recordTag != tag {
+				continue
+			}
+			lineText, _, _ := strings.Cut(rest, ":")
+			recordLine, err := strconv.Atoi(lineText)
+			if err != nil {
+				continue
+			}
+			distance := recordLine - line
+			if distance < 0 {
+				distance = -distance
+			}
+			if bestDistance < 0 || distance < bestDistance {
+				bestPage, bestDistance = page, distance
+			}
+		}
+	}
+	return bestPage, scanner.Err()
+}
+
+// besideSource return the path of this output name next to the source (outside of the isolated folder).
+func besideSource(name string) string {
+	if len(isolatedDir) > 0 {
+		return filepath.Join(sourceDir, name)
+	}
+	return name
+}
+
+// reportEditPage print the page of the last edit, and write it to the .page file
+// (so the editors can move the viewer to it). The "preview" mode also extracts the page
+// to the -page.pdf. This is done right after the compilation, before the post-steps.
+func reportEditPage() error {
+	if len(editPageMode) == 0 || editedLine == 0 {
+		return nil
+	}
+	source := inBaseOriginal + ".tex"
+	page, err := synctexPage(outputBase+".synctex", source, editedLine)
+	if err != nil {
+		return atStage("page", fmt.Errorf("Problem reading %s: %w", outputBase+".synctex", err))
+	}
+	if page == 0 {
+		info("The edited line", editedLine, "of", source, "is not in the output.")
+		return nil
+	}
+	info("The edited line", editedLine, "of", source, "is on page", strconv.Itoa(page)+".")
+	pageName := besideSource(outputBase + ".page")
+	if err := ioutil.WriteFile(pageName, []byte(strconv.Itoa(page)+"\n"), 0644); err != nil {
+		return atStage("page", fmt.Errorf("Problem writing %s: %w", pageName, err))
+	}
+	if editPageMode == "preview" {
+		pdfName := outputBase + ".pdf"
+		previewName := besideSource(outputBase + "-page.pdf")
+		if err := runTool("Extract page "+strconv.Itoa(page)+" to "+previewName, "qpdf", pdfName, "--pages", pdfName, strconv.Itoa(page), "--", previewName); err != nil {
+			return atStage("page", err)
+		}
+	}
+	return nil
+}
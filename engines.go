@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// engineInfo describe a TeX engine and its capabilities.
+type engineInfo struct {
+	name    string // the executable name
+	format  string // the corresponding latex format
+	canDump bool   // can dump a format with -ini
+	synctex bool   // can produce a .synctex file
+	unicode bool   // can use system fonts (fontspec, polyglossia...)
+	lua     bool   // can run lua code (luacode, \directlua...)
+	dvi     bool   // writes a .dvi, converted to .pdf by dvipdfmx
+	binary  string // the engine really run, written in the formats, if it is another one (a link)
+}
+
+// the engines we know about
+var knownEngines = []engineInfo{
+	{name: "pdftex", format: "pdflatex", canDump: true, synctex: true},
+	{name: "xetex", format: "xelatex", canDump: true, synctex: true, unicode: true},
+	{name: "luatex", format: "lualatex", canDump: true, synctex: true, unicode: true, lua: true},
+	{name: "uptex", format: "uplatex", canDump: true, synctex: true, dvi: true, binary: "euptex"},
+	{name: "euptex", format: "uplatex", canDump: true, synctex: true, dvi: true},
+	{name: "eptex", format: "platex", canDump: true, synctex: true, dvi: true},
+	{name: "tectonic", format: "latex", synctex: true, unicode: true},
+}
+
+var (
+	engineFlag string // the --engine value: the TeX engine executable, "" for the default one
+	formatFlag string // the --format value: the base format, "" for the one of the engine
+)
+
+// setEngine set the engine (texCompiler) and its base format (latexFormat).
+// The default engine is pdftex, or xetex with --xelatex.
+// The format of an unknown engine must be given with --format.
+func setEngine() error {
+	texCompiler = engineFlag
+	if len(texCompiler) == 0 {
+		texCompiler = "pdftex"
+		if mustUseXe {
+			texCompiler = "xetex"
+		}
+	}
+	// the xelatex adaptations of the preamble depend on it
+	mustUseXe = texCompiler == "xetex"
+	// tectonic has its own formats, the whole source is compiled
+	if usesTectonic() {
+		if len(formatFlag) > 0 {
+			return errors.New("Tectonic uses its own format, --format can't be used with it.")
+		}
+		mustCompileAll = true
+		return nil
+	}
+	latexFormat = formatFlag
+	if len(latexFormat) > 0 {
+		return nil
+	}
+	for _, e := range knownEngines {
+		if e.name == texCompiler {
+			if !e.canDump {
+				return errors.New("The engine " + texCompiler + " can't precompile the preamble.")
+			}
+			latexFormat = e.format
+			return nil
+		}
+	}
+	return errors.New("Unknown engine " + texCompiler + ", set its format with --format (like --format=platex).")
+}
+
+// engineBinary return the engine really run for the engine name (the name written in its formats).
+func engineBinary(name string) string {
+	for _, e := range knownEngines {
+		if e.name == name && len(e.binary) > 0 {
+			return e.binary
+		}
+	}
+	return name
+}
+
+// usesPackage check if the package is loaded in the preamble (without its comments, see readPreamble).
+func usesPackage(preamble, pkg string) bool {
+	for _, match := range reLoadPackage.FindAllStringSubmatch(preamble, -1) {
+		for _, name := range strings.Split(match[1], ",") {
+			if strings.TrimSpace(name) == pkg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the packages that need an engine with system fonts, or with lua
+var (
+	unicodePackages = []string{"fontspec", "polyglossia", "unicode-math"}
+	luaPackages     = []string{"luacode", "luatexbase", "luaotfload"}
+)
+
+// the end of the preamble with the default --split pattern
+var reDefaultSplit = regexp.MustCompile(defaultSplitPattern)
+
+// a comment: an unescaped % (after an even number of backslashes) up to the end of the line
+var reComment = regexp.MustCompile(`(?m)(^|[^\\])((?:\\\\)*)%.*$`)
+
+// stripComments remove the comments of the TeX code, and keep the line numbers.
+// So the commented packages (like % \usepackage{fontspec}) are not seen as loaded.
+func stripComments(code string) string {
+	return reComment.ReplaceAllString(code, "${1}${2}")
+}
+
+// readPreamble return the preamble of the source, up to the --split pattern (or \begin{document}),
+// without its comments.
+func readPreamble(sourceName string) (string, error) {
+	texdata, err := ioutil.ReadFile(sourceName)
+	if err != nil {
+		return "", err
+	}
+	preamble := string(texdata)
+	reEnd := reDefaultSplit
+	if len(splitPattern) > 0 && splitPattern != defaultSplitPattern {
+		if re, err := regexp.Compile(splitPattern); err == nil {
+			reEnd = re
+		}
+	}
+	if loc := reEnd.FindStringIndex(preamble); loc != nil {
+		preamble = preamble[:loc[0]]
+	}
+	return stripComments(preamble), nil
+}
+
+// loadedPackages return the packages of the list loaded in the preamble.
+func loadedPackages(preamble string, packages []string) []string {
+	loaded := []string{}
+	for _, pkg := range packages {
+		if usesPackage(preamble, pkg) {
+			loaded = append(loaded, pkg)
+		}
+	}
+	return loaded
+}
+
+// packageNeeds return what needs an engine with system fonts, and with lua, in the preamble
+// (the packages, and \directlua).
+func packageNeeds(preamble string) (unicode, lua []string) {
+	unicode = loadedPackages(preamble, unicodePackages)
+	lua = loadedPackages(preamble, luaPackages)
+	if strings.Contains(preamble, `\directlua`) {
+		lua = append(lua, `\directlua`)
+	}
+	return unicode, lua
+}
+
+// documentNeeds return the engine capabilities needed by the preamble.
+func documentNeeds(preamble string) engineInfo {
+	unicode, lua := packageNeeds(preamble)
+	return engineInfo{unicode: len(unicode) > 0, lua: len(lua) > 0}
+}
+
+// detectEngine select the engine needed by the preamble, when no engine is given:
+// lualatex for the lua code, xelatex for the system fonts, else the default pdflatex.
+// A given engine is kept, with a warning if it lacks a needed capability,
+// as the precompilation would fail deep in the log.
+func detectEngine() {
+	// the side by side builds are given their engines
+	if len(engineList) > 0 || len(engineRun) > 0 {
+		return
+	}
+	preamble, err := readPreamble(inBaseOriginal + ".tex")
+	if err != nil {
+		return
+	}
+	unicode, lua := packageNeeds(preamble)
+	if len(engineFlag) > 0 || mustUseXe {
+		engine := engineFlag
+		if len(engine) == 0 {
+			engine = "xetex"
+		}
+		for _, e := range knownEngines {
+			if e.name != engine {
+				continue
+			}
+			missing := []string{}
+			if !e.lua {
+				missing = append(missing, lua...)
+			}
+			if !e.unicode {
+				missing = append(missing, unicode...)
+			}
+			if len(missing) > 0 && infoLevel >= infoErrors {
+				warning("The preamble loads %s, which %s can't compile (see `latex-fast-compile engines`).", strings.Join(missing, ", "), engine)
+			}
+		}
+		return
+	}
+	if len(lua) > 0 {
+		engineFlag = "luatex"
+		info("The preamble loads " + strings.Join(lua, ", ") + ": use lualatex (set --engine to override).")
+	} else if len(unicode) > 0 {
+		mustUseXe = true
+		info("The preamble loads " + strings.Join(unicode, ", ") + ": use xelatex (set --engine to override).")
+	}
+}
+
+// isCompatible check if the engine has all the needed capabilities.
+func (e engineInfo) isCompatible(needs engineInfo) bool {
+	return (!needs.unicode || e.unicode) && (!needs.lua || e.lua)
+}
+
+// yesNo is used to display booleans in tables.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// listEngines is the `engines` subcommand.
+// It lists the engines found in the path with their capabilities,
+// and their compatibility with the document if one is given.
+func listEngines(args []string) error {
+	if len(args) > 1 {
+		return errors.New("No more than one parameter (.tex filename) can be specified.")
+	}
+	var needs engineInfo
+	withDocument := len(args) == 1
+	if withDocument {
+		sourceName := strings.TrimSuffix(args[0], ".tex") + ".tex"
+		preamble, err := readPreamble(sourceName)
+		if err != nil {
+			return fmt.Errorf("Problem reading %s: %w", sourceName, err)
+		}
+		needs = documentNeeds(preamble)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "engine\tformat\t-ini\tsynctex\toutput\tversion"
+	if withDocument {
+		header += "\tdocument"
+	}
+	fmt.Fprintln(w, header)
+	found := 0
+	for _, e := range knownEngines {
+		if _, err := exec.LookPath(e.name); err != nil {
+			continue
+		}
+		found++
+		output := "pdf"
+		if e.dvi {
+			output = "dvi"
+		}
+		line := e.name + "\t" + e.format + "\t" + yesNo(e.canDump) + "\t" + yesNo(e.synctex) + "\t" + output + "\t" + getTeXVersion(e.name)
+		if withDocument {
+			if e.isCompatible(needs) {
+				line += "\tcompatible"
+			} else {
+				line += "\tnot compatible"
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+	if found == 0 {
+		return errors.New("No TeX engine found in the current path.")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// explainDocument is the `explain` subcommand.
+// It splits the source as the compilation would do (with the same options),
+// and shows the changes made to the source, why they were made, and the generated files.
+func explainDocument(args []string) error {
+	os.Args = append(os.Args[:1], args...)
+	if err := SetParameters(); err != nil {
+		return atStage("parameters", err)
+	}
+	// the messages of the split are replaced by the transformations list
+	infoLevel = infoErrors
+	err := convertMarkdown()
+	if err == nil {
+		err = splitTeX()
+	}
+	defer clearTeX()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Source:", inBaseOriginal+".tex")
+	fmt.Println("Engine:", texCompiler, "("+latexFormat+")")
+	if mustCompileAll {
+		fmt.Println("The preamble is not precompiled: the source is compiled as is.")
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("Transformations:")
+	for _, t := range transformations {
+		where := "added"
+		if t.line > 0 {
+			where = "line " + strconv.Itoa(t.line)
+		}
+		fmt.Printf("  %-9s %-16s %s\n", where, t.action, strings.ReplaceAll(t.text, "\n", "\n"+strings.Repeat(" ", 29)))
+		fmt.Printf("  %-26s %s\n", "", t.reason)
+	}
+	fmt.Println()
+	fileNames := []string{inBase + ".preamble.tex", inBase + ".body.tex"}
+	if len(baseHash) > 0 {
+		fileNames = append([]string{baseName(inBase) + ".tex"}, fileNames...)
+	}
+	for _, fileName := range fileNames {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("Problem reading %s: %w", fileName, err)
+		}
+		fmt.Println(delimit(fileName, "end "+fileName, strings.TrimRight(string(data), "\n")))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+var (
+	outputModeFlag string      // the --output-mode value, in octal
+	outputMode     os.FileMode // the permissions of the outputs, 0 to keep the ones of the engine (umask)
+)
+
+// setOutputMode check and set the --output-mode permissions.
+func setOutputMode() error {
+	outputMode = 0
+	if len(outputModeFlag) == 0 {
+		return nil
+	}
+	mode, err := strconv.ParseUint(outputModeFlag, 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("Invalid --output-mode value " + outputModeFlag + " (use octal permissions like 0644).")
+	}
+	outputMode = os.FileMode(mode)
+	return nil
+}
+
+// applyOutputMode set the --output-mode permissions of the output and of its .synctex.
+func applyOutputMode() error {
+	if outputMode == 0 {
+		return nil
+	}
+	for _, fileName := range []string{outputBase + "." + outputExtension(), outputBase + ".synctex"} {
+		if isFileMissing(fileName) {
+			continue
+		}
+		if err := os.Chmod(fileName, outputMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyAttributes give to the copy the permissions and the modification time of the original.
+func copyAttributes(src, dst string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, stat.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+}
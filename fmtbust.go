@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var (
+	fmtBust         []string         // the --fmt-bust patterns: the text that outdates the .fmt when it changes
+	fmtBustPatterns []*regexp.Regexp // the compiled --fmt-bust patterns
+	fmtBustHash     string           // the hash of the text matching the patterns in the current source
+)
+
+// checkFmtBust compile the --fmt-bust patterns.
+func checkFmtBust() error {
+	fmtBustPatterns = nil
+	for _, pattern := range fmtBust {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New("Invalid --fmt-bust pattern " + pattern + ": " + err.Error() + ".")
+		}
+		fmtBustPatterns = append(fmtBustPatterns, re)
+	}
+	return nil
+}
+
+// bustHash return the hash of the text matching the --fmt-bust patterns, anywhere in the source.
+func bustHash(texdata []byte) string {
+	var matches [][]byte
+	for _, re := range fmtBustPatterns {
+		matches = append(matches, re.FindAll(texdata, -1)...)
+	}
+	sum := sha256.Sum256(bytes.Join(matches, []byte("\n")))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// checkFmtBustText rebuild the .fmt if the text matching the --fmt-bust patterns changed since its precompilation.
+// The preamble can depend on the text outside of it, like the class options set with \def before \documentclass
+// and used by the class, or a \newif switched in the body and read at \begin{document}.
+// The .fmt built without these patterns are rebuilt once.
+func checkFmtBustText(texdata []byte) {
+	if len(fmtBustPatterns) == 0 {
+		return
+	}
+	fmtBustHash = bustHash(texdata)
+	if mustBuildFormat || isFileMissing(outBase+".fmt") {
+		return
+	}
+	if origin := loadState().Format; origin == nil || origin.BustHash != fmtBustHash {
+		info("The text matching --fmt-bust changed, the .fmt is rebuilt.")
+		mustBuildFormat = true
+	}
+}
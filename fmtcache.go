@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// formatState is the origin of a .fmt: the source and the engine that built it,
+// with the hash of the preamble to find if the .fmt is outdated.
+type formatState struct {
+	Source       string `json:"source"` // the absolute path of the source
+	Engine       string `json:"engine"`
+	Split        string `json:"split"` // the --split pattern
+	PreambleHash string `json:"preambleHash"`
+	BustHash     string `json:"bustHash,omitempty"` // the hash of the text matching --fmt-bust
+}
+
+// preambleHash return the hash of the preamble of the source, found with the split pattern.
+func preambleHash(sourceName, split string) (string, error) {
+	data, err := ioutil.ReadFile(sourceName)
+	if err != nil {
+		return "", err
+	}
+	re, err := regexp.Compile(split)
+	if err != nil {
+		return "", err
+	}
+	loc := re.FindIndex(data)
+	if loc == nil {
+		return "", errors.New("no end of preamble")
+	}
+	sum := sha256.Sum256(data[:loc[0]])
+	return fmt.Sprintf("%x", sum[:8]), nil
+}
+
+// rememberFormat save the origin of the new .fmt in the state file.
+func rememberFormat() {
+	sourceName, err := filepath.Abs(inBaseOriginal + ".tex")
+	if err != nil {
+		return
+	}
+	hash, err := preambleHash(sourceName, splitPattern)
+	if err != nil {
+		return
+	}
+	state := loadState()
+	state.Format = &formatState{Source: sourceName, Engine: texCompiler, Split: splitPattern, PreambleHash: hash, BustHash: fmtBustHash}
+	if err := saveState(state); err != nil && infoLevel >= infoErrors {
+		warning("Problem saving %s: %v", stateFileName(), err)
+	}
+}
+
+// formatCommand is the `fmt` subcommand. It manages the precompiled preambles without compiling
+// the documents, like fmtutil does for the formats of the distribution:
+// `fmt build [--option...] file.tex` precompiles the preamble, `fmt list [folder...]` shows the .fmt files
+// and their state, and `fmt clean [--outdated] [folder...]` removes them.
+func formatCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Missing fmt action (build, list or clean).")
+	}
+	switch args[0] {
+	case "build":
+		return buildFormat(args[1:])
+	case "list":
+		return listFormats(args[1:])
+	case "clean":
+		return cleanFormats(args[1:])
+	}
+	return errors.New("Unknown fmt action " + args[0] + " (use build, list or clean).")
+}
+
+// buildFormat precompile the preamble of the document (with the same options as the compilation),
+// so the next compilations (of this tool, or of the editor plugins) start with it.
+func buildFormat(args []string) error {
+	os.Args = append(os.Args[:1], append([]string{"--no-watch"}, args...)...)
+	if err := SetParameters(); err != nil {
+		return atStage("parameters", err)
+	}
+	if mustCompileAll {
+		return errors.New("The preamble of " + inBaseOriginal + ".tex is not precompiled (--skip-fmt, tectonic or the ctex classes).")
+	}
+	mustBuildFormat = true
+	defer clearTeX()
+	err := convertMarkdown()
+	if err == nil {
+		err = splitTeX()
+	}
+	if err == nil {
+		err = createTempFolder()
+	}
+	if err == nil {
+		err = precompile()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Format:", outBase+".fmt")
+	return nil
+}
+
+// formatEntry is a .fmt found by the list and clean actions.
+type formatEntry struct {
+	name   string
+	size   int64
+	state  buildState
+	ours   bool   // has a state file, so it is built by this tool
+	base   bool   // the base format of a layered preamble (see --base-split)
+	status string // up to date, outdated...
+}
+
+// findFormats return the .fmt files in the folders (and their sub folders, except the hidden ones).
+func findFormats(folders []string) (formats []formatEntry, err error) {
+	if len(folders) == 0 {
+		folders = []string{"."}
+	}
+	for _, folder := range folders {
+		err = filepath.Walk(nativePath(folder), func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fileInfo.IsDir() {
+				if path != nativePath(folder) && strings.HasPrefix(fileInfo.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) == ".fmt" {
+				formats = append(formats, newFormatEntry(path))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Problem listing the formats of %s: %w", folder, err)
+		}
+	}
+	return formats, nil
+}
+
+// newFormatEntry read the state file of the .fmt, and check if the .fmt is still up to date.
+func newFormatEntry(name string) (entry formatEntry) {
+	entry.name = name
+	stateName := strings.TrimSuffix(name, ".fmt") + "." + stateExtension
+	if strings.HasSuffix(name, ".base.fmt") && isFileMissing(stateName) {
+		// the base format shares the state file of the document
+		entry.base = true
+		stateName = strings.TrimSuffix(name, ".base.fmt") + "." + stateExtension
+	}
+	if data, err := ioutil.ReadFile(stateName); err == nil {
+		json.Unmarshal(data, &entry.state)
+		entry.ours = !entry.base || len(entry.state.BaseFormat) > 0
+	}
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		// a link to the in-memory .fmt, gone after a reboot
+		entry.status = "missing in memory"
+		return entry
+	}
+	entry.size = fileInfo.Size()
+	origin := entry.state.Format
+	if origin == nil {
+		entry.status = "unknown"
+		return entry
+	}
+	texCompiler = origin.Engine
+	if problem := formatProblem(name); len(problem) > 0 {
+		entry.status = problem
+		return entry
+	}
+	hash, err := preambleHash(origin.Source, origin.Split)
+	switch {
+	case isFileMissing(origin.Source):
+		entry.status = "source missing"
+	case err != nil || hash != origin.PreambleHash:
+		entry.status = "outdated"
+	default:
+		entry.status = "up to date"
+	}
+	return entry
+}
+
+// listFormats is the `fmt list` action: it shows the .fmt files of the folders (the current one by default).
+func listFormats(args []string) error {
+	formats, err := findFormats(args)
+	if err != nil {
+		return err
+	}
+	if len(formats) == 0 {
+		fmt.Println("No .fmt file found.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "format\tengine\tsize\tstatus\tsource")
+	for _, f := range formats {
+		engine, source := "?", "?"
+		if origin := f.state.Format; origin != nil {
+			engine, source = origin.Engine, origin.Source
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f MB\t%s\t%s\n", f.name, engine, float64(f.size)/(1<<20), f.status, source)
+	}
+	w.Flush()
+	return nil
+}
+
+// cleanFormats is the `fmt clean` action: it removes the .fmt files built by this tool (with a state file)
+// in the folders, or only the ones that can't be used any more with --outdated.
+// Their state file and in-memory copy (--fmt-in-ram) are removed too.
+func cleanFormats(args []string) error {
+	outdated, folders := false, []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--outdated":
+			outdated = true
+		case strings.HasPrefix(arg, "-"):
+			return errors.New("Unknown fmt clean option " + arg + ".")
+		default:
+			folders = append(folders, arg)
+		}
+	}
+	formats, err := findFormats(folders)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, f := range formats {
+		if !f.ours || outdated && (f.status == "up to date" || f.status == "unknown") {
+			continue
+		}
+		if target, err := os.Readlink(f.name); err == nil && strings.HasPrefix(filepath.Base(filepath.Dir(target)), "latex-fast-compile-") {
+			info(" remove", target)
+			os.RemoveAll(filepath.Dir(target))
+		}
+		info(" remove", f.name, "("+f.status+")")
+		if err := os.Remove(f.name); err != nil {
+			return fmt.Errorf("Problem removing %s: %w", f.name, err)
+		}
+		if !f.base {
+			os.Remove(strings.TrimSuffix(f.name, ".fmt") + "." + stateExtension)
+		}
+		removed++
+	}
+	fmt.Println(removed, "format(s) removed.")
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// the magic constant at the start of the web2c formats (TeX Live)
+var formatMagic = []byte("W2TX")
+
+// the engines with web2c formats
+var web2cEngines = map[string]bool{"tex": true, "etex": true, "pdftex": true, "xetex": true, "ptex": true, "eptex": true, "uptex": true, "euptex": true}
+
+// formatProblem return what is wrong with the .fmt file, or "" if it looks usable.
+// The TeX Live formats are gzip compressed, and start with the magic constant W2TX
+// followed by the name of the engine that built them.
+func formatProblem(fmtName string) string {
+	stat, err := os.Stat(fmtName)
+	if err != nil {
+		return ""
+	}
+	if stat.Size() == 0 {
+		return "empty"
+	}
+	file, err := os.Open(fmtName)
+	if err != nil {
+		return fmt.Sprintf("unreadable (%v)", err)
+	}
+	defer file.Close()
+	// the MiKTeX and the LuaTeX formats have another header
+	if distro.name == "miktex" || !web2cEngines[texCompiler] {
+		return ""
+	}
+	var reader io.Reader = bufio.NewReader(file)
+	if head, err := reader.(*bufio.Reader).Peek(2); err == nil && head[0] == 0x1f && head[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Sprintf("unreadable (%v)", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	header := make([]byte, 8)
+	n, err := io.ReadFull(reader, header)
+	if n < 4 && !bytes.HasPrefix(formatMagic, header[:n]) || n >= 4 && !bytes.Equal(header[:4], formatMagic) {
+		return "not a TeX format"
+	}
+	if err != nil {
+		return "truncated"
+	}
+	// the engine name, padded with zeros
+	length := binary.BigEndian.Uint32(header[4:])
+	if length == 0 || length > 64 {
+		return ""
+	}
+	engine := make([]byte, length)
+	if _, err := io.ReadFull(reader, engine); err != nil {
+		return "truncated"
+	}
+	// the engine names are compared through their aliases (uptex is run as euptex)
+	if name := strings.TrimRight(string(engine), "\x00"); engineBinary(name) != engineBinary(texCompiler) {
+		return "built by " + name + ", not by " + texCompiler
+	}
+	return ""
+}
+
+// checkFormat check the .fmt before to compile with it. If it can't be used,
+// it is removed to be rebuilt. If it can't be removed, the error says how to recover.
+func checkFormat() error {
+	if mustCompileAll || mustBuildFormat {
+		return nil
+	}
+	fmtName := outBase + ".fmt"
+	problem := formatProblem(fmtName)
+	if len(problem) == 0 {
+		return nil
+	}
+	if infoLevel >= infoErrors {
+		warning("The precompiled %s is %s, it is rebuilt.", fmtName, problem)
+	}
+	unlinkFormat(outBase)
+	if err := os.Remove(fmtName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("The precompiled %s is %s and can't be removed (%v): remove it by hand, or use --skip-fmt.", fmtName, problem, err)
+	}
+	mustBuildFormat = true
+	return nil
+}
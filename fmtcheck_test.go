@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// formatHeader return the start of a web2c format built by the engine.
+func formatHeader(engine string) []byte {
+	name := make([]byte, 8)
+	copy(name, engine)
+	var header bytes.Buffer
+	header.Write(formatMagic)
+	binary.Write(&header, binary.BigEndian, uint32(len(name)))
+	header.Write(name)
+	header.WriteString("the rest of the format")
+	return header.Bytes()
+}
+
+// gzipped return the data compressed as the TeX Live formats.
+func gzipped(data []byte) []byte {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+	return compressed.Bytes()
+}
+
+func TestFormatProblem(t *testing.T) {
+	defer func(d texDistribution, compiler string) { distro, texCompiler = d, compiler }(distro, texCompiler)
+	distro = unknownDistribution
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		data     []byte
+		compiler string
+		want     string
+	}{
+		{"empty", []byte{}, "pdftex", "empty"},
+		{"plain", formatHeader("pdftex"), "pdftex", ""},
+		{"gzipped", gzipped(formatHeader("pdftex")), "pdftex", ""},
+		{"other engine", gzipped(formatHeader("xetex")), "pdftex", "built by xetex, not by pdftex"},
+		{"alias", gzipped(formatHeader("euptex")), "uptex", ""},
+		{"not a format", []byte("\\documentclass{article}"), "pdftex", "not a TeX format"},
+		{"short garbage", []byte("AB"), "pdftex", "not a TeX format"},
+		{"truncated magic", []byte("W2T"), "pdftex", "truncated"},
+		{"truncated length", []byte("W2TX\x00"), "pdftex", "truncated"},
+		{"truncated name", formatHeader("pdftex")[:10], "pdftex", "truncated"},
+		{"luatex", []byte("another header"), "luatex", ""},
+	}
+	for _, test := range tests {
+		fmtName := filepath.Join(dir, test.name+".fmt")
+		if err := os.WriteFile(fmtName, test.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		texCompiler = test.compiler
+		if got := formatProblem(fmtName); got != test.want {
+			t.Errorf("formatProblem(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+	texCompiler = "pdftex"
+	if got := formatProblem(filepath.Join(dir, "missing.fmt")); got != "" {
+		t.Errorf("formatProblem(missing) = %q, want \"\"", got)
+	}
+}
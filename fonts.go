@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the fontspec (and xeCJK) commands that select a font by name
+var reFontCommand = regexp.MustCompile(`\\(?:set(?:CJK)?(?:main|sans|mono|math)font|new(?:CJK)?fontfamily\s*\\[A-Za-z@]+)\s*(?:\[[^\]]*\])?\s*\{([^}]+)\}`)
+
+// fontNames return the font names used in the preamble.
+// The fonts given by file name (with extension) are skipped.
+func fontNames(preamble string) (names []string) {
+	for _, match := range reFontCommand.FindAllStringSubmatch(preamble, -1) {
+		name := strings.TrimSpace(match[1])
+		if len(name) == 0 || filepath.Ext(name) != "" || strings.ContainsAny(name, `\#`) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// fontKey is used to compare font names (ignoring case and spaces).
+func fontKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+// installedFonts return the family and full names known by fontconfig (by fontKey),
+// or nil if `fc-list` is not available.
+func installedFonts() map[string]string {
+	output, err := exec.Command("fc-list", ":", "family", "fullname").Output()
+	if err != nil {
+		return nil
+	}
+	fonts := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, part := range strings.Split(line, ":") {
+			part = strings.TrimPrefix(part, "fullname=")
+			for _, name := range strings.Split(part, ",") {
+				name = strings.TrimSpace(strings.ReplaceAll(name, `\-`, "-"))
+				if len(name) > 0 {
+					fonts[fontKey(name)] = name
+				}
+			}
+		}
+	}
+	return fonts
+}
+
+// levenshtein return the edit distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// fontSuggestions return up to three installed fonts with a name close to the missing one.
+func fontSuggestions(missing string, fonts map[string]string) []string {
+	key := fontKey(missing)
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	for k, name := range fonts {
+		d := levenshtein(key, k)
+		if strings.Contains(k, key) || strings.Contains(key, k) {
+			d = 0
+		}
+		if d <= 3 {
+			candidates = append(candidates, candidate{name, d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// checkFonts look for the fonts used by fontspec in the preamble (without its comments)
+// and report those that are not installed (according to fontconfig).
+// Only the chosen engine matters (by -x, --engine or the magic comment): xetex and luatex load the system fonts.
+// It is only a warning: the engine can still find fonts that fontconfig ignores.
+func checkFonts() {
+	if texCompiler != "xetex" && texCompiler != "luatex" || mustNoFontCheck {
+		return
+	}
+	// the fonts of the commented lines are not used
+	preamble, err := readPreamble(inBaseOriginal + ".tex")
+	if err != nil {
+		return
+	}
+	names := fontNames(preamble)
+	if len(names) == 0 {
+		return
+	}
+	fonts := installedFonts()
+	if fonts == nil {
+		if infoLevel == infoDebug {
+			fmt.Println("fc-list is not available: skip the font check.")
+		}
+		return
+	}
+	for _, name := range names {
+		if _, ok := fonts[fontKey(name)]; ok {
+			continue
+		}
+		if infoLevel >= infoErrors {
+			warning("Font \"%s\" seems not to be installed.", name)
+			if suggestions := fontSuggestions(name, fonts); len(suggestions) > 0 {
+				fmt.Println(" Did you mean:", strings.Join(suggestions, ", ")+"?")
+			}
+		}
+	}
+}
@@ -5,12 +5,10 @@ go 1.20
 require (
 	github.com/fatih/color v1.15.0
 	github.com/fsnotify/fsnotify v1.5.4
+	github.com/mattn/go-isatty v0.0.17
 	github.com/spf13/pflag v1.0.6-0.20201009195203-85dd5c8bc61c
+	golang.org/x/sys v0.6.0
 	golang.org/x/text v0.9.0
 )
 
-require (
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-)
+require github.com/mattn/go-colorable v0.1.13 // indirect
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// the --idle-passes value: the time without change before the extra passes, 0 for never
+var idlePassDelay time.Duration
+
+// the maximum number of extra passes in a row, if the auxiliary files never settle
+const maxIdlePasses = 3
+
+var (
+	idleMu     sync.Mutex
+	idleTimer  *time.Timer // the waiting extra pass, if any
+	idlePasses int         // the extra passes since the last change
+)
+
+// checkIdlePasses check the --idle-passes value.
+func checkIdlePasses() error {
+	if idlePassDelay < 0 {
+		return errors.New("Invalid --idle-passes value " + idlePassDelay.String() + ".")
+	}
+	return nil
+}
+
+// scheduleIdlePass run an extra pass after idlePassDelay without change (see cancelIdlePass),
+// as the auxiliary files changed (cross references, table of contents...).
+// So the compilations while typing stay fast, but the document converges when the editing pauses.
+func scheduleIdlePass() {
+	if idlePassDelay == 0 || !isRecompiling {
+		return
+	}
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	if idlePasses >= maxIdlePasses {
+		info("The auxiliary files still change after", maxIdlePasses, "extra passes, no more pass.")
+		return
+	}
+	if idleTimer != nil {
+		idleTimer.Stop()
+	}
+	trace("watch", "Extra pass in", idlePassDelay, "without change.")
+	idleTimer = time.AfterFunc(idlePassDelay, func() {
+		idleMu.Lock()
+		idleTimer = nil
+		idlePasses++
+		idleMu.Unlock()
+		jobs.submit(job{name: "extra pass", priority: priorityCompile, run: func() error {
+			info("No change for " + idlePassDelay.String() + ", run an extra pass.")
+			setTitle(symbolBusy, "compiling")
+			return compileJob()
+		}})
+	})
+}
+
+// cancelIdlePass forget the waiting extra pass, as the source changed:
+// the coming compilation schedules a new one if needed.
+func cancelIdlePass() {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	if idleTimer != nil {
+		idleTimer.Stop()
+		idleTimer = nil
+	}
+	idlePasses = 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+var (
+	concatOutput string // the --concat value: the .pdf with all the outputs of a merge
+	imposeMode   string // the --impose value: "2up", "booklet" or "" (no imposition)
+)
+
+// checkPostSteps check the --impose value and the tools needed by the post-steps.
+func checkPostSteps() error {
+	switch imposeMode {
+	case "", "2up", "booklet":
+	default:
+		return errors.New("Invalid --impose value " + imposeMode + ".")
+	}
+	if len(imposeMode) > 0 {
+		if _, err := exec.LookPath("pdfjam"); err != nil {
+			return errors.New("Can't find pdfjam in the current path (needed by --impose).")
+		}
+	}
+	if err := checkSpellcheck(); err != nil {
+		return err
+	}
+	if err := checkSVG(); err != nil {
+		return err
+	}
+	if err := checkLinkOutput(); err != nil {
+		return err
+	}
+	if err := checkBadge(); err != nil {
+		return err
+	}
+	if err := checkMetadata(); err != nil {
+		return err
+	}
+	if err := checkFinalSteps(); err != nil {
+		return err
+	}
+	if len(concatOutput) > 0 {
+		_, errQpdf := exec.LookPath("qpdf")
+		_, errPdfjam := exec.LookPath("pdfjam")
+		if errQpdf != nil && errPdfjam != nil {
+			return errors.New("Can't find qpdf or pdfjam in the current path (needed by --concat).")
+		}
+	}
+	return nil
+}
+
+// imposedName return the name of the imposed .pdf, like cylinder-booklet.pdf.
+func imposedName(pdfName string) string {
+	return strings.TrimSuffix(pdfName, ".pdf") + "-" + imposeMode + ".pdf"
+}
+
+// imposePDF impose the pages of the .pdf with pdfjam: 2 pages by sheet side (2up),
+// or folded and stapled in the middle (booklet). The original .pdf is kept.
+func imposePDF(pdfName string) error {
+	args := []string{"--nup", "2x1", "--landscape", "--outfile", imposedName(pdfName)}
+	if imposeMode == "booklet" {
+		args = append(args, "--booklet", "true")
+	}
+	if err := runTool("Impose "+pdfName+" ("+imposeMode+")", "pdfjam", append(args, pdfName)...); err != nil {
+		return atStage("impose", err)
+	}
+	return nil
+}
+
+// concatPDF concatenate the .pdf files, with qpdf if available (it keeps the links and the bookmarks),
+// else with pdfjam.
+func concatPDF(pdfNames []string, output string) error {
+	msg := "Concatenate to " + output
+	var err error
+	if _, errQpdf := exec.LookPath("qpdf"); errQpdf == nil {
+		err = runTool(msg, "qpdf", append(append([]string{"--empty", "--pages"}, pdfNames...), "--", output)...)
+	} else {
+		err = runTool(msg, "pdfjam", append([]string{"--fitpaper", "true", "--outfile", output}, pdfNames...)...)
+	}
+	if err != nil {
+		return atStage("concat", err)
+	}
+	return nil
+}
+
+// hasPostSteps check if something is done after the compilation:
+// the spellcheck, the exports (--target and --svg), the XMP metadata, the tagging check, the imposition,
+// the final .pdf (encrypted or signed) and the stable link to the output.
+func hasPostSteps() bool {
+	return len(spellLanguage) > 0 || len(exportTargets) > 0 || len(svgMode) > 0 || mustWriteXMP || mustCheckTagging || len(imposeMode) > 0 || hasFinalPDF() || len(linkOutput) > 0
+}
+
+// runPostSteps do the steps after a successful compilation.
+func runPostSteps() error {
+	// the misspellings are only reported, they never fail the build
+	if err := spellcheck(); err != nil {
+		reportError(err)
+	}
+	if err := exportDocument(); err != nil {
+		return err
+	}
+	if err := exportSVG(); err != nil {
+		return err
+	}
+	if err := writeXMP(); err != nil {
+		return err
+	}
+	if err := checkTagging(); err != nil {
+		return err
+	}
+	if err := imposeDocument(); err != nil {
+		return err
+	}
+	if err := finalizeDocument(); err != nil {
+		return err
+	}
+	// the link is updated only when all the steps succeed
+	return updateOutputLink()
+}
+
+// imposeDocument impose the output of the compilation (if asked).
+func imposeDocument() error {
+	if len(imposeMode) == 0 {
+		return nil
+	}
+	return imposePDF(outputBase + ".pdf")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// the --include-only values: the \include files to compile, all if empty
+var includeOnly []string
+
+// reBeginDocument match the beginning of the document, where the \includeonly is injected
+var reBeginDocument = regexp.MustCompile(`\\begin\s*\{document\}`)
+
+// checkIncludeOnly check the --include-only names (the \include argument, without .tex).
+func checkIncludeOnly() error {
+	for i, name := range includeOnly {
+		name = strings.TrimSuffix(strings.TrimSpace(name), ".tex")
+		if len(name) == 0 || strings.ContainsAny(name, "{}%") {
+			return errors.New("Invalid --include-only value " + includeOnly[i] + ".")
+		}
+		includeOnly[i] = texPath(name)
+	}
+	return nil
+}
+
+// includeOnlyCode return the \includeonly line asked by --include-only.
+func includeOnlyCode() string {
+	return `\includeonly{` + strings.Join(includeOnly, ",") + `}`
+}
+
+// addIncludeOnly inject the \includeonly of --include-only just before \begin{document},
+// on the same line to keep the line numbers (errors and synctex).
+// It is in the body (not in the .fmt), so changing the included files needs no precompilation,
+// and it overrides an \includeonly of the preamble.
+func addIncludeOnly(texdata []byte) []byte {
+	if len(includeOnly) == 0 {
+		return texdata
+	}
+	loc := reBeginDocument.FindIndex(texdata)
+	if loc == nil {
+		if infoLevel >= infoErrors {
+			warning("No \\begin{document} found, --include-only is ignored.")
+		}
+		return texdata
+	}
+	injected := append([]byte{}, texdata[:loc[0]]...)
+	injected = append(injected, includeOnlyCode()...)
+	return append(injected, texdata[loc[0]:]...)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+)
+
+// the --index value: the tool that sorts the .idx to the .ind (makeindex or xindy), none (the default) to never run it
+var indexTool string
+
+// the index tools run by the document itself through the shell escape (like imakeidx does)
+var reIndexShellEscape = regexp.MustCompile(`runsystem\((?:makeindex|texindy|xindy)\b`)
+
+// checkIndexTool check the --index value.
+func checkIndexTool() error {
+	switch indexTool {
+	case "makeindex", "xindy", "none":
+		return nil
+	}
+	return errors.New("Invalid --index value " + indexTool + " (use makeindex, xindy or none).")
+}
+
+// indexCommand return the command of the index tool: xindy is run by its LaTeX front end texindy.
+func indexCommand() string {
+	if indexTool == "xindy" {
+		return "texindy"
+	}
+	return indexTool
+}
+
+// indexNeeded return the hash of the .idx written by the last compilation if the .ind must be rebuilt, and why
+// ("" if not): the .ind is missing, or the .idx changed since the last run of the index tool.
+func indexNeeded() (inputs, reason string) {
+	if indexTool == "none" || usesTectonic() {
+		return "", ""
+	}
+	idx, err := ioutil.ReadFile(outBase + ".idx")
+	if err != nil {
+		return "", ""
+	}
+	sum := sha256.Sum256(idx)
+	inputs = fmt.Sprintf("%x", sum[:8])
+	switch {
+	case isFileMissing(outBase + ".ind"):
+		reason = "The index is missing"
+	case inputs != loadState().Index:
+		reason = "The index entries changed"
+	default:
+		return "", ""
+	}
+	if log, err := ioutil.ReadFile(engineLog()); err == nil && reIndexShellEscape.Match(log) {
+		info("The index is built by the document (shell escape), don't run " + indexCommand() + ".")
+		return "", ""
+	}
+	if _, err := exec.LookPath(indexCommand()); err != nil {
+		if !toolMissing[indexCommand()] && infoLevel >= infoErrors {
+			warning("%s: %s is needed, but it is not in the path.", reason, indexCommand())
+		}
+		toolMissing[indexCommand()] = true
+		return "", ""
+	}
+	return inputs, reason
+}
+
+// indexPass run makeindex (or xindy) after the compilation if the .idx changed,
+// then one more compilation reads the new .ind. As for the bibliography,
+// the hash of the .idx of the run is kept in the state file.
+func indexPass() error {
+	inputs, reason := indexNeeded()
+	if len(reason) == 0 {
+		return nil
+	}
+	info(reason + ", run " + indexCommand() + ".")
+	if err := runTool("Build the index with "+indexCommand(), indexCommand(), "-o", outBase+".ind", outBase+".idx"); err != nil {
+		return atStage("index", err)
+	}
+	state := loadState()
+	state.Index = inputs
+	if err := saveState(state); err != nil && infoLevel >= infoErrors {
+		warning("Problem saving %s: %v", stateFileName(), err)
+	}
+	return compile(false)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// the common part of all starter preambles
+const initPreambleComment string = `% The packages loaded before "% end preamble" are precompiled in the .fmt file.
+% Put the packages that can't be precompiled (fontspec, polyglossia, ...)
+% between "% end preamble" and "\begin{document}".`
+
+// the starter documents created by `latex-fast-compile init`
+var initTemplates = map[string]string{
+	"article": `\documentclass[11pt]{article}
+
+` + initPreambleComment + `
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+\usepackage{amsmath,amssymb}
+\usepackage{graphicx}
+\usepackage{hyperref}
+
+% end preamble
+
+\begin{document}
+
+\title{Title}
+\author{Author}
+\maketitle
+
+\section{Introduction}
+
+Hello world!
+
+\end{document}
+`,
+	"beamer": `\documentclass{beamer}
+
+` + initPreambleComment + `
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+\usepackage{amsmath,amssymb}
+\usepackage{graphicx}
+\usetheme{default}
+
+% end preamble
+
+\begin{document}
+
+\title{Title}
+\author{Author}
+
+\begin{frame}
+  \titlepage
+\end{frame}
+
+\begin{frame}{First slide}
+  Hello world!
+\end{frame}
+
+\end{document}
+`,
+	"thesis": `\documentclass[12pt,a4paper]{report}
+
+` + initPreambleComment + `
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+\usepackage{amsmath,amssymb,amsthm}
+\usepackage{graphicx}
+\usepackage{geometry}
+\usepackage{hyperref}
+
+% end preamble
+
+\begin{document}
+
+\title{Title}
+\author{Author}
+\maketitle
+
+\tableofcontents
+
+\chapter{Introduction}
+
+Hello world!
+
+\end{document}
+`,
+	"letter": `\documentclass[11pt]{letter}
+
+` + initPreambleComment + `
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+
+% end preamble
+
+\begin{document}
+
+\begin{letter}{Recipient \\ Address}
+\opening{Dear Sir or Madam,}
+
+Hello world!
+
+\closing{Yours faithfully,}
+\end{letter}
+
+\end{document}
+`,
+}
+
+// the starter project configuration created by `latex-fast-compile init`
+const initConfig string = `# latex-fast-compile project configuration.
+# Every line sets an option as on the command line, without the leading "--".
+# The options given on the command line take precedence.
+
+compiles-at-start = %d
+# temp-folder = build
+# xelatex
+`
+
+// printInitHelp display the usage of the init subcommand
+func printInitHelp() {
+	fmt.Println("Usage: latex-fast-compile init [article|beamer|thesis|letter] [filename[.tex]].")
+	fmt.Println("  Create a starter filename.tex (main.tex by default) and a " + configFileName + " file.")
+}
+
+// initProject is the `init` subcommand.
+// It creates a starter .tex and a project configuration file, but never overwrite existing files.
+func initProject(args []string) error {
+	kind, fileName := "article", "main.tex"
+	if len(args) > 0 {
+		if args[0] == "-h" || args[0] == "--help" {
+			printInitHelp()
+			return nil
+		}
+		kind = args[0]
+	}
+	if len(args) > 1 {
+		fileName = strings.TrimSuffix(args[1], ".tex") + ".tex"
+	}
+	if len(args) > 2 {
+		printInitHelp()
+		return errors.New("Too many parameters.")
+	}
+	template, ok := initTemplates[kind]
+	if !ok {
+		printInitHelp()
+		return errors.New("Unknown template " + kind + ".")
+	}
+	if !isFileMissing(fileName) {
+		return errors.New("File " + fileName + " already exists.")
+	}
+	info(" create", fileName)
+	if err := ioutil.WriteFile(fileName, []byte(template), 0644); err != nil {
+		return fmt.Errorf("Problem while writing %s: %w", fileName, err)
+	}
+
+	if !isFileMissing(configFileName) {
+		info(" keep existing", configFileName)
+		return nil
+	}
+	// the documents with a table of contents need two compilations at start
+	compiles := 1
+	if kind == "thesis" {
+		compiles = 2
+	}
+	info(" create", configFileName)
+	if err := ioutil.WriteFile(configFileName, []byte(fmt.Sprintf(initConfig, compiles)), 0644); err != nil {
+		return fmt.Errorf("Problem while writing %s: %w", configFileName, err)
+	}
+	return nil
+}
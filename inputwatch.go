@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// the files included by `\input` and `\include`, watched in addition to the source.
+// They are scanned again before every build, so the newly included files are also watched.
+var (
+	inputMu      sync.Mutex
+	inputWatcher *fsnotify.Watcher // the watcher of the watch loop (nil before the watching)
+	inputFolders map[string]bool   // the folders watched by inputWatcher
+	inputWatched = map[string]bool{}
+)
+
+// includedFiles return the files included (recursively) by the source, and the ones read by the last
+// engine runs (see recordInputs), split by the part that includes them: the changes of the preamble ones need a new .fmt.
+func includedFiles() (preamble, body []string) {
+	inputMu.Lock()
+	preamble = append(preamble, recordedPreamble...)
+	body = append(body, recordedBody...)
+	inputMu.Unlock()
+	if mustUsePandoc {
+		return preamble, body
+	}
+	sources := []string{inBaseOriginal + ".tex"}
+	if len(subfileName) > 0 {
+		sources = append(sources, subfileName)
+	}
+	for _, source := range sources {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			continue
+		}
+		text := stripComments(string(data))
+		if loc := reBeginDocument.FindStringIndex(text); loc != nil && source == inBaseOriginal+".tex" {
+			preamble = append(preamble, includedBy(text[:loc[0]], source)...)
+			text = text[loc[0]:]
+		}
+		body = append(body, includedBy(text, source)...)
+	}
+	// the .bib files are read by biber or bibtex (see bibliographyPasses)
+	if bibs, err := bibFiles(inBaseOriginal+".tex", 0); err == nil {
+		body = append(body, bibs...)
+	}
+	return preamble, body
+}
+
+// includedBy return the existing files included (recursively) by `\input` and `\include` in the text of the source.
+func includedBy(text, source string) (files []string) {
+	for _, match := range reInput.FindAllStringSubmatch(text, -1) {
+		if included := includedPath(match[1], ".tex", source); len(included) > 0 {
+			files = append(files, included)
+			files = append(files, inputFiles(included, 1)...)
+		}
+	}
+	return files
+}
+
+// startInputWatch return the included files to watch from the start.
+func startInputWatch() []string {
+	preamble, body := includedFiles()
+	inputMu.Lock()
+	defer inputMu.Unlock()
+	for _, fileName := range preamble {
+		inputWatched[filepath.Clean(fileName)] = true
+	}
+	for _, fileName := range body {
+		if _, ok := inputWatched[filepath.Clean(fileName)]; !ok {
+			inputWatched[filepath.Clean(fileName)] = false
+		}
+	}
+	return append(preamble, body...)
+}
+
+// keepInputWatcher keep the watcher and its folders to watch the files included later (see updateInputWatch).
+func keepInputWatcher(watcher *fsnotify.Watcher, folders map[string]bool) {
+	inputMu.Lock()
+	defer inputMu.Unlock()
+	inputWatcher, inputFolders = watcher, folders
+}
+
+// updateInputWatch watch the files newly included by the source (called before every build).
+// The files no longer included are still watched: at worst they trigger a useless build.
+func updateInputWatch() {
+	inputMu.Lock()
+	watching := inputWatcher != nil
+	inputMu.Unlock()
+	if !watching || mustManual {
+		return
+	}
+	preamble, body := includedFiles()
+	inputMu.Lock()
+	defer inputMu.Unlock()
+	for i, fileName := range append(preamble, body...) {
+		name := filepath.Clean(fileName)
+		inPreamble := i < len(preamble)
+		if wasPreamble, ok := inputWatched[name]; ok {
+			inputWatched[name] = wasPreamble || inPreamble
+			continue
+		}
+		inputWatched[name] = inPreamble
+		info(" watch", fileName)
+		folder := filepath.Dir(name)
+		if inputFolders[folder] {
+			continue
+		}
+		if err := inputWatcher.Add(folder); err != nil {
+			if infoLevel >= infoErrors {
+				warning("Can't watch %s for %s: %s.", folder, fileName, err.Error())
+			}
+			continue
+		}
+		trace("watch", "Watch folder", folder)
+		inputFolders[folder] = true
+	}
+}
+
+// watchedInput check if the file is an included file being watched,
+// and if it is included by the preamble (so its changes rebuild the .fmt).
+func watchedInput(fileName string) (watched, inPreamble bool) {
+	inputMu.Lock()
+	defer inputMu.Unlock()
+	inPreamble, watched = inputWatched[filepath.Clean(fileName)]
+	return watched, inPreamble
+}
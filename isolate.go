@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	isolatedDir string // the unique build folder used with --isolated (empty if not isolated)
+	workDir     string // the working folder before the switch to isolatedDir
+	sourceDir   string // the absolute path of the source folder
+	startDir    string // the current folder at the start, if it is left (isolated folder, % !TEX root)
+)
+
+// the extensions of the generated files (in addition to the aux ones), that are not inputs
+const generatedExtensions = "log,pdf,synctex,synctex.gz,fls,fdb_latexmk,dvi,xdv"
+
+// copyInput copy the file without any message (used for the many input files).
+func copyInput(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return copyAttributes(src, dst)
+}
+
+// userPath return the absolute path of a file given by the user,
+// relative to the current folder at the start (before the switch to the isolated or the root folder).
+func userPath(fileName string) (string, error) {
+	fileName = nativePath(fileName)
+	if !filepath.IsAbs(fileName) && len(startDir) > 0 {
+		fileName = filepath.Join(startDir, fileName)
+	}
+	return filepath.Abs(fileName)
+}
+
+// isGenerated check if the file is produced by the compilation (so it is not an input).
+func isGenerated(fileName string) bool {
+	for _, ext := range strings.Split(auxExtensions+","+generatedExtensions, ",") {
+		if strings.HasSuffix(fileName, "."+strings.TrimSpace(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupIsolation create a unique folder, copy the source in it and switch to it.
+// The other inputs are not copied: the engine and the tools find them in the source folder (see isolationSearchPaths),
+// so the \input{../shared} files are found too. Only the folders of the included files are created,
+// as the engine writes their .aux there.
+// So the workspace is left untouched, except for the final outputs copied back by endIsolation.
+func setupIsolation() (err error) {
+	defer func() { err = atStage("isolation", err) }()
+	if workDir, err = os.Getwd(); err != nil {
+		return fmt.Errorf("Problem getting the current folder: %w", err)
+	}
+	if len(startDir) == 0 {
+		startDir = workDir
+	}
+	if sourceDir, err = filepath.Abs(filepath.Dir(inBaseOriginal)); err != nil {
+		return fmt.Errorf("Problem getting the source folder: %w", err)
+	}
+	if isolatedDir, err = os.MkdirTemp("", "latex-fast-compile-"); err != nil {
+		return fmt.Errorf("Problem creating the isolated folder: %w", err)
+	}
+	info(" create isolated folder", isolatedDir)
+
+	for _, ext := range []string{".tex", ".md"} {
+		if source := inBaseOriginal + ext; !isFileMissing(source) {
+			if err := copyInput(source, filepath.Join(isolatedDir, filepath.Base(source))); err != nil {
+				return fmt.Errorf("Problem copying %s to %s: %w", source, isolatedDir, err)
+			}
+		}
+	}
+	for _, included := range inputFiles(inBaseOriginal+".tex", 0) {
+		absIncluded, err := filepath.Abs(included)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(sourceDir, filepath.Dir(absIncluded)); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			if err := os.MkdirAll(filepath.Join(isolatedDir, rel), 0755); err != nil {
+				return fmt.Errorf("Problem creating the folder of %s in %s: %w", included, isolatedDir, err)
+			}
+		}
+	}
+
+	if err = os.Chdir(isolatedDir); err != nil {
+		return fmt.Errorf("Problem switching to %s: %w", isolatedDir, err)
+	}
+	inBaseOriginal = filepath.Base(inBaseOriginal)
+	return nil
+}
+
+// the kpathsea variables of the search paths of the engine and the tools (bibtex, makeindex)
+var searchPathVariables = []string{"TEXINPUTS", "BIBINPUTS", "BSTINPUTS", "INDEXSTYLE"}
+
+// isolationSearchPaths let the engine and the tools find the inputs in the source folder when the build is isolated:
+// the folder is added before the search paths of the kpathsea variables, in the environment,
+// or with the -include-directory option of MiKTeX (returned).
+func isolationSearchPaths() (options []string) {
+	if len(isolatedDir) == 0 {
+		return nil
+	}
+	if !distro.kpathseaEnv {
+		return []string{"-include-directory=" + sourceDir}
+	}
+	for _, variable := range searchPathVariables {
+		// the final separator adds the default paths
+		engineEnv = append(engineEnv, variable+"="+sourceDir+string(os.PathListSeparator)+os.Getenv(variable))
+	}
+	return nil
+}
+
+// endIsolation copy back the outputs next to the source and remove the isolated folder.
+func endIsolation() (err error) {
+	if len(isolatedDir) == 0 {
+		return nil
+	}
+	outNames := []string{}
+	for _, ext := range append([]string{outputExtension(), "synctex"}, exportTargets...) {
+		outNames = append(outNames, outputBase+"."+ext)
+	}
+	if len(svgMode) > 0 {
+		outNames = append(outNames, svgFiles()...)
+	}
+	for _, outName := range outNames {
+		if isFileMissing(outName) {
+			continue
+		}
+		destName := filepath.Join(sourceDir, outName)
+		info(" copy", outName, "to", destName)
+		if copyErr := copyInput(outName, destName); copyErr != nil {
+			err = atStage("isolation", fmt.Errorf("Problem copying %s to %s: %w", outName, destName, copyErr))
+			reportError(err)
+		}
+	}
+	os.Chdir(workDir)
+	if len(linkOutput) > 0 && err == nil {
+		if target, _ := outputTarget(); !isFileMissing(target) {
+			if linkErr := linkFile(target, linkOutput); linkErr != nil {
+				err = atStage("link", linkErr)
+				reportError(err)
+			}
+		}
+	}
+	info(" remove isolated folder", isolatedDir)
+	os.RemoveAll(isolatedDir)
+	isolatedDir = ""
+	return err
+}
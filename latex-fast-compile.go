@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -11,16 +13,19 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 
 	"github.com/fatih/color"
 	"github.com/fsnotify/fsnotify"
+	"github.com/mattn/go-isatty"
 	flag "github.com/spf13/pflag"
 )
 
@@ -33,7 +38,7 @@ func printVersion() {
 	var out = flag.CommandLine.Output()
 	// write the help message
 	fmt.Fprintf(out, "version: %s\n", version)
-	fmt.Fprintf(out, "tex distribution: %s\n", texDistro)
+	fmt.Fprintf(out, "tex distribution: %s\n", distro.name)
 	fmt.Fprintf(out, texCompiler+" version: %s\n", texVersionStr)
 }
 
@@ -43,32 +48,87 @@ func printHelp() {
 	var out = flag.CommandLine.Output()
 	// write the help message
 	fmt.Fprintf(out, "latex-fast-compile (version: %s): compile latex source using precompiled header.\n\n", version)
-	fmt.Fprintf(out, "Usage: latex-fast-compile [options] filename[.tex].\n")
+	fmt.Fprintf(out, "Usage: latex-fast-compile [options] filename[.tex|.md].\n")
 	fmt.Fprintf(out, "  If filename.fmt is missing it is build before the compilation.\n")
+	fmt.Fprintf(out, "  A .md source is first converted to .tex with pandoc.\n")
+	fmt.Fprintf(out, "  The options can also be set in a %s file in the current folder.\n", configFileName)
+	fmt.Fprintf(out, "  Personal default options can be set in the %s environment variable,\n", optionsEnvVar)
+	fmt.Fprintf(out, "  or in the latex-fast-compile/%s file of the user configuration folder.\n", configFileName)
+	fmt.Fprintf(out, "  The precedence is: command line > project file > environment variable > user file.\n")
 	fmt.Fprintf(out, "  The available options are:\n\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Subcommands (a document with the same name, like doctor.tex, is compiled instead):\n")
+	fmt.Fprintf(out, "  latex-fast-compile init [article|beamer|thesis|letter] [filename[.tex]]\n")
+	fmt.Fprintf(out, "      Create a starter .tex file and a %s file.\n", configFileName)
+	fmt.Fprintf(out, "  latex-fast-compile engines [filename[.tex]]\n")
+	fmt.Fprintf(out, "      List the available engines and their capabilities.\n")
+	fmt.Fprintf(out, "  latex-fast-compile explain [options] filename[.tex|.md]\n")
+	fmt.Fprintf(out, "      Show how the source is split and changed before the precompilation.\n")
+	fmt.Fprintf(out, "  latex-fast-compile fmt build [options] file.tex | list [folder...] | clean [--outdated] [folder...]\n")
+	fmt.Fprintf(out, "      Precompile the preamble without compiling, list the .fmt files and their state, or remove them.\n")
+	fmt.Fprintf(out, "  latex-fast-compile doctor\n")
+	fmt.Fprintf(out, "      Show the recognized TeX distribution and the tools found in the path.\n")
+	fmt.Fprintf(out, "  latex-fast-compile serve [--jobs=N] [--queue=N] [--timeout=D] [--cache-max=N] [--option=value...] [host:port]\n")
+	fmt.Fprintf(out, "      Compile the .tex (or .zip) files posted to http://host:port/compile (default %s).\n", defaultServeAddress)
+	fmt.Fprintf(out, "  latex-fast-compile sync --remote=<git url> [--every=D] [--push] [--once] [--no-compile] [--option=value...] file.tex\n")
+	fmt.Fprintf(out, "      Pull, compile and (with --push) push the project of a git remote, like Overleaf.\n")
+	fmt.Fprintf(out, "  latex-fast-compile merge [--jobs=N] [--output=pattern] [--delimiter=c] [--raw] [--option=value...] template.tex data.csv\n")
+	fmt.Fprintf(out, "      Compile one .pdf by row of the CSV file, the columns replacing the @@column@@ placeholders.\n")
+	fmt.Fprintf(out, "  latex-fast-compile replay session.zip [folder]\n")
+	fmt.Fprintf(out, "      Run again the engine commands of a session recorded with --record.\n")
+	fmt.Fprintf(out, "  latex-fast-compile profile-preamble [--runs=N] [--option=value...] file.tex\n")
+	fmt.Fprintf(out, "      Dump the preamble package by package, and show the time and the .fmt size added by each.\n")
+	fmt.Fprintf(out, "  latex-fast-compile test-preamble [--option=value...] file.tex\n")
+	fmt.Fprintf(out, "      Compare a trivial body compiled with and without the precompiled preamble, and find the packages that differ.\n")
+	fmt.Fprintf(out, "  latex-fast-compile watch-debug [--option=value...] file.tex\n")
+	fmt.Fprintf(out, "      Print the file system events received for the watched files, without compiling.\n")
+	fmt.Fprintf(out, "\n")
 }
 
-// Check for error
-// - do nothing if no error
-// - print the error message and panic if there is an error
-func check(e error, m ...interface{}) {
-	if e != nil {
-		color.Set(color.FgRed)
-		if len(m) > 0 {
-			fmt.Print("Error: ")
-			fmt.Println(m...)
-		} else {
-			fmt.Println("Error.\n")
-		}
-		color.Unset()
-		fmt.Println(e)
-		// if we are in watch mode, do not halt on error
-		if !isCompiling {
-			panic(e)
-		}
+// stageError is an error that knows at which stage (parameters, split, precompile...) it happened.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// atStage add the stage to the error (if it has none yet).
+// A nil error stays nil.
+func atStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *stageError
+	if errors.As(err, &se) {
+		return err
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// reportError print the error message with the stage where it happened.
+// It does nothing if there is no error.
+func reportError(err error) {
+	if err == nil {
+		return
+	}
+	themeError.Set()
+	var se *stageError
+	if errors.As(err, &se) {
+		fmt.Println(symbolFailure + " Error during " + se.stage + ":")
+		err = se.err
+	} else {
+		fmt.Println(symbolFailure + " Error:")
 	}
+	color.Unset()
+	fmt.Println(err)
 }
 
 // the infoLevel type and constants
@@ -83,22 +143,21 @@ const (
 )
 
 // convert the flag `--info` flag to the corresponding level.
-func infoLevelFromString(info string) infoLevelType {
+func infoLevelFromString(info string) (infoLevelType, error) {
 	switch info {
 	case "no":
-		return infoNo
+		return infoNo, nil
 	case "errors":
-		return infoErrors
+		return infoErrors, nil
 	case "errors+log":
-		return infoErrorsAndLog
+		return infoErrorsAndLog, nil
 	case "actions":
-		return infoActions
+		return infoActions, nil
 	case "debug":
 		fmt.Println("Set info level to debug.")
-		return infoDebug
+		return infoDebug, nil
 	default:
-		check(errors.New("Invalid info level."))
-		return infoDebug
+		return infoDebug, errors.New("Invalid info level " + info + ".")
 	}
 }
 
@@ -108,6 +167,7 @@ var (
 	mustCompileAll     bool
 	mustNotSync        bool
 	mustNoWatch        bool
+	mustIsolate        bool
 	mustUseXe          bool
 	numCompilesAtStart int
 	mustShowHelp       bool
@@ -116,43 +176,66 @@ var (
 	logSanitize        string
 	splitPattern       string
 	tempFolderName     string
+	fmtMethod          string
 	clearFlag          string
 	mustClear          bool
 	auxExtensions      string
 	mustNoNormalize    bool
+	normalizeMode      string
 	additionalOptions  []string
+	splitOptionValues  []string
+	rawOptions         []string
+	precompileOnly     []string
+	compileOnly        []string
+	mustNoShellEscape  bool
+	mustShellRestrict  bool
+	shellAllow         []string
+	openoutPolicy      string
+	openinPolicy       string
+	viaPandoc          string
+	exportTargets      []string
+	mustNoFontCheck    bool
+	watchAlso          []string
+	rebuildEvery       time.Duration
 	// global variables
+	engineEnv         []string
+	logLineWidth      int
 	texCompiler       string
 	latexFormat       string
-	texDistro         string
 	texVersionStr     string
 	inBaseOriginal    string
+	outputBase        string // the name of the final .pdf and .synctex (without extension)
 	inBase            string
+	outFolder         string
 	outBase           string
-	isCompiling       bool
+	mustUsePandoc     bool
 	isRecompiling     bool
 	infoLevel         infoLevelType
 	reSanitize        *regexp.Regexp
 	reSplit           *regexp.Regexp
 	precompileOptions []string
 	compileOptions    []string
-	// temp variable for error catch
-	err error
 )
 
+// the default extensions of the auxiliary files removed at the end (the `--aux-extensions` flag)
+const defaultAuxExtensions = "aux,bbl,blg,fmt,fff,glg,glo,gls,idx,ilg,ind,lof,lot,nav,out,ptc,snm,sta,stp,toc"
+
+// the default regex that defines the end of the preamble (the `--split` flag)
+const defaultSplitPattern = `(?m)^\s*(?:%\s*end\s*preamble|\\begin{document})`
+
 // getTeXVersion return the first line from `(pdf|xe)tex --version`
-func getTeXVersion() string {
+func getTeXVersion(engine string) string {
 	// build command
 	var cmdOutput strings.Builder
-	cmd := exec.Command(texCompiler, "--version")
+	cmd := exec.Command(engine, "--version")
 	cmd.Stdout = &cmdOutput
 	cmd.Stderr = &cmdOutput
 	// print command?
-	if infoLevel == infoDebug {
-		fmt.Println(delimit("command", "", cmd.String()))
+	if tracing("exec") {
+		fmt.Println(delimit("command", "", quoteArgs(cmd.Args)))
 	}
 	// run command
-	err = cmd.Run()
+	err := cmd.Run()
 	linesOutput := strings.Split(cmdOutput.String(), "\n")
 	if err != nil || len(linesOutput) == 0 {
 		return ""
@@ -163,18 +246,79 @@ func getTeXVersion() string {
 
 // Try to recognize the distribution based on the tex version.
 func setDistro() {
-	texVersionStr = getTeXVersion()
-	if strings.Contains(texVersionStr, "MiKTeX") {
-		texDistro = "miktex"
-	}
-	if strings.Contains(texVersionStr, "TeX Live") {
-		texDistro = "texlive"
-	}
+	texVersionStr = getTeXVersion(texCompiler)
+	distro = detectDistribution(texVersionStr, enginePath(texCompiler))
 
 	precompileOptions = []string{"-interaction=batchmode", "-halt-on-error", "-ini"}
 	compileOptions = []string{"-interaction=batchmode", "-halt-on-error"}
 }
 
+// latinJobName return the normalized name if it can be used as job name,
+// or a hashed ASCII name if it is empty or has non-Latin letters (like 日本語.tex or Москва.tex),
+// as such names do not work well for the precompiled .fmt files.
+func latinJobName(normalized, original string) string {
+	base := filepath.Base(normalized)
+	usable := len(base) > 0 && base != "."
+	for _, r := range base {
+		if unicode.IsLetter(r) && r >= utf8.RuneSelf && !unicode.Is(unicode.Latin, r) {
+			usable = false
+			break
+		}
+	}
+	if usable {
+		return normalized
+	}
+	sum := sha256.Sum256([]byte(original))
+	hashed := filepath.Join(filepath.Dir(normalized), fmt.Sprintf("document-%x", sum[:4]))
+	info("The name", filepath.Base(original), "has non-Latin letters, use", filepath.Base(hashed), "for the intermediate files.")
+	return hashed
+}
+
+// disambiguateName add a hash of the original name to the normalized one, if another
+// source of the same folder has the same normalized name (like résumé.tex and resume.tex).
+// So the two documents do not overwrite each other's .fmt and auxiliary files.
+func disambiguateName(normalized, original string) string {
+	if normalized == original {
+		return normalized
+	}
+	dir := filepath.Dir(original)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return normalized
+	}
+	collision := ""
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || ext != ".tex" && ext != ".md" {
+			continue
+		}
+		other := filepath.Join(dir, strings.TrimSuffix(entry.Name(), ext))
+		if other == filepath.Clean(original) || normalizeName(other) != filepath.Clean(normalized) {
+			continue
+		}
+		// the copy of the source done by --skip-fmt is not a collision
+		if ext == ".tex" && sameContent(other+".tex", original+".tex") {
+			continue
+		}
+		collision = entry.Name()
+		break
+	}
+	if len(collision) == 0 {
+		return normalized
+	}
+	sum := sha256.Sum256([]byte(original))
+	disambiguated := fmt.Sprintf("%s-%x", normalized, sum[:4])
+	info("The normalized name", normalized, "is also the name of", collision+", use", disambiguated+".")
+	return disambiguated
+}
+
+// sameContent check if the two files exist and have the same content.
+func sameContent(name1, name2 string) bool {
+	data1, err1 := ioutil.ReadFile(name1)
+	data2, err2 := ioutil.ReadFile(name2)
+	return err1 == nil && err2 == nil && bytes.Equal(data1, data2)
+}
+
 // used in normalizeName
 func isMn(r rune) bool {
 	return unicode.Is(unicode.Mn, r) // Mn: nonspacing marks
@@ -183,28 +327,121 @@ func isMn(r rune) bool {
 // normalizeName remove accents and spaces
 // borrowed from https://stackoverflow.com/a/26722698
 func normalizeName(fileName string) string {
+	if normalizeMode == "translit" {
+		fileName = transliterate(fileName)
+	}
 	t := transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC)
 	result, _, _ := transform.String(t, fileName)
 	return strings.ReplaceAll(result, " ", "")
 }
 
-// Set the configuration variables from the command line flags
-func SetParameters() {
-	// the list of flags
+// defineFlags define the flags of the compilation.
+func defineFlags() {
 	flag.BoolVar(&mustBuildFormat, "precompile", false, "Force to create .fmt file even if it exists.")
+	flag.BoolVar(&mustBuildBase, "precompile-base", false, "Force to create the base .fmt file (see --base-split) even if it is up to date.")
 	flag.BoolVar(&mustCompileAll, "skip-fmt", false, "Skip .fmt file and compile all.")
 	flag.BoolVar(&mustNotSync, "no-synctex", false, "Do not build .synctex file.")
+	flag.StringVar(&badgeFile, "badge", "", "Write a SVG badge (like build.svg) with the result of every build: passing with the page count, or failing.")
+	flag.StringVar(&linkOutput, "link-output", "", "Keep a stable path (like latest.pdf) linked to the last successful output.\nA symlink, or a copy where the symlinks are not allowed.")
+	flag.StringVar(&outputModeFlag, "output-mode", "", "The permissions of the output and its .synctex, in octal (like 0644), the ones of the engine (umask) by default.")
+	flag.StringVar(&outputFormat, "output-format", "pdf", "The output format [pdf|dvi]. dvi=stop at the .dvi (.xdv with xelatex) for a custom post-processor.")
 	flag.BoolVar(&mustNoWatch, "no-watch", false, "Do not watch for file changes in the .tex file.")
-	flag.BoolVarP(&mustUseXe, "xelatex", "x", false, "Use xelatex in place of pdflatex.")
+	flag.BoolVar(&mustNoRecorder, "no-recorder", false, "Do not watch the files read by the engine (images, data files, local packages...),\nfound in the .fls of -recorder.")
+	flag.BoolVar(&mustNoBibliography, "no-bibliography", false, "Do not run biber or bibtex when the bibliography is missing or outdated.")
+	flag.StringVar(&indexTool, "index", "none", "The tool that builds the index when the .idx changes [makeindex|xindy|none].\nNot run if the document runs it by the shell escape (like imakeidx).")
+	flag.BoolVar(&mustIsolate, "isolated", false, "Build in a new unique temp folder and copy back only the .pdf (implies --no-watch).")
+	flag.BoolVarP(&mustUseXe, "xelatex", "x", false, "Use xelatex in place of pdflatex (same as --engine=xetex).")
+	flag.BoolVar(&mustNoMagicComments, "no-magic-comments", false, "Ignore the % !TEX comments of the source (program, options and root).")
+	flag.StringVar(&engineFlag, "engine", "", "The TeX engine to use (like luatex, uptex or eptex), pdftex by default.")
+	flag.StringVar(&formatFlag, "format", "", "The base format of the engine (like platex), the usual one of the engine by default.")
+	flag.StringArrayVar(&watchAlso, "watch-also", []string{}, "Also watch these files for changes (glob patterns accepted).\nCan be used multiple times.")
+	flag.StringArrayVar(&templateVars, "var", []string{}, "Replace @@key@@ by value in (a copy of) the source (key=value).\nCan be used multiple times.")
+	flag.StringSliceVar(&includeOnly, "include-only", []string{}, "Compile only these \\include files (like chap2,chap5), with \\includeonly added to the body.")
+	flag.StringVar(&regionFlag, "region", "", "Compile only these lines of the body (like 120:180) against the precompiled preamble, to a -region.pdf preview (implies --no-watch).")
+	flag.StringArrayVar(&dataFiles, "data", []string{}, "The data files (CSV, JSON...) read by the document: their changes trigger a rebuild\n(glob patterns accepted). Can be used multiple times.")
+	flag.StringArrayVar(&preambleData, "preamble-data", []string{}, "The data files read by the preamble: their changes rebuild the .fmt\n(glob patterns accepted). Can be used multiple times.")
+	flag.StringArrayVar(&fmtBust, "fmt-bust", []string{}, "Rebuild the .fmt when the text matching this regex changes, anywhere in the source\n(like the class options set with \\def before \\documentclass). Can be used multiple times.")
+	flag.DurationVar(&rebuildEvery, "every", 0, "Also rebuild at this interval (like 10m) while watching, even without changes.")
+	flag.DurationVar(&idlePassDelay, "idle-passes", 0, "While watching, compile again after this time without change (like 2s) when the auxiliary files changed\n(cross references, table of contents...), 0 for never.")
+	flag.StringVar(&editPageMode, "edit-page", "", "While watching, print the page of the last edited line (found with the .synctex) after each rebuild,\nand write it to the .page file for the editors [report|preview]. preview=also extract it to a -page.pdf.\nWithout value report is used.")
+	flag.Lookup("edit-page").NoOptDefVal = "report"
+	flag.BoolVar(&mustPauseSignals, "pause-signals", false, "Pause the watching on SIGTSTP (Ctrl-Z) and resume it on SIGCONT,\nin place of suspending the process (not on Windows).")
+	flag.BoolVar(&mustManual, "manual", false, "Do not watch the files, compile only on request\n(stdin line, SIGUSR1/SIGUSR2, trigger file or socket).")
+	flag.StringVar(&socketAddress, "socket", "", "Also accept the build requests on this socket (unix://path or tcp://host:port).")
+	flag.StringVar(&metricsAddress, "metrics", "", "Serve the build statistics for Prometheus on http://host:port/metrics while watching.")
+	flag.BoolVar(&mustWarm, "warm", false, "Keep an engine waiting with the format loaded for the next compile.")
 	flag.IntVar(&numCompilesAtStart, "compiles-at-start", 1, "Number of compiles before to start watching.")
+	flag.StringVar(&batterySaver, "battery-saver", "", "Save the battery while watching: wait longer after a change, no draft compilation [on|percent].\nWith a percent (like 20) the watching is also paused on battery under it. Without value on is used.")
+	flag.Lookup("battery-saver").NoOptDefVal = "on"
 	flag.StringVar(&infoLevelFlag, "info", "actions", "The info level [no|errors|errors+log|actions|debug].")
+	flag.StringSliceVar(&traceFlag, "trace", []string{}, "Print the debug information of these categories only, whatever the info level\n["+traceNames()+"|all].")
 	flag.StringVar(&logSanitize, "log-sanitize", `(?ms)^(?:! |l\.|<recently read> ).*?$(?:\s^.*?$){0,2}`, "Match the log against this regex before display, or display all if empty.\n")
-	flag.StringVar(&splitPattern, "split", `(?m)^\s*(?:%\s*end\s*preamble|\\begin{document})`, "The regex that defines the end of the preamble.\n")
+	flag.StringArrayVar(&suppressWarnings, "suppress-warning", []string{}, "Ignore the log warnings matching this regex (like Font shape .* undefined).\nCan be used multiple times.")
+	flag.StringSliceVar(&silenceFilters, "silence", []string{}, "Ignore the log warnings of these built-in filters\n[microtype|hyperref-tokens|font-shapes|fancyhdr|unused-options|boxes].")
+	flag.StringVar(&splitPattern, "split", defaultSplitPattern, "The regex that defines the end of the preamble.\n")
+	flag.StringVar(&baseSplitPattern, "base-split", defaultBaseSplit, "The regex that defines the end of the base of the preamble (the class and the heavy packages),\ndumped in its own .fmt, rebuilt only when the base changes. Empty for none.\n")
+	flag.BoolVar(&mustKeepIntermediate, "keep-intermediate", false, "Keep the .preamble.tex and .body.tex files (and .full.tex) at the end, whatever the info level.")
+	flag.StringVar(&splitOnlyMode, "split-only", "", "Only split the source, without TeX: keep the .preamble.tex and .body.tex files,\nor print them [files|stdout]. Without value files is used.")
+	flag.Lookup("split-only").NoOptDefVal = "files"
 	flag.StringVar(&tempFolderName, "temp-folder", "", "Folder to store all temp files, .fmt included.")
+	flag.BoolVar(&mustFmtInRAM, "fmt-in-ram", false, "Keep the .fmt in memory (tmpfs) and link to it.")
+	flag.StringVar(&fmtMethod, "fmt-method", "option", "How the .fmt is given to the engine [option|line].\noption=-fmt (or -undump) option, line=%& first line.")
 	flag.StringVar(&clearFlag, "clear", "auto", "Clear auxiliary files and .fmt at end [auto|yes|no].\n When watching auto=true, else auto=false.\nIn debug mode clear is false.")
-	flag.StringVar(&auxExtensions, "aux-extensions", "aux,bbl,blg,fmt,fff,glg,glo,gls,idx,ilg,ind,lof,lot,nav,out,ptc,snm,sta,stp,toc", "Extensions to remove in clear at the end procedure.\n")
+	flag.StringVar(&auxExtensions, "aux-extensions", defaultAuxExtensions, "Extensions to remove in clear at the end procedure.\n")
+	flag.StringArrayVar(&protectPatterns, "protect", []string{}, "Never clear the files matching this pattern (the sources like *.tex and *.bib are always protected).\nCan be used multiple times.")
+	flag.BoolVar(&mustConfirm, "clear-confirm", false, "Ask before clearing the auxiliary files at the end.")
+	flag.StringVar(&trashMode, "clear-to-trash", "", "Move the cleared files to the trash instead of removing them [os|folder].\nos=the trash of the system (or the folder if not possible), folder=the "+trashFolder+" folder. Without value os is used.")
+	flag.Lookup("clear-to-trash").NoOptDefVal = "os"
 	flag.BoolVar(&mustNoNormalize, "no-normalize", false, "Keep accents and spaces in intermediate file names.")
+	flag.StringVar(&normalizeMode, "normalize", "strip", "How the intermediate file names are normalized [strip|translit|none].\nstrip=remove the accents, translit=also ß→ss, Cyrillic and Greek to ASCII.")
+	flag.BoolVar(&mustNoFontCheck, "no-font-check", false, "Do not check if the fonts used with xelatex or lualatex are installed.")
 	flag.StringSliceVar(&additionalOptions, "option", []string{}, "Additional option to pass to the compiler. Can be used multiple times.")
+	flag.StringArrayVar(&splitOptionValues, "options", []string{}, "Additional options to pass to the compiler, split at spaces and commas except inside quotes.\nCan be used multiple times.")
+	flag.StringArrayVar(&rawOptions, "option-raw", []string{}, "Additional option passed as is (a single argument) to the compiler.\nCan be used multiple times.")
+	flag.StringSliceVar(&precompileOnly, "precompile-option", []string{}, "Like --option, but only for the precompilation (.fmt creation).")
+	flag.StringSliceVar(&compileOnly, "compile-option", []string{}, "Like --option, but only for the compilation (.pdf creation).")
+	flag.BoolVar(&mustNoShellEscape, "no-shell-escape", false, "Disable the shell escape, even if it is asked in an option.")
+	flag.BoolVar(&mustShellRestrict, "shell-restricted", false, "Allow only the restricted shell escape.")
+	flag.StringSliceVar(&shellAllow, "shell-allow", []string{}, "The commands allowed in restricted shell escape (implies --shell-restricted).\nCan be used multiple times.")
+	flag.StringVar(&openoutPolicy, "openout", "", "The files the engine can write [any|restricted|paranoid] (openout_any).")
+	flag.StringVar(&openinPolicy, "openin", "", "The files the engine can read [any|restricted|paranoid] (openin_any).")
+	flag.StringVar(&maxMemory, "max-memory", "", "Limit the memory of the TeX engine (ex. 512M or 2G).")
+	flag.BoolVar(&mustBeNice, "nice", false, "Run the TeX engine with a low priority.")
+	flag.BoolVar(&mustBeNice, "low-priority", false, "Same as --nice.")
+	flag.CommandLine.MarkHidden("low-priority")
+	flag.IntVar(&verifyEvery, "verify-against-full", 0, "Compare the output with a plain compilation (without .fmt) every N compilations.\nWithout value N=10.")
+	flag.Lookup("verify-against-full").NoOptDefVal = "10"
+	flag.StringVar(&viaPandoc, "via-pandoc", "", "Convert the markdown source to .tex with pandoc before compiling.\nThe optional value is the pandoc template to use.")
+	flag.Lookup("via-pandoc").NoOptDefVal = "default"
+	flag.StringSliceVar(&engineList, "engines", []string{}, "Build the document with each engine [pdflatex|xelatex] side by side,\nto filename.pdflatex.pdf, filename.xelatex.pdf...")
+	flag.StringVar(&engineRun, "engine-run", "", "The engine of one of the --engines builds (internal).")
+	flag.CommandLine.MarkHidden("engine-run")
+	flag.StringSliceVar(&exportTargets, "target", []string{}, "Also export the document to this format with pandoc [docx|epub].\nCan be used multiple times.")
+	flag.StringVar(&svgMode, "svg", "", "Also convert the output to SVG with dvisvgm [single|pages].\nsingle=the first page only (a figure), pages=a file by page. Without value single is used.")
+	flag.Lookup("svg").NoOptDefVal = "single"
+	flag.StringVar(&imposeMode, "impose", "", "Also impose the pages of the .pdf with pdfjam [2up|booklet].")
+	flag.StringVar(&concatOutput, "concat", "", "Concatenate the .pdf files of a merge to this file (with qpdf or pdfjam).")
+	flag.StringVar(&documentMetadata, "document-metadata", "", "Add \\DocumentMetadata{...} with these keys before \\documentclass\n(like testphase=phase-III for the tagged PDF).")
+	flag.BoolVar(&mustCheckTagging, "check-tagging", false, "Check that the .pdf is tagged (structure tree, marked content, language).")
+	flag.StringVar(&pdfTitle, "pdf-title", "", "The title in the PDF metadata.")
+	flag.StringVar(&pdfAuthor, "pdf-author", "", "The author in the PDF metadata.")
+	flag.StringVar(&pdfSubject, "pdf-subject", "", "The subject in the PDF metadata.")
+	flag.StringVar(&pdfKeywords, "pdf-keywords", "", "The keywords in the PDF metadata.")
+	flag.BoolVar(&mustWriteXMP, "pdf-xmp", false, "Also write the PDF metadata as XMP with exiftool.")
+	flag.StringVar(&encryptPDF, "encrypt-pdf", "", "Also create a -final.pdf encrypted with qpdf, with these passwords (user:owner).")
+	flag.StringVar(&signPDF, "sign-pdf", "", "Also create a -final.pdf signed by this command, with {in} (and {out}) for the files.")
+	flag.StringVar(&spellLanguage, "spellcheck", "", "Spellcheck the source with hunspell or aspell after each compilation,\nand print the new misspellings. The optional value is the language (like en_US).")
+	flag.Lookup("spellcheck").NoOptDefVal = "default"
+	flag.StringVar(&spellDictionary, "spell-dictionary", defaultSpellDictionary, "The project dictionary of --spellcheck: the accepted words, one by line.")
+	flag.StringVar(&recordFile, "record", "", "Record the last build (sources, split files, commands, environment, logs, versions)\nto this .zip archive, to attach to a bug report.")
+	flag.BoolVar(&mustWatchOutput, "watch-output", false, "Do not compile, only watch the .pdf built by another tool (make, latexmk...)\nand do the actions after the compilation (exports, spellcheck, title, bell...).")
+	flag.StringVar(&titleMode, "set-title", "", "Show the build state in the terminal title [terminal|tmux].\nWith tmux the window name is also set.")
+	flag.Lookup("set-title").NoOptDefVal = "terminal"
+	flag.StringVar(&bellMode, "bell", "never", "Ring the terminal bell at the end of the builds [error|always|never].")
+	flag.BoolVar(&mustFlashBell, "bell-flash", false, "Also flash the terminal when the bell rings.")
+	flag.Var(&presetFlag, "preset", "Set the options of a preset defined in the configuration files.\nCan be used multiple times.")
+	flag.StringArrayVar(&themeSettings, "theme", []string{}, "Set a color [action|success|error|warning|watch] or a symbol [prefix|ok|fail|busy] (key=value).\nCan be used multiple times.")
+	flag.BoolVar(&mustUseASCII, "ascii", false, "Use only ASCII symbols in the messages.")
 	flag.BoolVarP(&mustShowVersion, "version", "v", false, "Print the version number.")
 	flag.BoolVarP(&mustShowHelp, "help", "h", false, "Print this help message.")
 	// keep the flags order
@@ -213,67 +450,281 @@ func SetParameters() {
 	flag.CommandLine.Init("latex-fast-compile", flag.ContinueOnError)
 	// The help message
 	flag.Usage = printHelp
-	err = flag.CommandLine.Parse(os.Args[1:])
+}
+
+// loadDefaultOptions set the flags from the configuration files and the environment variable,
+// before the command line ones. Every source takes precedence over the previous ones:
+// the personal defaults (the user configuration, then the environment variable),
+// then the project configuration, that a stray shell export can't override, and then the command line.
+func loadDefaultOptions() error {
+	for _, load := range []func() error{
+		func() error { return loadConfig(userConfigFile()) },
+		loadEnvOptions,
+		func() error { return loadConfig(configFileName) },
+	} {
+		if err := load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOptions set the flags of a subcommand from the configuration files and the compilation options
+// it gives to this program, and compile the --suppress-warning regexes used to read the logs.
+func parseOptions(options []string) error {
+	defineFlags()
+	if err := loadDefaultOptions(); err != nil {
+		return err
+	}
+	if err := flag.CommandLine.Parse(options); err != nil {
+		return fmt.Errorf("Problem parsing parameters: %w", err)
+	}
+	return compileSuppress()
+}
+
+// jobBase return the job name (inBase) of the source base: the base itself,
+// or its normalized name (see --normalize).
+func jobBase(original string) string {
+	if mustNoNormalize {
+		return original
+	}
+	return disambiguateName(latinJobName(normalizeName(original), original), original)
+}
+
+// jobFolder return the folder of the intermediate files of the job (outFolder), "" without --temp-folder.
+// Every document has its own sub folder, so the temp folder can be shared.
+func jobFolder(job string) string {
+	folder := nativePath(tempFolderName)
+	if len(folder) == 0 {
+		return ""
+	}
+	if !mustNoNormalize {
+		folder = normalizeName(folder)
+	}
+	return filepath.Join(folder, job)
+}
+
+// Set the configuration variables from the command line flags
+func SetParameters() error {
+	defineFlags()
+	if err := loadDefaultOptions(); err != nil {
+		return err
+	}
+	err := flag.CommandLine.Parse(os.Args[1:])
 	// display the help message if the flag is set or if there is an error
 	if mustShowHelp || err != nil {
 		flag.Usage()
-		check(err, "Problem parsing parameters.")
+		if err != nil {
+			return fmt.Errorf("Problem parsing parameters: %w", err)
+		}
 		// if no error
 		os.Exit(0)
 	}
 	// set the info level
-	infoLevel = infoLevelFromString(infoLevelFlag)
+	infoLevel, err = infoLevelFromString(infoLevelFlag)
+	if err != nil {
+		return err
+	}
+	if err := setTrace(); err != nil {
+		return err
+	}
+	// the colors and symbols of the messages
+	if err := setTheme(); err != nil {
+		return err
+	}
+	if err := setTitleMode(); err != nil {
+		return err
+	}
+	if err := checkBellMode(); err != nil {
+		return err
+	}
+	if err := checkBatterySaver(); err != nil {
+		return err
+	}
+	if err := checkIdlePasses(); err != nil {
+		return err
+	}
+	if err := checkFmtBust(); err != nil {
+		return err
+	}
+	if err := checkIndexTool(); err != nil {
+		return err
+	}
+	if err := checkBaseSplit(); err != nil {
+		return err
+	}
+	// the limits of the engine process
+	if err := setLimits(); err != nil {
+		return err
+	}
+	// check for positional parameters, before anything is done with the file
+	// (only --version can be used without file)
+	if flag.NArg() > 1 {
+		return errors.New("No more than one positional parameter (.tex filename) can be specified.")
+	}
+	if flag.NArg() == 0 && !mustShowVersion {
+		return errors.New("You should provide a .tex file to compile.")
+	}
+	// the source base name
+	inBaseOriginal = strings.TrimSuffix(strings.TrimSuffix(nativePath(flag.Arg(0)), ".tex"), ".md")
+	if mustWatchOutput {
+		// the .pdf built by the other tool can be given
+		inBaseOriginal = strings.TrimSuffix(inBaseOriginal, ".pdf")
+	}
+	// a subfile of a bigger document?
+	if !mustNoMagicComments {
+		if err := followTeXRoot(); err != nil {
+			return err
+		}
+	}
+	// build in a unique folder?
+	if mustIsolate && flag.NArg() == 1 {
+		mustNoWatch = true
+		if err := setupIsolation(); err != nil {
+			return err
+		}
+	}
+	// the engine and the options of the editors
+	if !mustNoMagicComments {
+		applyMagicComments()
+	}
+	// the engine needed by the preamble, if not given
+	detectEngine()
+	// CJK documents need special care
+	detectCJK()
+	// one of the side by side builds?
+	if len(engineRun) > 0 {
+		if err := checkEngineNames([]string{engineRun}); err != nil {
+			return err
+		}
+		mustUseXe = engineRun == "xelatex"
+		engineFlag, formatFlag = "", ""
+		// the exports do not depend on the engine, only the first build does them
+		if len(engineList) > 0 && engineList[0] != engineRun {
+			exportTargets = nil
+		}
+	}
 	// set the compiler
-	if mustUseXe {
-		texCompiler = "xetex"
-		latexFormat = "xelatex"
-	} else {
-		texCompiler = "pdftex"
-		latexFormat = "pdflatex"
+	if err := setEngine(); err != nil {
+		return err
 	}
 	// set the distro based on the latex version
 	setDistro()
+	if fmtMethod != "option" && fmtMethod != "line" {
+		return errors.New("Invalid --fmt-method value " + fmtMethod + ".")
+	}
 	// display the version?
 	if mustShowVersion {
 		printVersion()
 		os.Exit(0)
 	}
 
-	// check for positional parameters
-	if flag.NArg() > 1 {
-		check(errors.New("No more than one positional parameter (.tex filename) can be specified."))
+	// markdown source?
+	mustUsePandoc = len(viaPandoc) > 0 || strings.HasSuffix(flag.Arg(0), ".md")
+	if mustUsePandoc && len(viaPandoc) == 0 {
+		viaPandoc = "default"
+	}
+	if mustUsePandoc && strings.HasSuffix(flag.Arg(0), ".tex") {
+		return errors.New("With --via-pandoc the source is the markdown file, not " + flag.Arg(0) + " (use " + inBaseOriginal + ".md).")
+	}
+	if viaPandoc != "default" {
+		viaPandoc = nativePath(viaPandoc)
+	}
+	// export targets?
+	for _, target := range exportTargets {
+		if target != "docx" && target != "epub" {
+			return errors.New("Invalid target " + target + ".")
+		}
+	}
+	if mustUsePandoc || len(exportTargets) > 0 {
+		if _, err := exec.LookPath("pandoc"); err != nil {
+			return errors.New("Can't find pandoc in the current path.")
+		}
 	}
-	if flag.NArg() == 0 {
-		check(errors.New("You should provide a .tex file to compile."))
+	if err := checkPostSteps(); err != nil {
+		return err
+	}
+	if err := checkOutputFormat(); err != nil {
+		return err
+	}
+	if err := setOutputMode(); err != nil {
+		return err
+	}
+	if len(concatOutput) > 0 && infoLevel >= infoErrors {
+		warning("The --concat option is used only by the merge subcommand.")
 	}
 
-	inBaseOriginal = strings.TrimSuffix(flag.Arg(0), ".tex")
-	if mustNoNormalize {
-		inBase = inBaseOriginal
-	} else {
-		inBase = normalizeName(inBaseOriginal)
+	switch normalizeMode {
+	case "strip", "translit":
+	case "none":
+		mustNoNormalize = true
+	default:
+		return errors.New("Invalid --normalize value " + normalizeMode + ".")
+	}
+	inBase = jobBase(inBaseOriginal)
+	outputBase = inBaseOriginal
+	// the side by side builds do not share their intermediate files and outputs
+	if len(engineRun) > 0 {
+		inBase += "." + engineRun
+		outputBase += "." + engineRun
 	}
 
 	// synctex or not?
 	if !mustNotSync {
 		compileOptions = append(compileOptions, "--synctex=-1")
 	}
+	// pdf or dvi?
+	compileOptions = append(compileOptions, outputFormatOptions()...)
+	// the files read by the engine are listed in the .fls, to watch them
+	if usesRecorder() {
+		precompileOptions = append(precompileOptions, "-recorder")
+		compileOptions = append(compileOptions, "-recorder")
+	}
 	// additional options
-	compileOptions = append(compileOptions, additionalOptions...)
-	precompileOptions = append(precompileOptions, additionalOptions...)
+	sharedOptions, err := splitOptions(splitOptionValues)
+	if err != nil {
+		return err
+	}
+	sharedOptions = append(sharedOptions, additionalOptions...)
+	sharedOptions = append(sharedOptions, rawOptions...)
+	compileOnlyOptions, precompileOnlyOptions := compileOnly, precompileOnly
+	// the inputs of the isolated build stay in the source folder
+	sharedOptions = append(sharedOptions, isolationSearchPaths()...)
+	compileOptions = append(compileOptions, sharedOptions...)
+	compileOptions = append(compileOptions, compileOnlyOptions...)
+	precompileOptions = append(precompileOptions, sharedOptions...)
+	precompileOptions = append(precompileOptions, precompileOnlyOptions...)
+	fullOptions = append([]string{"-interaction=batchmode", "-halt-on-error"}, sharedOptions...)
+	fullOptions = append(fullOptions, compileOnlyOptions...)
+	// the shell escape policy overrides the options
+	applyShellPolicy()
+	// the file access policy is set in the environment
+	if err := setFilePolicy("openout_any", openoutPolicy); err != nil {
+		return err
+	}
+	if err := setFilePolicy("openin_any", openinPolicy); err != nil {
+		return err
+	}
+	// the log lines should not be wrapped
+	setLogLineWidth()
 
 	// sanitize log or not?
 	if len(logSanitize) > 0 {
 		reSanitize, err = regexp.Compile(logSanitize)
-		check(err)
+		if err != nil {
+			return fmt.Errorf("Invalid --log-sanitize regex: %w", err)
+		}
 	}
-	// check if tex is present
-	if len(texDistro) == 0 {
+	if err := compileSuppress(); err != nil {
+		return err
+	}
+	// check if tex is present (not needed if the other tool compiles, or without compilation)
+	if len(distro.name) == 0 && !mustWatchOutput && len(splitOnlyMode) == 0 {
 		if len(texVersionStr) == 0 {
-			check(errors.New("Can't find" + texCompiler + "in the current path."))
+			return errors.New("Can't find " + texCompiler + " in the current path.")
 		} else {
 			if infoLevel > infoNo {
-				fmt.Println("Unknown", texCompiler, " version:", texVersionStr)
+				fmt.Println("Unknown distribution of", texCompiler, "("+texVersionStr+"), the TeX Live options are used.")
 			}
 		}
 	}
@@ -282,7 +733,7 @@ func SetParameters() {
 		pathPDFLatex, err := exec.LookPath(texCompiler)
 		if err != nil {
 			// We should never be here
-			check(errors.New("Can't find" + texCompiler + "in the current path (bis)."))
+			return errors.New("Can't find " + texCompiler + " in the current path (bis).")
 		}
 		fmt.Println(texCompiler, "location:", pathPDFLatex)
 	}
@@ -290,38 +741,110 @@ func SetParameters() {
 	// set split pattern
 	if len(splitPattern) > 0 {
 		reSplit, err = regexp.Compile(splitPattern)
-		check(err)
+		if err != nil {
+			return fmt.Errorf("Invalid --split regex: %w", err)
+		}
 	} else {
 		mustCompileAll = true
 	}
 	// set temp folder?
+	tempFolderName = nativePath(tempFolderName)
 	if !mustNoNormalize {
 		tempFolderName = normalizeName(tempFolderName)
 	}
 	if len(tempFolderName) > 0 {
-		if inBase == inBaseOriginal && texDistro == "miktex" {
-			precompileOptions = append(precompileOptions, "-aux-directory="+tempFolderName)
-			compileOptions = append(compileOptions, "-aux-directory="+tempFolderName)
+		outFolder = jobFolder(inBase)
+		if usesAuxDirectory() {
+			precompileOptions = append(precompileOptions, "-aux-directory="+texPath(outFolder))
+			compileOptions = append(compileOptions, "-aux-directory="+texPath(outFolder))
 		} else {
-			precompileOptions = append(precompileOptions, "-output-directory="+tempFolderName)
-			compileOptions = append(compileOptions, "-output-directory="+tempFolderName)
+			precompileOptions = append(precompileOptions, "-output-directory="+texPath(outFolder))
+			compileOptions = append(compileOptions, "-output-directory="+texPath(outFolder))
 		}
-		outBase = filepath.Join(tempFolderName, inBase)
+		outBase = filepath.Join(outFolder, inBase)
 	} else {
 		outBase = inBase
 	}
 
+	// a format name can't have spaces
+	if fmtMethod == "line" && strings.Contains(inBase, " ") {
+		if infoLevel >= infoErrors {
+			warning("The name %q has spaces, the .fmt is given with the -fmt option.", inBase)
+		}
+		fmtMethod = "option"
+	}
+
 	// set the source filename
-	precompileName := "&" + latexFormat + " " + inBase + ".preamble.tex"
+	precompileName := "&" + latexFormat + " " + texFileName(inBase+".preamble.tex")
 	precompileOptions = append(precompileOptions, "-jobname="+inBase, precompileName)
-	compileName := "&" + inBase + " " + inBase + ".body.tex"
+	compileName := "&" + inBase + " " + texFileName(inBase+".body.tex")
 	if mustCompileAll {
-		compileName = "&" + latexFormat + " " + inBase + ".tex"
+		compileName = "&" + latexFormat + " " + texFileName(fullSourceName())
+	} else if fmtMethod == "option" {
+		// the .fmt is found by its path, even in the temp folder
+		compileOptions = append(compileOptions, formatOption())
+		compileName = texFileName(inBase + ".body.tex")
 	}
 	compileOptions = append(compileOptions, "-jobname="+inBase, compileName)
+	if usesTectonic() {
+		// tectonic has its own command line
+		compileOptions = tectonicOptions(append(sharedOptions, compileOnlyOptions...))
+	}
+
+	if err := checkVars(); err != nil {
+		return err
+	}
+	if err := checkIncludeOnly(); err != nil {
+		return err
+	}
+	if err := checkRegion(); err != nil {
+		return err
+	}
+	if err := checkEditPage(); err != nil {
+		return err
+	}
+	if rebuildEvery < 0 {
+		return errors.New("Invalid --every value " + rebuildEvery.String() + ".")
+	}
+
+	// in manual mode only the trigger file is watched
+	if mustManual {
+		if mustNoWatch {
+			return errors.New("The --manual and --no-watch (or --isolated) options can't be used together.")
+		}
+		watchAlso, dataFiles, preambleData = nil, nil, nil
+	}
+	for _, patterns := range [][]string{watchAlso, dataFiles, preambleData} {
+		for i, pattern := range patterns {
+			patterns[i] = nativePath(pattern)
+		}
+	}
+
+	// the side by side builds are run by new processes
+	if runsEngines() {
+		if err := checkEngineNames(engineList); err != nil {
+			return err
+		}
+		if mustManual || mustIsolate {
+			return errors.New("The --engines option can't be used with --manual or --isolated.")
+		}
+	}
+
+	// the warm engine waits for the next compilation, so it is useless without watching
+	if mustNoWatch {
+		mustWarm = false
+	}
 
 	// clear or not
 	mustClear = (infoLevel < infoDebug) && (clearFlag == "yes" || clearFlag == "auto" && !mustNoWatch)
+	if err := checkTrashMode(); err != nil {
+		return err
+	}
+
+	if err := checkSplitOnly(); err != nil {
+		return err
+	}
+	return checkWatchOutput()
 }
 
 // check if file is missing
@@ -350,14 +873,20 @@ func delimit(what, end, msg string) string {
 }
 
 // sanitizeLog try to keep only the lines related to the errors.
-// It is controlled by the regular expression set in `--log-sanitize`.
+// It is controlled by the regular expression set in `--log-sanitize`,
+// and the parts matching a `--suppress-warning` regex are dropped.
 func sanitizeLog(log []byte) string {
 
 	if reSanitize == nil {
 		return delimit("raw log", "end log", string(log))
 	}
 
-	errorLines := reSanitize.FindAll(log, -1)
+	var errorLines [][]byte
+	for _, lines := range reSanitize.FindAll(unwrapLog(log), -1) {
+		if !isSuppressed(string(lines)) {
+			errorLines = append(errorLines, lines)
+		}
+	}
 	if len(errorLines) == 0 {
 		return ("Nothing interesting in the log.")
 	} else {
@@ -366,174 +895,817 @@ func sanitizeLog(log []byte) string {
 
 }
 
-// Build, print and run command.
-// The info parameter is printed if the infoLevel authorize this.
-func run(info, command string, args ...string) (err error) {
-	var startTime time.Time
-	// build command (without possible interactions)
-	cmd := exec.Command(command, args...)
-	cmd.Stdin = nil
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	// print command?
-	if infoLevel == infoDebug {
-		fmt.Println(delimit("command", "", cmd.String()))
+// splitArgs split the `--option` value to arguments.
+// The arguments are separated by spaces or commas (as in `--option=-a,-b`),
+// except inside single or double quotes that are removed.
+func splitArgs(value string) (args []string, err error) {
+	return splitWords(value, true)
+}
+
+// splitWords split the value at spaces (and commas if asked), except inside quotes that are removed.
+func splitWords(value string, atCommas bool) (args []string, err error) {
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range value {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case atCommas && r == ',' || unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
 	}
-	// print action?
-	if infoLevel >= infoActions {
-		startTime = time.Now()
-		fmt.Print("::::::: ", info+"...")
+	if quote != 0 {
+		return nil, errors.New("Unclosed quote in " + value + ".")
 	}
-	// run command
-	err = cmd.Run()
-	// print time?
-	if infoLevel >= infoActions {
-		if err == nil {
-			color.Set(color.FgGreen)
-		} else {
-			color.Set(color.FgRed)
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// splitOptions split all the --options values (see splitArgs).
+func splitOptions(values []string) (options []string, err error) {
+	for _, value := range values {
+		args, err := splitArgs(value)
+		if err != nil {
+			return nil, fmt.Errorf("Problem parsing the option %s: %w", value, err)
 		}
-		fmt.Printf("done [%.1fs]\n", time.Since(startTime).Seconds())
-		color.Unset()
+		options = append(options, args...)
 	}
-	// if error
-	if infoLevel == infoDebug || infoLevel >= infoErrors && err != nil {
-		if infoLevel >= infoErrorsAndLog {
-			dat, logErr := ioutil.ReadFile(outBase + ".log")
-			check(logErr, "Problem reading ", outBase+".log")
-			fmt.Println(sanitizeLog(dat))
+	return options, nil
+}
+
+// the options that control the shell escape (TeX Live and MiKTeX variants)
+var shellOptions = []string{"shell-escape", "no-shell-escape", "shell-restricted", "enable-write18", "disable-write18", "restrict-write18"}
+
+// removeShellOptions return the options without the shell escape ones.
+func removeShellOptions(options []string) (kept []string) {
+	for _, option := range options {
+		name := strings.TrimLeft(option, "-")
+		isShell := false
+		for _, shellOption := range shellOptions {
+			if name == shellOption {
+				isShell = true
+			}
 		}
-		if err != nil {
-			color.Red("The compilation finished with errors.\n")
+		if !isShell {
+			kept = append(kept, option)
 		}
 	}
+	return kept
+}
 
-	return err
+// applyShellPolicy set the shell escape options from the security flags
+// `--no-shell-escape`, `--shell-restricted` and `--shell-allow`.
+func applyShellPolicy() {
+	if !mustNoShellEscape && !mustShellRestrict && len(shellAllow) == 0 {
+		return
+	}
+	compileOptions = removeShellOptions(compileOptions)
+	precompileOptions = removeShellOptions(precompileOptions)
+	fullOptions = removeShellOptions(fullOptions)
+	var option string
+	if mustNoShellEscape {
+		option = distro.noShellEscape
+	} else {
+		option = distro.shellRestricted
+		if len(shellAllow) > 0 {
+			if !distro.kpathseaEnv && infoLevel >= infoErrors {
+				warning("With MiKTeX the allowed commands are set by AllowedShellCommands[] in the configuration, --shell-allow is ignored.")
+			}
+			// kpathsea reads the texmf.cnf variables from the environment
+			engineEnv = append(engineEnv, "shell_escape_commands="+strings.Join(shellAllow, ","))
+		}
+	}
+	compileOptions = append(compileOptions, option)
+	precompileOptions = append(precompileOptions, option)
+	fullOptions = append(fullOptions, option)
 }
 
-// info print the message only if the infoLevel authorize it.
-func info(message ...interface{}) {
-	if infoLevel >= infoActions {
-		fmt.Println(message...)
+// setFilePolicy set the kpathsea file access variable (openout_any or openin_any)
+// in the engine environment. The policy can be given by its name or its first letter.
+func setFilePolicy(variable, policy string) error {
+	if len(policy) == 0 {
+		return nil
+	}
+	switch policy {
+	case "any", "a", "restricted", "r", "paranoid", "p":
+		if !distro.kpathseaEnv && infoLevel >= infoErrors {
+			warning("With MiKTeX %s is not read from the environment, --%s has no effect.", variable, strings.TrimSuffix(variable, "_any"))
+		}
+		engineEnv = append(engineEnv, variable+"="+policy[:1])
+		return nil
+	default:
+		return errors.New("Invalid " + variable + " policy " + policy + ".")
 	}
 }
 
-// Borrowed from https://stackoverflow.com/a/21067803
-func copyFile(src, dst string) (ok bool) {
-	defer func() {
-		if err == nil {
-			ok = true
+// quoteArgs return the command line with the arguments quoted when needed,
+// so the exact argv is visible in the debug output.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if len(arg) == 0 || strings.ContainsAny(arg, " \t\"'\\,") {
+			quoted[i] = strconv.Quote(arg)
 		} else {
-			check(errors.New("Error while copy " + src + " to " + dst + "."))
+			quoted[i] = arg
 		}
-	}()
+	}
+	return strings.Join(quoted, " ")
+}
 
-	info(" copy", src, "to", dst)
+// the width at which TeX wraps the log lines by default
+const defaultMaxPrintLine = 79
 
-	in, err := os.Open(src)
-	if err != nil {
+// the width asked to TeX Live with max_print_line, so the log lines are not wrapped
+const longMaxPrintLine = 10000
+
+// setLogLineWidth ask TeX Live (with the max_print_line variable) to not wrap the log lines,
+// and keep the width used by the engine for unwrapLog.
+func setLogLineWidth() {
+	logLineWidth = defaultMaxPrintLine
+	if value := os.Getenv("max_print_line"); len(value) > 0 {
+		if width, err := strconv.Atoi(value); err == nil {
+			logLineWidth = width
+		}
 		return
 	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return
+	// MiKTeX ignores the environment variable
+	if distro.kpathseaEnv {
+		engineEnv = append(engineEnv, "max_print_line="+strconv.Itoa(longMaxPrintLine))
+		logLineWidth = longMaxPrintLine
 	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
+}
+
+// unwrapLog join the log lines wrapped by TeX at logLineWidth characters,
+// so the multi-line messages and the long file names can be matched by the sanitize regex.
+// The width is counted in bytes (pdftex) or in characters (xetex), so both are tested.
+func unwrapLog(log []byte) []byte {
+	lines := bytes.Split(bytes.ReplaceAll(log, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	var unwrapped bytes.Buffer
+	for i, line := range lines {
+		unwrapped.Write(line)
+		wrapped := len(line) == logLineWidth || utf8.RuneCount(line) == logLineWidth
+		if i < len(lines)-1 && !wrapped {
+			unwrapped.WriteByte('\n')
 		}
-	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
 	}
-	err = out.Sync()
-	return
+	return unwrapped.Bytes()
 }
 
-const xeFirstLine string = `\def\encodingdefault{OT1}\normalfont
-\everyjob\expandafter{\the\everyjob\def\encodingdefault{TU}\normalfont}`
-
-// The xetex precompilation is tricky, so we have to adapt the preamble
-func adaptPreamble(preamble string) (newPreamble, addToBody string) {
-	if !mustUseXe {
-		return preamble, ""
-	}
-	info("Adapt preamble to xelatex.")
-	info("Switch to OT1 encoding in the preamble. And restore TU encoding later.")
-	newPreamble = xeFirstLine
+// Build, print and run command.
+// The info parameter is printed if the infoLevel authorize this.
+// A crashed engine is run again once (see isCrash).
+func run(info, command string, args ...string) (err error) {
+	for retried := false; ; retried = true {
+		cmd := engineCommand(jobContext(), command, args...)
+		startTime := printAction(info)
+		if err = startEngine(cmd); err == nil {
+			err = cmd.Wait()
+		}
+		recordCommand(engineArgs(cmd), err)
+		err = runEnd(cmd, startTime, err)
+		if err == nil {
+			return nil
+		}
+		if !retried && isCrash(err) {
+			noteRetry(err)
+			continue
+		}
+		printReproduction(cmd.Dir, engineArgs(cmd))
+		return err
+	}
+}
+
+// the size of the engine output kept by engineOutput
+const engineOutputSize = 16 * 1024
+
+// engineOutput keep the end of the engine output (stdout and stderr),
+// shown if the engine fails before writing its log (bad format, bad option...).
+type engineOutput struct {
+	started time.Time // the creation of the command, the log is older if it is not written by it
+	data    []byte
+}
+
+// Write keep the last engineOutputSize bytes.
+func (o *engineOutput) Write(p []byte) (int, error) {
+	o.data = append(o.data, p...)
+	if len(o.data) > engineOutputSize {
+		o.data = o.data[len(o.data)-engineOutputSize:]
+	}
+	return len(p), nil
+}
+
+// engineCommand build the engine command (without possible interactions),
+// and print it in debug mode. Its output is kept in an engineOutput.
+func engineCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = nil
+	output := &engineOutput{started: time.Now()}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// a program started by the shell escape can keep the output open
+	cmd.WaitDelay = time.Second
+	if len(engineEnv) > 0 {
+		cmd.Env = append(os.Environ(), engineEnv...)
+	}
+	// print command?
+	if tracing("exec") {
+		if len(engineEnv) > 0 {
+			fmt.Println(delimit("environment", "", strings.Join(engineEnv, "\n")))
+		}
+		fmt.Println(delimit("command", "", quoteArgs(cmd.Args)))
+	}
+	return cmd
+}
+
+// startEngine start the engine command with the memory and priority limits,
+// applied before the engine starts (see prepareLimits).
+func startEngine(cmd *exec.Cmd) error {
+	prepareLimits(cmd)
+	return cmd.Start()
+}
+
+// printAction print the action if the infoLevel authorize this, and return the start time.
+func printAction(info string) (startTime time.Time) {
+	if infoLevel >= infoActions {
+		startTime = time.Now()
+		themeAction.Print(actionPrefix + info + "...")
+	}
+	return startTime
+}
+
+// runEnd print the end of the action started at startTime, and the log if needed.
+// Without a log written by the engine, its output is printed instead.
+func runEnd(cmd *exec.Cmd, startTime time.Time, err error) error {
+	// print time?
+	if infoLevel >= infoActions {
+		if err == nil {
+			themeSuccess.Set()
+		} else {
+			themeError.Set()
+		}
+		fmt.Printf("done [%.1fs]\n", time.Since(startTime).Seconds())
+		color.Unset()
+	}
+	output, _ := cmd.Stdout.(*engineOutput)
+	logName := engineLog()
+	var logData []byte
+	var logErr error
+	if infoLevel == infoDebug || err != nil {
+		logData, logErr = engineLogData(logName, output)
+	}
+	// if error
+	if infoLevel == infoDebug || infoLevel >= infoErrors && err != nil {
+		switch {
+		case logErr != nil && output != nil && len(bytes.TrimSpace(output.data)) > 0:
+			// the real cause is in the output, not in a missing (or old) log
+			fmt.Println(delimit(cmd.Args[0]+" output (no log)", "end output", strings.TrimSpace(string(output.data))))
+		case infoLevel < infoErrorsAndLog:
+		case logErr != nil:
+			themeError.Printf("Problem reading %s: %v\n", logName, logErr)
+		default:
+			fmt.Println(sanitizeLog(logData))
+		}
+		if err != nil {
+			themeError.Println("The compilation finished with errors.")
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	// the cause is kept in the error, for the final report
+	cause := ""
+	if logErr == nil {
+		cause = firstLogError(logData)
+	} else if output != nil && len(bytes.TrimSpace(output.data)) > 0 {
+		cause = lastOutputLine(output.data)
+	}
+	return newCommandError(cmd, err, cause, logErr == nil && len(bytes.TrimSpace(logData)) > 0)
+}
+
+// engineLogData return the log written by the engine, or an error if it is missing
+// or older than the command (with its output).
+func engineLogData(logName string, output *engineOutput) ([]byte, error) {
+	stat, err := os.Stat(logName)
+	if err != nil {
+		return nil, err
+	}
+	if output != nil && stat.ModTime().Before(output.started.Truncate(2*time.Second)) {
+		return nil, errors.New("the log is not written by this run")
+	}
+	return ioutil.ReadFile(logName)
+}
+
+// Build, print and run an external (non TeX) tool.
+// As there is no .log file, the error output of the tool is printed in case of error.
+// The tool has the environment of the engine: bibtex, makeindex... read the same kpathsea policies.
+func runTool(info, command string, args ...string) (err error) {
+	var startTime time.Time
+	var errOutput bytes.Buffer
+	// build command (without possible interactions)
+	cmd := exec.CommandContext(jobContext(), command, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = &errOutput
+	if len(engineEnv) > 0 {
+		cmd.Env = append(os.Environ(), engineEnv...)
+	}
+	// print command?
+	if tracing("exec") {
+		if len(engineEnv) > 0 {
+			fmt.Println(delimit("environment", "", strings.Join(engineEnv, "\n")))
+		}
+		fmt.Println(delimit("command", "", quoteArgs(cmd.Args)))
+	}
+	// print action?
+	if infoLevel >= infoActions {
+		startTime = time.Now()
+		themeAction.Print(actionPrefix + info + "...")
+	}
+	// run command
+	err = cmd.Run()
+	// print time?
+	if infoLevel >= infoActions {
+		if err == nil {
+			themeSuccess.Set()
+		} else {
+			themeError.Set()
+		}
+		fmt.Printf("done [%.1fs]\n", time.Since(startTime).Seconds())
+		color.Unset()
+	}
+	// if error
+	if infoLevel == infoDebug || infoLevel >= infoErrors && err != nil {
+		if infoLevel >= infoErrorsAndLog && errOutput.Len() > 0 {
+			fmt.Println(delimit(command+" output", "end output", strings.TrimSpace(errOutput.String())))
+		}
+		if err != nil {
+			themeError.Println(command + " finished with errors.")
+		}
+	}
+	if err != nil && errOutput.Len() > 0 {
+		return newCommandError(cmd, err, lastOutputLine(errOutput.Bytes()), false)
+	}
+	return newCommandError(cmd, err, "", false)
+}
+
+// info print the message only if the infoLevel authorize it.
+func info(message ...interface{}) {
+	if infoLevel >= infoActions {
+		fmt.Println(message...)
+	}
+}
+
+// Borrowed from https://stackoverflow.com/a/21067803
+func copyFile(src, dst string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Error while copy %s to %s: %w", src, dst, err)
+		}
+	}()
+
+	info(" copy", src, "to", dst)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	// the copy keeps the permissions (and the time) of the original, not the default ones
+	err = copyAttributes(src, dst)
+	return
+}
+
+const xeFirstLine string = `\def\encodingdefault{OT1}\normalfont
+\everyjob\expandafter{\the\everyjob\def\encodingdefault{TU}\normalfont}`
+
+// the CJK setup of the document: "ctexclass", "ctex", "xeCJK", "CJK" or "" if none
+var cjkSetup string
+
+// the ctex document classes
+var reCtexClass = regexp.MustCompile(`\\documentclass\s*(?:\[[^\]]*\])?\s*\{\s*ctex(?:art|rep|book|beamer)\s*\}`)
+
+// detectCJK look in the preamble (without its comments) for the CJK packages and adapt the parameters.
+// ctex and xeCJK need xelatex, and the ctex classes load the fonts so they can't be precompiled.
+func detectCJK() {
+	preamble, err := readPreamble(inBaseOriginal + ".tex")
+	if err != nil {
+		return
+	}
+	switch {
+	case reCtexClass.MatchString(preamble):
+		cjkSetup = "ctexclass"
+	case usesPackage(preamble, "ctex"):
+		cjkSetup = "ctex"
+	case usesPackage(preamble, "xeCJK"):
+		cjkSetup = "xeCJK"
+	case usesPackage(preamble, "CJK") || usesPackage(preamble, "CJKutf8"):
+		cjkSetup = "CJK"
+	default:
+		return
+	}
+	info("CJK document detected (" + cjkSetup + ").")
+	if cjkSetup != "CJK" && !mustUseXe && len(engineFlag) == 0 {
+		info("Use xelatex for this CJK document.")
+		mustUseXe = true
+	}
+	if cjkSetup == "ctexclass" && !mustCompileAll {
+		info("The ctex classes load the fonts, so the preamble can't be precompiled: skip .fmt.")
+		mustCompileAll = true
+	}
+}
+
+// usesOT1Trick is true if the preamble is precompiled with OT1 encoding (see xeFirstLine).
+// The trick is not used for the xelatex CJK setups that it breaks.
+func usesOT1Trick() bool {
+	return mustUseXe && cjkSetup != "ctex" && cjkSetup != "xeCJK"
+}
+
+// transformation record a change made to the source when it is split.
+type transformation struct {
+	line   int    // the line in the source (0 for the added text)
+	action string // what was done
+	text   string // the line or the added text
+	reason string // why it was done
+}
+
+// the changes made to the source by the last splitTeX (shown by the explain subcommand)
+var transformations []transformation
+
+// record add a transformation to the list of the changes made to the source.
+func record(line int, action, text, reason string) {
+	if line > 0 {
+		trace("split", fmt.Sprintf("line %d: %s %q", line, action, text))
+	} else {
+		trace("split", fmt.Sprintf("%s %q", action, text))
+	}
+	transformations = append(transformations, transformation{line, action, text, reason})
+}
+
+// moveToBodyReason return why the preamble line can't be precompiled with xelatex,
+// or an empty string if it can. A commented package is kept in the preamble.
+func moveToBodyReason(line string) string {
+	line = stripComments(line)
+	if strings.Contains(line, "fontspec") || strings.Contains(line, "polyglossia") {
+		return "The system fonts loaded by fontspec and polyglossia can't be precompiled."
+	}
+	if cjkSetup == "ctex" || cjkSetup == "xeCJK" {
+		for _, s := range []string{"ctex", "xeCJK", `\setCJK`} {
+			if strings.Contains(line, s) {
+				return "The " + cjkSetup + " fonts can't be precompiled."
+			}
+		}
+	}
+	return ""
+}
+
+// The xetex precompilation is tricky, so we have to adapt the preamble
+func adaptPreamble(preamble string) (newPreamble, addToBody string) {
+	if !mustUseXe {
+		return preamble, ""
+	}
+	info("Adapt preamble to xelatex.")
+	var newLines []string
+	if usesOT1Trick() {
+		info("Switch to OT1 encoding in the preamble. And restore TU encoding later.")
+		newLines = append(newLines, xeFirstLine)
+		record(0, "add to preamble", xeFirstLine, "The TU fonts can't be precompiled by xelatex: the preamble is precompiled with OT1 and TU is restored at every compilation.")
+	}
 	preambleLines := strings.Split(preamble, "\n")
-	for _, line := range preambleLines {
-		if strings.Contains(line, "fontspec") || strings.Contains(line, "polyglossia") {
+	for i, line := range preambleLines {
+		if reason := moveToBodyReason(line); len(reason) > 0 {
 			info("Move line from preamble to body: ", line)
 			addToBody += line + "\n"
+			record(i+1, "move to body", line, reason)
 		} else {
-			newPreamble += "\n" + line
+			newLines = append(newLines, line)
 		}
 	}
+	newPreamble = strings.Join(newLines, "\n")
 
 	return
 }
 
+// errSourceGone is returned when the source is missing while watching (see isSourceGone).
+var errSourceGone = errors.New("The source is missing.")
+
+// isSourceGone check if the source is missing while we are recompiling in watch mode.
+// This is not an error: editors and git can remove and recreate the file,
+// and the compilation restarts when the file comes back.
+func isSourceGone(sourceName string) bool {
+	if mustNoWatch || !isRecompiling || !isFileMissing(sourceName) {
+		return false
+	}
+	info("File " + sourceName + " is missing, wait for it to come back.")
+	return true
+}
+
+// the last line of the .tex produced by pandoc, to never overwrite (or clear) a .tex written by hand
+const pandocMark = "% generated from the markdown source by latex-fast-compile"
+
+// isGeneratedTeX check if the .tex file is missing or produced by convertMarkdown.
+func isGeneratedTeX(texName string) bool {
+	data, err := ioutil.ReadFile(texName)
+	if err != nil {
+		return isFileMissing(texName)
+	}
+	return strings.HasSuffix(strings.TrimSpace(string(data)), pandocMark)
+}
+
+// convertMarkdown produce the `.tex` file from the `.md` source using pandoc.
+// The `.tex` file is saved next to the `.md` source and is then split as usual.
+// An existing `.tex` not produced by pandoc is never overwritten, and the produced one is cleared at the end.
+func convertMarkdown() error {
+	if !mustUsePandoc {
+		return nil
+	}
+	sourceName := inBaseOriginal + ".md"
+	if isSourceGone(sourceName) {
+		return errSourceGone
+	}
+	if isFileMissing(sourceName) {
+		return atStage("pandoc", errors.New("File "+sourceName+" is missing."))
+	}
+	texName := inBaseOriginal + ".tex"
+	if !isGeneratedTeX(texName) {
+		return atStage("pandoc", errors.New("The file "+texName+" is not produced from "+sourceName+", it is not overwritten (rename one of them)."))
+	}
+	args := []string{sourceName, "--standalone", "--to=latex", "--output=" + texName}
+	if viaPandoc != "default" {
+		args = append(args, "--template="+viaPandoc)
+	}
+	err := runTool("Convert "+sourceName+" with pandoc", "pandoc", args...)
+	if err != nil {
+		return atStage("pandoc", fmt.Errorf("Problem converting %s to .tex: %w", sourceName, err))
+	}
+	// the mark is after \end{document}, so the line numbers are kept
+	texFile, err := os.OpenFile(texName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return atStage("pandoc", fmt.Errorf("Problem marking %s: %w", texName, err))
+	}
+	defer texFile.Close()
+	if _, err := texFile.WriteString("\n" + pandocMark + "\n"); err != nil {
+		return atStage("pandoc", fmt.Errorf("Problem marking %s: %w", texName, err))
+	}
+	return nil
+}
+
+// the regular expressions used to find the included files and the bibliography
+var (
+	reInput        = regexp.MustCompile(`\\(?:input|include)\s*\{([^}]+)\}`)
+	reBibliography = regexp.MustCompile(`\\(?:bibliography|addbibresource)\s*(?:\[[^\]]*\])?\s*\{([^}]+)\}`)
+)
+
+// includedPath return the path of the file included by fromFile (with `\input`, `\include` or `\bibliography`),
+// with the default extension, or "" if it is missing. Like TeX the path is relative to the current folder,
+// else it is relative to the folder of the including file (like with the import package).
+func includedPath(name, ext, fromFile string) string {
+	name = strings.TrimSpace(name)
+	if filepath.Ext(name) == "" {
+		name += ext
+	}
+	if !isFileMissing(name) {
+		return name
+	}
+	if folder := filepath.Dir(fromFile); folder != "." && !filepath.IsAbs(name) {
+		if nested := filepath.Join(folder, name); !isFileMissing(nested) {
+			return nested
+		}
+	}
+	// the inputs of the isolated build are not copied
+	if len(isolatedDir) > 0 && !filepath.IsAbs(name) {
+		if original := filepath.Join(sourceDir, name); !isFileMissing(original) {
+			return original
+		}
+	}
+	return ""
+}
+
+// flattenTeX return the content of the .tex file, without its comments, where all `\input` and `\include`
+// are replaced (recursively) by the content of the corresponding files.
+// The missing files are left as they are.
+func flattenTeX(fileName string, depth int) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	code := stripComments(string(data))
+	if depth > 10 {
+		return code, nil
+	}
+	var flattenErr error
+	flat := reInput.ReplaceAllStringFunc(code, func(match string) string {
+		included := includedPath(reInput.FindStringSubmatch(match)[1], ".tex", fileName)
+		if len(included) == 0 || flattenErr != nil {
+			return match
+		}
+		text, err := flattenTeX(included, depth+1)
+		if err != nil {
+			flattenErr = err
+			return match
+		}
+		return text
+	})
+	return flat, flattenErr
+}
+
+// texReferences return the existing bibliography files and the existing files included by the .tex file.
+func texReferences(fileName string) (bibs, inputs []string, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	code := stripComments(string(data))
+	for _, match := range reBibliography.FindAllStringSubmatch(code, -1) {
+		for _, bib := range strings.Split(match[1], ",") {
+			if bibName := includedPath(bib, ".bib", fileName); len(bibName) > 0 {
+				bibs = append(bibs, bibName)
+			}
+		}
+	}
+	for _, match := range reInput.FindAllStringSubmatch(code, -1) {
+		if included := includedPath(match[1], ".tex", fileName); len(included) > 0 {
+			inputs = append(inputs, included)
+		}
+	}
+	return bibs, inputs, nil
+}
+
+// bibFiles return the list of the bibliography files used in the .tex file and in its included files.
+func bibFiles(fileName string, depth int) (files []string, err error) {
+	files, inputs, err := cachedReferences(fileName)
+	if err != nil || depth > 10 {
+		return files, err
+	}
+	for _, included := range inputs {
+		nested, err := bibFiles(included, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, nested...)
+	}
+	return files, nil
+}
+
+// exportDocument produce the `--target` documents (docx, epub...) with pandoc.
+// The markdown source is used if present, else the flattened .tex source.
+func exportDocument() error {
+	if len(exportTargets) == 0 {
+		return nil
+	}
+	var args []string
+	if mustUsePandoc {
+		args = append(args, inBaseOriginal+".md")
+		if viaPandoc != "default" {
+			args = append(args, "--template="+viaPandoc)
+		}
+	} else {
+		flatName := inBase + ".flat.tex"
+		flatData, err := flattenTeX(inBaseOriginal+".tex", 0)
+		if err != nil {
+			return atStage("export", fmt.Errorf("Problem reading the source: %w", err))
+		}
+		info(" create", flatName)
+		if err := ioutil.WriteFile(flatName, []byte(flatData), 0644); err != nil {
+			return atStage("export", fmt.Errorf("Problem while writing %s: %w", flatName, err))
+		}
+		defer clearFiles(inBase, "flat.tex")
+		args = append(args, flatName, "--from=latex")
+		bibs, err := bibFiles(inBaseOriginal+".tex", 0)
+		if err != nil {
+			return atStage("export", fmt.Errorf("Problem reading the source: %w", err))
+		}
+		if len(bibs) > 0 {
+			args = append(args, "--citeproc")
+			for _, bib := range bibs {
+				args = append(args, "--bibliography="+bib)
+			}
+		}
+	}
+	for _, target := range exportTargets {
+		err := runTool("Export to "+target, "pandoc", append(args, "--standalone", "--output="+inBaseOriginal+"."+target)...)
+		if err != nil {
+			return atStage("export", fmt.Errorf("Problem exporting to %s: %w", target, err))
+		}
+	}
+
+	return nil
+}
+
 // splitTeX split the `.tex` file to two files `.preamble.tex` and `.body.tex`.
 // it also append `\dump` to the preamble and perpend `%&...` to the body.
 // both files are saved in the same folder (not in the temporary one) as the original source.
-func splitTeX() (ok bool) {
+func splitTeX() error {
 	sourceName := inBaseOriginal + ".tex"
+	if isSourceGone(sourceName) {
+		return errSourceGone
+	}
 	if isFileMissing(sourceName) {
-		check(errors.New("File " + sourceName + " is missing."))
+		return atStage("split", errors.New("File "+sourceName+" is missing."))
 	}
-	// we hope that...
-	ok = true
 	// copy the original?
-	if mustCompileAll && inBaseOriginal != inBase {
-		ok = copyFile(inBaseOriginal+".tex", inBase+".tex")
+	if mustCompileAll && fullSourceName() != inBaseOriginal+".tex" {
+		if err := copySource(fullSourceName()); err != nil {
+			return atStage("split", err)
+		}
 	}
 	// is the split necessary?
+	transformations = nil
 	if !mustBuildFormat && mustCompileAll {
-		return
+		return nil
 	}
 	// read the file
 	var texdata []byte
 	for i := 0; i < 2; i++ {
+		var err error
 		texdata, err = ioutil.ReadFile(sourceName)
-		check(err, "Problem reading "+sourceName+" for splitting.")
+		if err != nil && isSourceGone(sourceName) {
+			return errSourceGone
+		}
+		if err != nil {
+			return atStage("split", fmt.Errorf("Problem reading %s for splitting: %w", sourceName, err))
+		}
 		if len(texdata) == 0 {
 			if i == 0 {
 				info("Problem reading " + sourceName + " for splitting. Try one more time.")
 				time.Sleep(100 * time.Millisecond)
 			} else {
-				check(errors.New("Problem reading " + sourceName + " for splitting."))
-				return false
+				return atStage("split", errors.New("Problem reading "+sourceName+" for splitting: the file is empty."))
 			}
 		} else {
 			break
 		}
 	}
+	texdata = substituteVars(texdata)
+	// the text outside of the preamble can outdate the .fmt
+	if !mustCompileAll {
+		checkFmtBustText(texdata)
+	}
 	// split the file
 	loc := reSplit.FindIndex(texdata)
 	if len(loc) == 0 {
-		check(errors.New("Problem while splitting " + sourceName + " to preamble and body."))
-		return false
+		return atStage("split", errors.New("Problem while splitting "+sourceName+" to preamble and body."))
 	}
 	texPreamble := string(texdata[:loc[0]])
+	if code := documentMetadataCode(texdata); len(code) > 0 {
+		texPreamble = code + texPreamble
+		record(1, "add to preamble", code, "The document metadata (--document-metadata) must be set before \\documentclass.")
+	}
 	texBody := string(texdata[loc[0]:])
+	record(strings.Count(texPreamble, "\n")+1, "split", strings.SplitN(texBody, "\n", 2)[0], "The preamble ends here (see --split).")
+	if len(includeOnly) > 0 {
+		texBody = string(addIncludeOnly([]byte(texBody)))
+		record(0, "add to body", includeOnlyCode(), "Only these files are included (--include-only), on the line of \\begin{document} to keep the line numbers.")
+	}
 
 	// create the .preamble.tex
 	preambleName := inBase + ".preamble.tex"
 	texPreamble, addToBody := adaptPreamble(texPreamble)
+	// the lines of the whole preamble, counted before its base is split out
+	preambleLines := strings.Count(texPreamble, "\n")
+	texPreamble, err := splitBase(texPreamble)
+	if err != nil {
+		return atStage("split", err)
+	}
 	info(" create", preambleName)
-	err = ioutil.WriteFile(preambleName, []byte(texPreamble+"\\dump"), 0644)
-	check(err, "Problem while writing", preambleName)
-	ok = (err == nil)
+	record(0, "add to preamble", "\\dump", "The format is saved at the end of the preamble.")
+	if err := ioutil.WriteFile(preambleName, []byte(texPreamble+"\\dump"), 0644); err != nil {
+		return atStage("split", fmt.Errorf("Problem while writing %s: %w", preambleName, err))
+	}
 
 	// create the .body.tex
 	// first count the number on lines in the header
 	// to add them to the body
 	// to preserve the line numbering (for errors location and synctex)
-	numLinesInPreamble := strings.Count(texPreamble, "\n") - strings.Count(addToBody, "\n")
-	if mustUseXe {
+	numLinesInPreamble := preambleLines - strings.Count(addToBody, "\n")
+	if usesOT1Trick() {
 		numLinesInPreamble -= strings.Count(xeFirstLine, "\n")
 	}
 	// if the preamble is empty, no need
@@ -541,14 +1713,43 @@ func splitTeX() (ok bool) {
 		info("The preamble is empty.")
 		numLinesInPreamble = 1
 	}
-	fakePreamble := "%&" + inBase + strings.Repeat("\n", numLinesInPreamble)
+	firstLine := "%&" + inBase
+	if fmtMethod == "option" {
+		// the .fmt is given by the -fmt option, the first line is only a reminder
+		firstLine = "% precompiled preamble in " + inBase + ".fmt"
+	}
+	fakePreamble := firstLine + strings.Repeat("\n", numLinesInPreamble)
+	if hasMetadata() {
+		// on the second line, as the first one can be the %& line
+		fakePreamble = firstLine + "\n" + metadataCode() + strings.Repeat("\n", numLinesInPreamble-1)
+	}
+	record(0, "add to body", firstLine, fmt.Sprintf("Load the precompiled %s.fmt, followed by %d empty lines in place of the preamble to keep the line numbers (errors and synctex).", inBase, numLinesInPreamble))
+	if hasMetadata() {
+		record(0, "add to body", metadataCode(), "The PDF metadata (--pdf-title...) are set at the beginning of the document, so the .fmt does not depend on them.")
+	}
 	bodyName := inBase + ".body.tex"
 	info(" create", bodyName)
-	err = ioutil.WriteFile(bodyName, []byte(fakePreamble+addToBody+texBody), 0644)
-	check(err, "Problem while writing", bodyName)
-	ok = ok && (err == nil)
+	if err := ioutil.WriteFile(bodyName, []byte(fakePreamble+addToBody+texBody), 0644); err != nil {
+		return atStage("split", fmt.Errorf("Problem while writing %s: %w", bodyName, err))
+	}
 
-	return ok
+	return nil
+}
+
+// texFileName return the file name with / separators, and quoted if it has spaces,
+// as TeX reads the name only up to the first space.
+// The quoted names are understood by TeX Live and MiKTeX.
+func texFileName(name string) string {
+	name = texPath(name)
+	if strings.Contains(name, " ") {
+		return `"` + name + `"`
+	}
+	return name
+}
+
+// formatOption return the engine option that loads the precompiled .fmt by its path.
+func formatOption() string {
+	return distro.formatOption + texPath(outBase)
 }
 
 // clearFiles is used by clearTeX and clearAux.
@@ -559,47 +1760,146 @@ func clearFiles(base, extensions string) {
 		if isFileMissing(fileToDelete) {
 			continue
 		}
-		if infoLevel >= infoActions {
-			info(" remove", fileToDelete)
-		}
-		os.Remove(fileToDelete)
+		removeFile(fileToDelete)
 	}
 }
 
-// clear the files produced by splitTeX().
+// clear the files produced by splitTeX() (and writeRegion()), and the .tex produced by convertMarkdown().
 func clearTeX() {
-	clearFiles(inBase, "preamble.tex,body.tex")
+	clearFiles(inBase, "preamble.tex,body.tex,full.tex,region.tex,base.tex")
+	if mustUsePandoc && !isFileMissing(inBaseOriginal+".tex") && isGeneratedTeX(inBaseOriginal+".tex") {
+		removeFile(inBaseOriginal + ".tex")
+	}
 }
 
-// clear the auxiliary files produced by the tex compiler
+// clear the auxiliary files produced by the tex compiler, and the state file kept with the .fmt
 func clearAux() {
-	clearFiles(outBase, auxExtensions)
+	clearFiles(outBase, safeExtensions(outBase, auxExtensions+",base.fmt,"+stateExtension))
+	clearTectonic()
+	clearRegion()
+	if usesRecorder() {
+		clearFiles(outBase, safeExtensions(outBase, "fls"))
+	}
+	if writesDVI() {
+		clearFiles(outBase, safeExtensions(outBase, "dvi"))
+	}
+	clearFormatInRAM(outBase)
+	clearFormatInRAM(baseName(outBase))
+}
+
+// createTempFolder create the temp folder if it is missing.
+// It is called before every compilation as the folder can be removed while watching.
+func createTempFolder() error {
+	if len(outFolder) == 0 || !isFolderMissing(outFolder) {
+		return nil
+	}
+	info(" create folder", outFolder)
+	if err := os.MkdirAll(outFolder, 0755); err != nil {
+		return atStage("temp folder", fmt.Errorf("Problem creating %s: %w", outFolder, err))
+	}
+	return nil
+}
+
+// a lock older than this is left by a killed process
+const staleLockAge = 10 * time.Minute
+
+// the lock file held by this process (if any)
+var heldLock string
+
+// lockOutFolder wait until no other process compiles in the output folder, and take it.
+// The lock is a file created exclusively in the folder. It is released by unlockOutFolder.
+func lockOutFolder() {
+	if len(outFolder) == 0 {
+		return
+	}
+	lockName := filepath.Join(outFolder, ".lock")
+	for waiting := false; ; {
+		lockFile, err := os.OpenFile(lockName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintln(lockFile, os.Getpid())
+			lockFile.Close()
+			heldLock = lockName
+			return
+		}
+		if stat, err := os.Stat(lockName); err == nil && time.Since(stat.ModTime()) > staleLockAge {
+			info(" remove stale lock", lockName)
+			os.Remove(lockName)
+			continue
+		}
+		if isFolderMissing(outFolder) {
+			return
+		}
+		if !waiting {
+			info("Wait for", outFolder, "to be released by another compilation...")
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unlockOutFolder release the lock taken by lockOutFolder.
+func unlockOutFolder() {
+	if len(heldLock) > 0 {
+		os.Remove(heldLock)
+		heldLock = ""
+	}
 }
 
 // precompile produce the `.fmt` file based on the `.preamble.tex` part.
 func precompile() (err error) {
+	// a bad .fmt is rebuilt, instead of an obscure engine error
+	if err := checkFormat(); err != nil {
+		return atStage("precompile", err)
+	}
 	if mustBuildFormat || !mustCompileAll && isFileMissing(outBase+".fmt") {
-		err = run("Precompile", texCompiler, precompileOptions...)
+		lockOutFolder()
+		// the waiting engine has the old format loaded
+		stopWarm()
+		unlinkFormat(outBase)
+		startTime := time.Now()
+		if len(baseHash) > 0 {
+			err = precompileLayers()
+		} else {
+			err = run("Precompile", texCompiler, precompileOptions...)
+		}
+		recordPrecompile(time.Since(startTime), err)
+		// the preamble warnings do not appear in the next (body-only) logs
+		if err == nil {
+			rememberWarnings()
+			rememberFormat()
+			recordInputs(true)
+			collectFormat()
+			moveFormatToRAM(outBase)
+		}
+		unlockOutFolder()
 	}
 	// we tel to splitTeX that the preamble is not needed any more
 	mustBuildFormat = false
 
-	return err
+	return atStage("precompile", err)
 }
 
-// compileEnd is defered to the compile end
+// compileEnd is called at the compile end
 func compileEnd() {
 	if isRecompiling {
-		color.Set(color.FgCyan)
-		info("Wait for new changes...")
+		themeWatch.Set()
+		if mustManual {
+			info("Wait for new requests...")
+		} else {
+			info("Wait for new changes...")
+		}
 		color.Unset()
 	}
-	isCompiling = false
 }
 
 // compile produce the `.pdf` file based on the `.body.tex` part.
 func compile(draft bool) (err error) {
-	defer compileEnd()
+	// tectonic reruns the engine by itself
+	if draft && usesTectonic() {
+		return nil
+	}
+	lockOutFolder()
+	defer unlockOutFolder()
 	msg := "Compile "
 	if draft {
 		msg += "draft "
@@ -609,71 +1909,246 @@ func compile(draft bool) (err error) {
 	} else {
 		msg += "(use precompiled " + outBase + ".fmt)"
 	}
-	if draft {
+	auxBefore := takeAuxSnapshot()
+	startTime := time.Now()
+	if draft && !writesDVI() {
 		draftOptions := append(compileOptions, "-draftmode")
 		err = run(msg, texCompiler, draftOptions...)
+	} else if mustWarm && !mustCompileAll {
+		err = runWarm(msg)
 	} else {
 		err = run(msg, texCompiler, compileOptions...)
 	}
+	if usesTectonic() {
+		if err := collectTectonicOutput(); err != nil {
+			return atStage("output", err)
+		}
+	}
+	// the statistics of the non draft compilations
+	if !draft {
+		pages := -1
+		if err == nil && len(metricsAddress) > 0 {
+			pages = logPages(outBase + ".log")
+		}
+		recordCompile(time.Since(startTime), err, pages)
+	}
+	// prepare the engine for the next compilation
+	startWarm()
 	if err != nil {
-		return err
+		return atStage("compile", err)
+	}
+	// the DVI engines (without -draftmode) need a driver for the .pdf
+	if !draft && writesDVI() && outputFormat == "pdf" {
+		if err := dviToPDF(outBase); err != nil {
+			return atStage(dviDriver, err)
+		}
+	}
+	// the changes of the auxiliary files explain the need of more compilations
+	// (tectonic reruns the engine by itself)
+	if !usesTectonic() && reportAuxChurn(auxBefore, draft) && !draft {
+		scheduleIdlePass()
+	}
+	// the files read by the compilation are watched
+	if !draft {
+		recordInputs(false)
 	}
-	// move/rename .pdf and .synctex to the original source
-	if !draft && inBaseOriginal != outBase && (texDistro != "miktex" || inBaseOriginal != inBase) {
-		if !isFileMissing(outBase + ".pdf") {
-			if copyFile(outBase+".pdf", inBaseOriginal+".pdf") {
-				info(" delete", outBase+".pdf")
-				os.Remove(outBase + ".pdf")
+	// the full builds give the preamble warnings, the others remind them
+	if !draft {
+		if mustCompileAll {
+			rememberWarnings()
+		} else {
+			remindWarnings()
+		}
+	}
+	if !draft && !mustNotSync {
+		trace("synctex", "Written by the engine:", outBase+".synctex", !isFileMissing(outBase+".synctex"))
+	}
+	// move/rename the output (.pdf, or .dvi/.xdv) and .synctex to the original source
+	if !draft && outputBase != outBase && !usesAuxDirectory() {
+		output := "." + outputExtension()
+		if !isFileMissing(outBase + output) {
+			if err := copyFile(outBase+output, outputBase+output); err != nil {
+				return atStage("output", err)
 			}
+			info(" delete", outBase+output)
+			os.Remove(outBase + output)
 		}
 		if !mustNotSync && !isFileMissing(outBase+".synctex") {
-			info(" move", outBase+".synctex", "to", inBaseOriginal+".synctex")
-			err = os.Rename(outBase+".synctex", inBaseOriginal+".synctex")
-			check(err, "Error while copy "+outBase+".synctex  to "+inBaseOriginal+".synctex.")
+			info(" move", outBase+".synctex", "to", outputBase+".synctex")
+			if err := moveFile(outBase+".synctex", outputBase+".synctex"); err != nil {
+				return atStage("output", err)
+			}
 		}
 	}
-	// modify .synctex?
-	if !mustNotSync && (!mustCompileAll || mustCompileAll && inBase != inBaseOriginal) {
-		info(" modify", inBaseOriginal+".synctex")
-		syncdata, err := ioutil.ReadFile(inBaseOriginal + ".synctex")
-		check(err, "Problem reading", inBaseOriginal+".synctex")
-		ext := ".body.tex"
+	// modify .synctex? (the one of a draft compilation is replaced by the next one)
+	if !draft && !mustNotSync && (!mustCompileAll || mustCompileAll && fullSourceName() != inBaseOriginal+".tex") {
+		info(" modify", outputBase+".synctex")
+		syncdata, err := ioutil.ReadFile(outputBase + ".synctex")
+		if err != nil {
+			return atStage("synctex", fmt.Errorf("Problem reading %s: %w", outputBase+".synctex", err))
+		}
+		compiledName := inBase + ".body.tex"
 		if mustCompileAll {
-			ext = ".tex"
+			compiledName = fullSourceName()
+		}
+		if tracing("synctex") {
+			trace("synctex", "Replace", compiledName, "by", inBaseOriginal+".tex", "found:", bytes.Contains(syncdata, []byte(compiledName)))
+		}
+		syncdata = bytes.Replace(syncdata, []byte(compiledName), []byte(inBaseOriginal+".tex"), 1)
+		if err := ioutil.WriteFile(outputBase+".synctex", syncdata, 0644); err != nil {
+			return atStage("synctex", fmt.Errorf("Problem modifying %s: %w", outputBase+".synctex", err))
+		}
+	}
+	if !draft {
+		if err := applyOutputMode(); err != nil {
+			return atStage("output", err)
 		}
-		syncdata = bytes.Replace(syncdata, []byte(inBase+ext), []byte(inBaseOriginal+".tex"), 1)
-		err = ioutil.WriteFile(inBaseOriginal+".synctex", syncdata, 0644)
-		check(err, "Problem modifying", inBaseOriginal+".synctex")
 	}
+	return nil
+}
 
+// prepare convert, split and precompile (if needed) the source before the compilation.
+func prepare() error {
+	forgetCommands()
+	noteEditedLine()
+	updateInputWatch()
+	if err := convertMarkdown(); err != nil {
+		return err
+	}
+	if err := splitTeX(); err != nil {
+		return err
+	}
+	// the temp folder or the .fmt could have been removed while watching
+	if isRecompiling && !mustCompileAll && isFileMissing(outBase+".fmt") {
+		info("The precompiled " + outBase + ".fmt is missing, rebuild it.")
+	}
+	if err := createTempFolder(); err != nil {
+		return err
+	}
+	return precompile()
+}
+
+// showResult show the result of a build in the terminal title and with the bell.
+func showResult(err error) {
+	titleResult(err)
+	ringBell(err)
+	writeBadge(err)
+	reportRetries()
+}
+
+// submitRebuild queue the jobs that rebuild the document when the source changes.
+// Every job queues the next one only if it succeeds: preparation, compilation and then export.
+// The running exports are outdated, so they are cancelled.
+// The reason is printed when the rebuild starts.
+// With withFormat the .fmt is also rebuilt.
+func submitRebuild(reason string, withFormat bool) {
+	name := "preparation"
+	if withFormat {
+		name = "preparation with precompile"
+	}
+	jobs.cancel(priorityPostTool)
+	cancelIdlePass()
+	jobs.submit(job{name: name, priority: priorityPrecompile, run: func() error {
+		info(reason)
+		setTitle(symbolBusy, "compiling")
+		if withFormat {
+			mustBuildFormat = true
+		}
+		if err := prepare(); err != nil {
+			showResult(err)
+			return err
+		}
+		jobs.submit(job{name: "compilation", priority: priorityCompile, run: compileJob})
+		return nil
+	}})
+}
+
+// compileJob compile the body, and queue the post-steps if it succeeds.
+func compileJob() error {
+	err := compile(false)
+	if err == nil {
+		err = bibliographyPasses()
+	}
+	if err == nil {
+		err = indexPass()
+	}
+	if err == nil {
+		err = reportEditPage()
+	}
+	showResult(err)
+	if err != nil {
+		return err
+	}
+	if isVerificationDue() {
+		jobs.submit(job{name: "verification", priority: priorityCheck, run: func() error {
+			return atStage("verify", verifyAgainstFull())
+		}})
+	}
+	if hasPostSteps() {
+		jobs.submit(job{name: "export", priority: priorityPostTool, run: func() error {
+			err := runPostSteps()
+			if err != nil {
+				showResult(err)
+			}
+			return err
+		}})
+	}
 	return nil
 }
 
-// recompile is called when the source file changes (and we are watching it).
-func recompile() {
-	if splitTeX() {
-		isRecompiling = true
-		compile(false)
-		isRecompiling = false
-	} else {
-		isCompiling = false
+// watchedFiles return the list of the source files to watch for changes.
+func watchedFiles() []string {
+	if !mustUsePandoc {
+		if len(subfileName) > 0 {
+			return []string{inBaseOriginal + ".tex", subfileName}
+		}
+		return []string{inBaseOriginal + ".tex"}
 	}
+	files := []string{inBaseOriginal + ".md"}
+	// the template can be a file or a name known by pandoc
+	if viaPandoc != "default" && !isFileMissing(viaPandoc) {
+		files = append(files, viaPandoc)
+	}
+	return files
 }
 
 // This is the last function executed in this program.
-func mainEnd() {
-	// clear the files?
-	if mustClear {
+// It clears the files and exits with status 1 if there is an error.
+func mainEnd(err error) {
+	// stop the running job (if any), and wait for its end
+	jobs.stop()
+	stopWarm()
+	// give back the terminal title
+	restoreTitle()
+	// stop the build requests
+	closeSocket()
+	closeMetrics()
+	// stop the side by side builds
+	stopEngines()
+	// do not block the other processes
+	unlockOutFolder()
+	// the archive of the session needs the split files
+	if recordErr := writeRecord(err); recordErr != nil {
+		reportError(atStage("record", recordErr))
+	}
+	// clear the files? (the side by side builds clear their own files)
+	if mustClear && !runsEngines() {
 		clearAux()
 	}
-	if infoLevel < infoDebug {
+	if runsEngines() || mustKeepIntermediate {
+		// nothing to clear
+	} else if infoLevel < infoDebug {
 		clearTeX()
 	} else {
 		fmt.Println("Do not clear", inBase+".preamble.tex", "and", inBase+".body.tex.")
 		fmt.Println("End.")
 	}
+	// copy back the outputs of an isolated build
+	if isolationErr := endIsolation(); err == nil {
+		err = isolationErr
+	}
 	// in case of error return status is 1
-	if r := recover(); r != nil {
+	if err != nil {
 		os.Exit(1)
 	}
 
@@ -683,83 +2158,535 @@ func mainEnd() {
 
 // If we terminate with Ctrl/Cmd-C we call end()
 func catchCtrlC() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		mainEnd()
+		mainEnd(nil)
 	}()
 }
 
-// Ready to go!
-func main() {
-	// error handling
-	catchCtrlC()
-	defer mainEnd()
-	// The flags
-	SetParameters()
-	// prepare the source files
-	splitTeX()
+// the subcommands, recognized by the first parameter
+var subcommands = map[string]func(args []string) error{
+	"init":             initProject,
+	"engines":          listEngines,
+	"explain":          explainDocument,
+	"fmt":              formatCommand,
+	"doctor":           doctor,
+	"serve":            serve,
+	"sync":             syncProject,
+	"merge":            mergeDocuments,
+	"replay":           replaySession,
+	"profile-preamble": profilePreamble,
+	"test-preamble":    testPreamble,
+	"watch-debug":      watchDebug,
+}
 
-	// create .fmt (if needed)
-	err = precompile()
-	check(err, "Problem with the header compilation.")
-	// start compiling
-	for i := 0; i < numCompilesAtStart; i++ {
-		isCompiling = true
-		err = compile(i < numCompilesAtStart-1) // only the last compile is not in draft mode
+// isDocumentName check if the name is the one of a source of the current folder (name.tex or name.md).
+// Such a document is compiled, even if its name is the one of a subcommand (like doctor.tex).
+func isDocumentName(name string) bool {
+	return !isFileMissing(name+".tex") || !isFileMissing(name+".md")
+}
+
+// runSubcommand run the subcommand and exit.
+func runSubcommand(command func(args []string) error, args []string) {
+	infoLevel = infoActions
+	if err := command(args); err != nil {
+		reportError(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// watchCommand is a command sent to the watch loop.
+type watchCommand int
+
+const (
+	cmdRebuild       watchCommand = iota // compile now, or just after the running compilation
+	cmdPrecompile                        // rebuild the .fmt and compile
+	cmdQuit                              // stop watching
+	cmdPause                             // stop reacting to the changes
+	cmdResume                            // react again to the changes (and rebuild if something changed)
+	cmdBatteryPause                      // like cmdPause, sent by the battery saver
+	cmdBatteryResume                     // like cmdResume, sent by the battery saver
+)
+
+// pauseState is the pause of the watching, asked by the user (keys, socket, signals) or by the battery saver.
+// The two reasons are kept apart, so the watching resumes only when both are gone.
+type pauseState struct {
+	byUser    bool
+	byBattery bool
+}
+
+// paused check if the watching is paused, for any reason.
+func (p pauseState) paused() bool {
+	return p.byUser || p.byBattery
+}
+
+// apply update the pause with the command, and return true if the watching is paused or resumed by it.
+func (p *pauseState) apply(command watchCommand) bool {
+	was := p.paused()
+	switch command {
+	case cmdPause:
+		p.byUser = true
+	case cmdResume:
+		p.byUser = false
+	case cmdBatteryPause:
+		p.byBattery = true
+	case cmdBatteryResume:
+		p.byBattery = false
+	}
+	if command == cmdResume && p.byBattery {
+		info("Still paused by the battery saver.")
+	}
+	if command == cmdBatteryResume && p.byUser {
+		info("Still paused until resume.")
+	}
+	return was != p.paused()
+}
+
+// the name of the trigger file (next to the source): touching it forces a rebuild
+const triggerFileName = ".lfc-trigger"
+
+// triggerFile return the path of the trigger file of the document.
+func triggerFile() string {
+	return filepath.Join(filepath.Dir(inBaseOriginal), triggerFileName)
+}
+
+// readTrigger return the command asked by the last line of the trigger file:
+// "precompile" rebuilds the .fmt, "compile" (or nothing) just compiles.
+func readTrigger() watchCommand {
+	data, err := ioutil.ReadFile(triggerFile())
+	if err != nil {
+		return cmdRebuild
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 {
+		return cmdRebuild
+	}
+	switch last := strings.ToLower(lines[len(lines)-1]); last {
+	case "precompile":
+		return cmdPrecompile
+	case "compile":
+		return cmdRebuild
+	default:
+		if infoLevel >= infoErrors {
+			warning("Unknown command %s in %s: compile.", last, triggerFile())
+		}
+		return cmdRebuild
+	}
+}
+
+// the time to wait after a change before to read the source
+// (the changes during this time are read by the coming compilation)
+const settleDelay = 10 * time.Millisecond
+
+// watchCommands is used to control the watch loop from other goroutines.
+var watchCommands = make(chan watchCommand)
+
+// watchDone is closed when the watch loop ends, so the commands are no longer sent.
+var watchDone = make(chan struct{})
+
+// sendCommand send the command to the watch loop, false if the loop has ended.
+func sendCommand(command watchCommand) bool {
+	select {
+	case watchCommands <- command:
+		return true
+	case <-watchDone:
+		return false
+	}
+}
+
+// isIntermediate check if the file is produced by the compilation
+// (so its changes must not trigger a new compilation).
+func isIntermediate(fileName string) bool {
+	if isGenerated(fileName) {
+		return true
+	}
+	fileName = filepath.Clean(fileName)
+	for _, ext := range []string{".preamble.tex", ".body.tex", ".flat.tex", ".full.tex"} {
+		if fileName == filepath.Clean(inBase+ext) {
+			return true
+		}
+	}
+	// the .tex produced by pandoc or copied to a normalized name
+	return mustUsePandoc && fileName == filepath.Clean(inBaseOriginal+".tex") ||
+		inBase != inBaseOriginal && fileName == filepath.Clean(inBase+".tex")
+}
+
+// matchesWatchAlso check if the file matches a --watch-also, --data or --preamble-data pattern.
+// The files created after the start of the watching are also found this way.
+func matchesWatchAlso(fileName string) bool {
+	if isIntermediate(fileName) {
+		return false
+	}
+	return matchesPattern(watchAlso, fileName) || isDataFile(fileName)
+}
+
+// addWatched add the file to the watched ones.
+// For a symlink we also watch the real file (the outputs stay next to the symlink).
+func addWatched(watched map[string]bool, fileName string) {
+	trace("watch", "Watch", fileName)
+	watched[filepath.Clean(fileName)] = true
+	if realName, err := filepath.EvalSymlinks(fileName); err == nil && filepath.Clean(realName) != filepath.Clean(fileName) {
+		trace("watch", "Watch", realName, "for", fileName)
+		watched[filepath.Clean(realName)] = true
+	}
+}
+
+// watchedEvent check if the event is about a watched file, and if it is a change that asks a rebuild.
+func watchedEvent(event fsnotify.Event, watched map[string]bool) (isWatched, isChange bool) {
+	if isInput, _ := watchedInput(event.Name); !watched[filepath.Clean(event.Name)] && !isInput && !matchesWatchAlso(event.Name) {
+		return false, false
+	}
+	// a file removed and recreated (atomic save) comes with a Create event,
+	// and touching the trigger file comes with a Chmod event
+	touched := event.Op&fsnotify.Chmod != 0 && filepath.Clean(event.Name) == filepath.Clean(triggerFile())
+	return true, event.Op&(fsnotify.Write|fsnotify.Create) != 0 || touched
+}
+
+// watchEvents forward the changes of the watched files to the changes channel,
+// and report the watcher errors. The events of the polled folders (if any) come from polled.
+func watchEvents(watcher *fsnotify.Watcher, polled <-chan fsnotify.Event, watched map[string]bool, changes chan<- string) {
+	for {
+		var event fsnotify.Event
+		select {
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			event = e
+		case event = <-polled:
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// the watcher errors are reported, but we keep watching
+			reportError(atStage("watch", err))
+			continue
+		}
+		isWatched, isChange := watchedEvent(event, watched)
+		if !isWatched {
+			trace("watch", "Ignore", event)
+			continue
+		}
+		trace("watch", "Event", event)
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			trace("watch", "File", event.Name, "removed or renamed.")
+		}
+		if isChange {
+			changes <- event.Name
+		}
+	}
+}
+
+// newWatcher create the watcher of the source files and of the additional files (--watch-also...),
+// and return it with the watched files, and the folders to poll as the system can't watch them.
+func newWatcher() (watcher *fsnotify.Watcher, watched map[string]bool, polled []string, err error) {
+	// creates a new file watcher
+	watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		if isWatchLimit(err) {
+			err = fmt.Errorf("%w, %s", err, watchLimitAdvice())
+		}
+		return nil, nil, nil, atStage("watch", fmt.Errorf("Problem creating the file watcher: %w", err))
+	}
+
+	// the files to watch (none in manual mode)
+	watched = make(map[string]bool)
+	if !mustManual {
+		for _, fileName := range watchedFiles() {
+			addWatched(watched, fileName)
+		}
+		for _, fileName := range startInputWatch() {
+			addWatched(watched, fileName)
+		}
+	}
+	// the trigger file can be created later
+	watched[filepath.Clean(triggerFile())] = true
+
+	// the additional files to watch
+	for _, p := range extraPatterns() {
+		matches, err := filepath.Glob(p.pattern)
 		if err != nil {
-			break
+			watcher.Close()
+			return nil, nil, nil, atStage("watch", fmt.Errorf("Bad --%s pattern %s: %w", p.option, p.pattern, err))
+		}
+		if len(matches) == 0 && infoLevel >= infoErrors {
+			warning("No file matches --%s=%s (yet).", p.option, p.pattern)
+		}
+		for _, fileName := range matches {
+			if !isIntermediate(fileName) {
+				addWatched(watched, fileName)
+			}
 		}
 	}
-	// watching ?
-	if !mustNoWatch {
-		color.Set(color.FgCyan)
+
+	// we watch the folders and not the files, so we still get the events
+	// when a file is removed and recreated (by editors or git)
+	folders := make(map[string]bool)
+	for _, p := range extraPatterns() {
+		// the folder of a pattern without match, if it exists
+		folder := filepath.Dir(p.pattern)
+		if !strings.ContainsAny(folder, "*?[") && !isFolderMissing(folder) && !folders[folder] {
+			folders[folder] = true
+			if polled, err = addWatchedFolder(watcher, folder, polled); err != nil {
+				watcher.Close()
+				return nil, nil, nil, err
+			}
+		}
+	}
+	for fileName := range watched {
+		folder := filepath.Dir(fileName)
+		if folders[folder] {
+			continue
+		}
+		folders[folder] = true
+		if polled, err = addWatchedFolder(watcher, folder, polled); err != nil {
+			watcher.Close()
+			return nil, nil, nil, err
+		}
+	}
+	keepInputWatcher(watcher, folders)
+	return watcher, watched, polled, nil
+}
+
+// addWatchedFolder add the folder to the watcher. If the system limit of the watched folders
+// is reached, the folder is added to the polled ones.
+func addWatchedFolder(watcher *fsnotify.Watcher, folder string, polled []string) ([]string, error) {
+	err := watcher.Add(folder)
+	if err == nil {
+		trace("watch", "Watch folder", folder)
+		return polled, nil
+	}
+	if isWatchLimit(err) {
+		trace("watch", "Poll folder", folder+":", err)
+		return append(polled, folder), nil
+	}
+	return polled, atStage("watch", fmt.Errorf("Problem watching %s: %w", folder, err))
+}
+
+// watch recompile the document at every change of the source files, until Ctrl/Cmd-C.
+// The rebuilds are run by the jobs scheduler, so this loop only waits for the changes
+// and for the commands sent by the other goroutines through watchCommands.
+func watch() error {
+	themeWatch.Set()
+	if mustManual {
+		info("Waiting for build requests...(enter, precompile or quit, to exit press Ctrl/Cmd-C).")
+	} else {
 		info("Watching for file changes...(to exit press Ctrl/Cmd-C).")
-		color.Unset()
-		// creates a new file watcher
-		watcher, err := fsnotify.NewWatcher()
-		check(err, "Problem creating the file watcher")
-		defer watcher.Close()
-
-		// stop watching ?
-		done := make(chan bool)
-
-		// watch and print
-		var ok bool
-		go func() {
-			for {
-				select {
-				case event, ok := <-watcher.Events:
-					if !ok {
-						return
-					}
-					if event.Op&fsnotify.Write == fsnotify.Write {
-						if !isCompiling {
-							isCompiling = true
-							info("File changed.")
-							// wait before to start compile
-							// hoping that this is enough for the file to be closed before.
-							time.AfterFunc(10*time.Millisecond, recompile)
-						} else {
-							if infoLevel >= infoDebug {
-								info("File changed : compilation already running.")
-							}
-						}
-					}
-				case err, ok = <-watcher.Errors:
-					if !ok {
-						return
-					}
-					check(err, "Problem with the file watcher")
+	}
+	color.Unset()
+	watcher, watched, polled, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	defer close(watchDone)
+
+	changes := make(chan string)
+	go watchEvents(watcher, startPolling(polled), watched, changes)
+
+	// the other sources of build requests
+	if mustManual {
+		go readStdinRequests()
+		notifyRequestSignals()
+	} else if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		// the keys (pause, resume...) typed in the terminal
+		go readStdinRequests()
+	}
+	if mustPauseSignals {
+		notifyPauseSignals()
+	}
+	startBatteryWatch()
+	if err := listenSocket(); err != nil {
+		return err
+	}
+	if err := listenMetrics(); err != nil {
+		return err
+	}
+
+	// the rebuilds are run by the scheduler, so the loop is always ready for new events
+	isRecompiling = true
+
+	// wait a bit after the first change before to rebuild,
+	// hoping that this is enough for the file to be closed,
+	// and that all the changes of the same save are seen by the rebuild
+	var settle <-chan time.Time
+	trigger := filepath.Clean(triggerFile())
+	triggered := false
+	// the last changed data file and included file, and is the .fmt outdated by one of them
+	dataChanged, inputChanged, preambleChanged := "", "", false
+	// while paused the changes are only remembered
+	var pause pauseState
+	missed := false
+	// the scheduled rebuilds (--every)
+	var every <-chan time.Time
+	if rebuildEvery > 0 {
+		ticker := time.NewTicker(rebuildEvery)
+		defer ticker.Stop()
+		every = ticker.C
+	}
+	var titleBeforePause [2]string
+	for {
+		select {
+		case fileName := <-changes:
+			forgetChangedFile(fileName)
+			if filepath.Clean(fileName) == trigger {
+				triggered = true
+			} else if isDataFile(fileName) {
+				dataChanged = filepath.Clean(fileName)
+				preambleChanged = preambleChanged || isPreambleData(fileName)
+			} else if isInput, inPreamble := watchedInput(fileName); isInput {
+				inputChanged = filepath.Clean(fileName)
+				// the .fmt contains the files included by the preamble
+				preambleChanged = preambleChanged || inPreamble
+			}
+			if pause.paused() {
+				missed = true
+			} else if settle == nil {
+				settle = time.After(watchSettleDelay())
+			}
+		case <-settle:
+			settle = nil
+			trace("watch", "Settled after", watchSettleDelay())
+			if pause.paused() {
+				missed = true
+				break
+			}
+			withFormat := preambleChanged || triggered && readTrigger() == cmdPrecompile
+			switch {
+			case triggered:
+				submitRebuild("Rebuild triggered by "+triggerFileName+".", withFormat)
+			case len(dataChanged) > 0:
+				submitRebuild("Data file "+dataChanged+" changed.", withFormat)
+			case len(inputChanged) > 0:
+				submitRebuild("Input file "+inputChanged+" changed.", withFormat)
+			default:
+				submitRebuild("File changed.", false)
+			}
+			triggered, dataChanged, inputChanged, preambleChanged = false, "", "", false
+		case <-every:
+			if pause.paused() {
+				missed = true
+			} else {
+				// the files changed without event are read again
+				forgetChangedFile("")
+				submitRebuild("Scheduled rebuild (every "+rebuildEvery.String()+").", false)
+			}
+		case command := <-watchCommands:
+			switch command {
+			case cmdRebuild:
+				forgetChangedFile("")
+				submitRebuild("Rebuild requested.", false)
+			case cmdPrecompile:
+				forgetChangedFile("")
+				submitRebuild("Rebuild with precompile requested.", true)
+			case cmdQuit:
+				return nil
+			case cmdPause, cmdBatteryPause:
+				if pause.apply(command) {
+					titleBeforePause = currentTitle()
+					info("Paused: the changes are not compiled until resume.")
+					setTitle(symbolBusy, "paused")
+				}
+			case cmdResume, cmdBatteryResume:
+				if !pause.apply(command) {
+					break
+				}
+				if missed {
+					missed = false
+					withFormat := preambleChanged || triggered && readTrigger() == cmdPrecompile
+					triggered, dataChanged, inputChanged, preambleChanged = false, "", "", false
+					submitRebuild("Resumed, the files changed while paused.", withFormat)
+				} else {
+					info("Resumed.")
+					setTitle(titleBeforePause[0], titleBeforePause[1])
 				}
 			}
-		}()
+		}
+	}
+}
 
-		// out of the box fsnotify can watch a single file, or a single directory
-		err = watcher.Add(inBaseOriginal + ".tex")
-		check(err, "Problem watching", inBaseOriginal+".tex")
+// start prepare the source, compile it, and then watch it (if needed).
+// In watch mode the compilation errors are reported, but do not stop the watching.
+func start() error {
+	// The flags
+	if err := SetParameters(); err != nil {
+		return atStage("parameters", err)
+	}
+	if runsEngines() {
+		return runEngines()
+	}
+	// the document is compiled by another tool
+	if mustWatchOutput {
+		return watchOutput()
+	}
+	// only the split is asked
+	if len(splitOnlyMode) > 0 {
+		return splitOnly()
+	}
+	checkFonts()
+	// prepare the source files and create .fmt (if needed)
+	setTitle(symbolBusy, "compiling")
+	err := prepare()
+	// only a region of the body?
+	if len(regionFlag) > 0 {
+		if err == nil {
+			err = compileRegion()
+		}
+		showResult(err)
+		return err
+	}
+	// start compiling
+	for i := 0; err == nil && i < numCompilesAtStart; i++ {
+		err = compile(i < numCompilesAtStart-1) // only the last compile is not in draft mode
+		compileEnd()
+	}
+	// biber or bibtex, makeindex or xindy, and the compilations that read the new .bbl and .ind
+	if err == nil {
+		err = bibliographyPasses()
+	}
+	if err == nil {
+		err = indexPass()
+	}
+	// is the fast output the same as the plain one? (the scheduler doesn't run yet)
+	if err == nil && isVerificationDue() {
+		err = atStage("verify", verifyAgainstFull())
+	}
+	// export to other formats, impose...
+	if err == nil {
+		err = runPostSteps()
+	}
+	showResult(err)
+	// watching ?
+	if mustNoWatch {
+		return err
+	}
+	reportError(err)
+	return watch()
+}
 
-		<-done
+// Ready to go!
+func main() {
+	// subcommand?
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok && !isDocumentName(os.Args[1]) {
+			runSubcommand(command, os.Args[2:])
+		}
 	}
+	// the scheduler of the rebuilds in watch mode
+	jobs = newScheduler(compileEnd)
+	// error handling
+	catchCtrlC()
+	// the files are cleared even in case of unexpected error
+	defer func() {
+		if r := recover(); r != nil {
+			reportError(fmt.Errorf("Unexpected error: %v", r))
+			mainEnd(errors.New("unexpected error"))
+		}
+	}()
+	err := start()
+	reportError(err)
+	mainEnd(err)
 }
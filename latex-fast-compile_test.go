@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		value    string
+		atCommas bool
+		want     []string
+		wantErr  bool
+	}{
+		{"", true, nil, false},
+		{"   ", true, nil, false},
+		{"-a -b", true, []string{"-a", "-b"}, false},
+		{"-a,-b", true, []string{"-a", "-b"}, false},
+		{"-a,-b", false, []string{"-a,-b"}, false},
+		{" -a ,, -b ", true, []string{"-a", "-b"}, false},
+		{"-a\t-b\n-c", false, []string{"-a", "-b", "-c"}, false},
+		{`"a b",c`, true, []string{"a b", "c"}, false},
+		{`'a,b' c`, true, []string{"a,b", "c"}, false},
+		{`--x="a b"`, true, []string{"--x=a b"}, false},
+		{`"it's"`, true, []string{"it's"}, false},
+		{`'say "hi"'`, true, []string{`say "hi"`}, false},
+		{`a"b c"d`, true, []string{"ab cd"}, false},
+		{`""`, true, []string{""}, false},
+		{`'' x`, true, []string{"", "x"}, false},
+		{`a ""`, true, []string{"a", ""}, false},
+		{`a\b`, true, []string{`a\b`}, false},
+		{`"unclosed`, true, nil, true},
+		{`a 'b`, true, nil, true},
+	}
+	for _, test := range tests {
+		got, err := splitWords(test.value, test.atCommas)
+		if (err != nil) != test.wantErr {
+			t.Errorf("splitWords(%q, %v) error = %v, want error %v", test.value, test.atCommas, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitWords(%q, %v) = %q, want %q", test.value, test.atCommas, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	got, err := splitArgs(`-a,"-b c" -d`)
+	want := []string{"-a", "-b c", "-d"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("splitArgs = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestUnwrapLog(t *testing.T) {
+	defer func(width int) { logLineWidth = width }(logLineWidth)
+	logLineWidth = 5
+	tests := []struct {
+		log, want string
+	}{
+		{"", ""},
+		{"abc\ndef", "abc\ndef"},
+		{"abcde\nfg\nh", "abcdefg\nh"},
+		{"abcde\r\nfg\r\n", "abcdefg\n"},
+		{"abcde\nfghij\nk", "abcdefghijk"},
+		{"abcdef\ng", "abcdef\ng"},
+		// 5 characters but 7 bytes (xetex counts the characters)
+		{"ééabc\nd", "ééabcd"},
+		// 5 bytes but 4 characters (pdftex counts the bytes)
+		{"éabc\nd", "éabcd"},
+	}
+	for _, test := range tests {
+		if got := string(unwrapLog([]byte(test.log))); got != test.want {
+			t.Errorf("unwrapLog(%q) = %q, want %q", test.log, got, test.want)
+		}
+	}
+}
+
+func TestDisambiguateName(t *testing.T) {
+	defer func(level infoLevelType) { infoLevel = level }(infoLevel)
+	infoLevel = infoNo
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("résumé.tex", "accented")
+	write("resume.tex", "plain")
+	write("thèse.tex", "alone")
+	write("copie.tex", "same")
+	write("copié.tex", "same")
+	write("note.txt", "")
+	write("nöte.tex", "other")
+
+	tests := []struct {
+		original string
+		hashed   bool
+	}{
+		{"résumé", true},
+		{"thèse", false},
+		{"copié", false},
+		{"nöte", false},
+	}
+	for _, test := range tests {
+		original := filepath.Join(dir, test.original)
+		normalized := normalizeName(original)
+		got := disambiguateName(normalized, original)
+		if hashed := got != normalized; hashed != test.hashed {
+			t.Errorf("disambiguateName(%q) = %q, want hashed %v", test.original, got, test.hashed)
+		}
+		if test.hashed && !strings.HasPrefix(got, normalized+"-") {
+			t.Errorf("disambiguateName(%q) = %q, want the prefix %q", test.original, got, normalized+"-")
+		}
+	}
+	// the name without accents is kept as is
+	plain := filepath.Join(dir, "resume")
+	if got := disambiguateName(plain, plain); got != plain {
+		t.Errorf("disambiguateName(%q) = %q, want it unchanged", plain, got)
+	}
+}
+
+func TestLatinJobName(t *testing.T) {
+	defer func(level infoLevelType) { infoLevel = level }(infoLevel)
+	infoLevel = infoNo
+	tests := []struct {
+		name   string
+		hashed bool
+	}{
+		{"main", false},
+		{"thèse", false},
+		{"file-1_2", false},
+		{"日本語", true},
+		{"Москва", true},
+		{"a日", true},
+	}
+	for _, test := range tests {
+		normalized := filepath.Join("dir", test.name)
+		got := latinJobName(normalized, normalized)
+		if hashed := got != normalized; hashed != test.hashed {
+			t.Errorf("latinJobName(%q) = %q, want hashed %v", test.name, got, test.hashed)
+		}
+		if test.hashed && !strings.HasPrefix(filepath.Base(got), "document-") {
+			t.Errorf("latinJobName(%q) = %q, want a document- name", test.name, got)
+		}
+	}
+}
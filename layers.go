@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// the default regex that defines the end of the base preamble (the `--base-split` flag)
+const defaultBaseSplit = `(?m)^\s*%\s*end\s*base\b`
+
+var (
+	baseSplitPattern string         // the --base-split value ("" for no base format)
+	reBaseSplit      *regexp.Regexp // the compiled --base-split value
+	baseHash         string         // the hash of the base preamble of the source ("" without base)
+	mustBuildBase    bool           // the --precompile-base value: also rebuild the base format
+)
+
+// checkBaseSplit compile the --base-split pattern.
+func checkBaseSplit() (err error) {
+	reBaseSplit = nil
+	if len(baseSplitPattern) == 0 {
+		return nil
+	}
+	if reBaseSplit, err = regexp.Compile(baseSplitPattern); err != nil {
+		return errors.New("Invalid --base-split pattern " + baseSplitPattern + ": " + err.Error() + ".")
+	}
+	return nil
+}
+
+// baseName return the job name of the base format (like cylinder.base).
+func baseName(base string) string {
+	return base + ".base"
+}
+
+// splitBase split the preamble at the end of its base (see --base-split), if any.
+// The base (the class and the heavy packages) is written to the .base.tex, dumped in its own .fmt,
+// and the rest of the preamble (the project macros) is dumped on top of it.
+// So a change of the project macros doesn't pay the precompilation of the base.
+// The returned preamble starts with empty lines in place of the base, to keep the line numbers of its errors
+// (the body doesn't rely on them, see splitTeX).
+func splitBase(preamble string) (string, error) {
+	baseHash = ""
+	if reBaseSplit == nil || mustCompileAll {
+		return preamble, nil
+	}
+	loc := reBaseSplit.FindStringIndex(preamble)
+	if loc == nil {
+		return preamble, nil
+	}
+	// the format of the base is loaded by its name (on the line of the source)
+	if strings.Contains(outBase, " ") {
+		if infoLevel >= infoErrors {
+			warning("The name %q has spaces, the preamble is dumped without base format.", outBase)
+		}
+		return preamble, nil
+	}
+	base := preamble[:loc[0]]
+	sum := sha256.Sum256([]byte(texCompiler + "\n" + base))
+	baseHash = fmt.Sprintf("%x", sum[:8])
+	record(strings.Count(base, "\n")+1, "split base", strings.SplitN(preamble[loc[0]:], "\n", 2)[0], "The base of the preamble ends here (see --base-split): it is dumped in "+baseName(inBase)+".fmt, and the rest of the preamble on top of it.")
+	baseTeX := baseName(inBase) + ".tex"
+	info(" create", baseTeX)
+	if err := ioutil.WriteFile(baseTeX, []byte(base+"\\dump"), 0644); err != nil {
+		return preamble, fmt.Errorf("Problem while writing %s: %w", baseTeX, err)
+	}
+	return strings.Repeat("\n", strings.Count(base, "\n")) + preamble[loc[0]:], nil
+}
+
+// isBaseOutdated check if the base format must be rebuilt: it is missing, broken,
+// or it was built from another base preamble.
+func isBaseOutdated() bool {
+	baseFmt := baseName(outBase) + ".fmt"
+	if mustBuildBase || isFileMissing(baseFmt) || len(formatProblem(baseFmt)) > 0 {
+		return true
+	}
+	return loadState().BaseFormat != baseHash
+}
+
+// layerOptions return the precompilation options of the base (the base of the preamble on the LaTeX format),
+// or of the preamble (the rest of the preamble on the base format).
+func layerOptions(base bool) []string {
+	options := make([]string, len(precompileOptions))
+	copy(options, precompileOptions)
+	for i, option := range options {
+		if option == "-jobname="+inBase && base {
+			options[i] = "-jobname=" + baseName(inBase)
+		}
+	}
+	if base {
+		options[len(options)-1] = "&" + latexFormat + " " + texFileName(baseName(inBase)+".tex")
+	} else {
+		options[len(options)-1] = "&" + texPath(baseName(outBase)) + " " + texFileName(inBase+".preamble.tex")
+	}
+	return options
+}
+
+// precompileLayers precompile the base format if it is outdated, then the preamble on top of it.
+func precompileLayers() error {
+	if isBaseOutdated() {
+		// the in-memory base can be gone
+		unlinkFormat(baseName(outBase))
+		if err := run("Precompile the base", texCompiler, layerOptions(true)...); err != nil {
+			return err
+		}
+		if len(outFolder) > 0 && isFileMissing(baseName(outBase)+".fmt") && !isFileMissing(baseName(inBase)+".fmt") {
+			info(" move", baseName(inBase)+".fmt", "to", baseName(outBase)+".fmt")
+			if err := moveFile(baseName(inBase)+".fmt", baseName(outBase)+".fmt"); err != nil {
+				return err
+			}
+		}
+		moveFormatToRAM(baseName(outBase))
+		state := loadState()
+		state.BaseFormat = baseHash
+		if err := saveState(state); err != nil && infoLevel >= infoErrors {
+			warning("Problem saving %s: %v", stateFileName(), err)
+		}
+		mustBuildBase = false
+	} else {
+		info("The base", baseName(outBase)+".fmt", "is up to date.")
+	}
+	return run("Precompile on the base", texCompiler, layerOptions(false)...)
+}
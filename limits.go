@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var (
+	maxMemory   string // the --max-memory value
+	memoryLimit uint64 // the memory limit of the engine in bytes (0 means no limit)
+	mustBeNice  bool   // run the engine with a low priority
+)
+
+// the niceness of the engine with --nice (as with the nice command)
+const niceValue = 10
+
+// the hidden first argument that makes this program the launcher of a limited engine (see prepareLimits)
+const limitsLauncher = "--lfc-limits-launcher"
+
+// engineArgs return the arguments of the engine command, without the launcher of the limits.
+func engineArgs(cmd *exec.Cmd) []string {
+	if len(cmd.Args) > 5 && cmd.Args[1] == limitsLauncher {
+		return cmd.Args[5:]
+	}
+	return cmd.Args
+}
+
+// parseMemory convert a size like 512M or 2G to bytes.
+// The suffixes K, M, G and T are powers of 1024, the optional B is ignored.
+func parseMemory(value string) (uint64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	unit := uint64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(size, suffix) {
+			size = strings.TrimSuffix(size, suffix)
+			unit = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(size), 10, 64)
+	if err != nil || n == 0 {
+		return 0, errors.New("Bad memory size " + value + " (ex. 512M or 2G).")
+	}
+	return n * unit, nil
+}
+
+// setLimits read the --max-memory value and check that the limits can be applied on this system.
+func setLimits() error {
+	if len(maxMemory) == 0 {
+		return nil
+	}
+	if !canLimitMemory {
+		return errors.New("The --max-memory option is not supported on this system.")
+	}
+	var err error
+	memoryLimit, err = parseMemory(maxMemory)
+	return err
+}
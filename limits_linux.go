@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// the memory of a process can be limited on this system
+const canLimitMemory = true
+
+// limitMemory limit the memory of this process (and of the command it executes).
+func limitMemory(limit uint64) error {
+	return unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit})
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package main
+
+// the memory of an other process can't be limited on this system
+const canLimitMemory = false
+
+// limitMemory has nothing to do: the memory limit is refused by setLimits.
+func limitMemory(limit uint64) error {
+	return nil
+}
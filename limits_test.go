@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"512K", 512 << 10, false},
+		{"512M", 512 << 20, false},
+		{"512m", 512 << 20, false},
+		{"2G", 2 << 30, false},
+		{"2GB", 2 << 30, false},
+		{"2gb", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{" 2 G ", 2 << 30, false},
+		{"100B", 100, false},
+		{"", 0, true},
+		{"0", 0, true},
+		{"0M", 0, true},
+		{"G", 0, true},
+		{"-1G", 0, true},
+		{"1.5G", 0, true},
+		{"2X", 0, true},
+		{"2GG", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseMemory(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d (error %v)", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
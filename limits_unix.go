@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// the launcher runs before everything else
+func init() {
+	if len(os.Args) > 5 && os.Args[1] == limitsLauncher {
+		launchLimited(os.Args[2], os.Args[3], os.Args[4], os.Args[5:])
+	}
+}
+
+// prepareLimits start the command through this program, that applies the limits to itself
+// and then executes the command (see launchLimited). So the limits apply from the first
+// instruction of the engine, and not after its start. The first argument is kept for the messages.
+func prepareLimits(cmd *exec.Cmd) {
+	if memoryLimit == 0 && !mustBeNice || cmd.Err != nil {
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		cmd.Err = fmt.Errorf("Problem finding this program to limit the engine: %w", err)
+		return
+	}
+	args := []string{cmd.Args[0], limitsLauncher, strconv.FormatUint(memoryLimit, 10), strconv.FormatBool(mustBeNice), cmd.Path}
+	cmd.Path, cmd.Args = self, append(args, cmd.Args...)
+}
+
+// launchLimited limit the memory and lower the priority of this process, then replace it by the command.
+// The command never runs without the asked limits.
+func launchLimited(memory, nice, path string, args []string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if limit, err := strconv.ParseUint(memory, 10, 64); err == nil && limit > 0 {
+		if err := limitMemory(limit); err != nil {
+			fail(fmt.Errorf("Problem limiting the memory: %w", err))
+		}
+	}
+	if nice == "true" {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, niceValue); err != nil {
+			fail(fmt.Errorf("Problem lowering the priority: %w", err))
+		}
+	}
+	fail(syscall.Exec(path, args, os.Environ()))
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// the memory of a process can't be limited without job objects
+const canLimitMemory = false
+
+// the priority class used with --nice (see CreateProcess)
+const belowNormalPriorityClass = 0x00004000
+
+// prepareLimits set the priority class of the command before its start.
+func prepareLimits(cmd *exec.Cmd) {
+	if mustBeNice {
+		cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: belowNormalPriorityClass}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// the --link-output value: the stable path of the last successful output ("" for none)
+var linkOutput string
+
+// checkLinkOutput check the --link-output path, made absolute to survive the switch to the isolated folder.
+func checkLinkOutput() error {
+	if len(linkOutput) == 0 {
+		return nil
+	}
+	var err error
+	if linkOutput, err = userPath(linkOutput); err != nil {
+		return err
+	}
+	if stat, err := os.Lstat(linkOutput); err == nil && stat.IsDir() {
+		return errors.New("Invalid --link-output value " + linkOutput + " (it is a folder).")
+	}
+	return nil
+}
+
+// outputTarget return the absolute path of the output, once copied back from the isolated folder.
+func outputTarget() (string, error) {
+	output := outputBase + "." + outputExtension()
+	if len(isolatedDir) > 0 {
+		return filepath.Join(sourceDir, output), nil
+	}
+	return filepath.Abs(output)
+}
+
+// updateOutputLink point the --link-output path to the last successful output.
+// The isolated builds are linked by endIsolation, after the copy back.
+func updateOutputLink() error {
+	if len(linkOutput) == 0 || len(isolatedDir) > 0 {
+		return nil
+	}
+	target, err := outputTarget()
+	if err != nil {
+		return atStage("link", err)
+	}
+	return atStage("link", linkFile(target, linkOutput))
+}
+
+// linkFile replace the link by a symlink to the target, or by a copy of the target
+// where the symlinks are not allowed (like Windows without the developer mode).
+// The new link is renamed over the old one, so the viewers never see a missing file.
+func linkFile(target, link string) error {
+	if target == link {
+		return nil
+	}
+	// the side by side builds (--engines) link concurrently
+	temp := link + "." + strconv.Itoa(os.Getpid()) + ".part"
+	os.Remove(temp)
+	// a relative symlink survives the move of the project folder
+	relTarget, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		relTarget = target
+	}
+	if err := os.Symlink(relTarget, temp); err == nil {
+		info(" link", link, "to", target)
+	} else {
+		if infoLevel >= infoDebug {
+			info(" no symlink for", link+":", err.Error())
+		}
+		if err := copyFile(target, temp); err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+	if err := os.Rename(temp, link); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
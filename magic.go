@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// reMagicComment match the `% !TEX key = value` magic comments of the editors
+// (TeXShop, TeXstudio, TeXworks, VS Code...), TS-program being the TeXShop variant of program.
+var reMagicComment = regexp.MustCompile(`(?i)^%\s*!\s*TEX\s+([\w-]+)\s*=\s*(.*?)\s*$`)
+
+// the engines of the `% !TEX program` values
+var magicPrograms = map[string]string{
+	"pdflatex": "pdftex",
+	"pdftex":   "pdftex",
+	"xelatex":  "xetex",
+	"xetex":    "xetex",
+	"lualatex": "luatex",
+	"luatex":   "luatex",
+	"platex":   "eptex",
+	"uplatex":  "euptex",
+	"tectonic": "tectonic",
+}
+
+// readMagicComments return the magic comments of the first lines of the file (the comments and
+// the empty lines before the content), by lower case key.
+func readMagicComments(fileName string) map[string]string {
+	comments := map[string]string{}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return comments
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "%") {
+			break
+		}
+		if match := reMagicComment.FindStringSubmatch(line); match != nil {
+			key := strings.ToLower(match[1])
+			if key == "ts-program" {
+				key = "program"
+			}
+			comments[key] = match[2]
+		}
+	}
+	return comments
+}
+
+// applyMagicComments use the `% !TEX program` and `% !TEX options` comments of the source,
+// so the configuration of the editors is not duplicated.
+// The program selects the engine if none is given, and the options are split (like --options) and added before the --option ones.
+func applyMagicComments() {
+	comments := readMagicComments(inBaseOriginal + ".tex")
+	if options, ok := comments["options"]; ok && len(options) > 0 {
+		info("Use the options " + options + " of % !TEX options.")
+		splitOptionValues = append([]string{options}, splitOptionValues...)
+	}
+	program, ok := comments["program"]
+	// the side by side builds are given their engines
+	if !ok || len(engineList) > 0 || len(engineRun) > 0 {
+		return
+	}
+	engine, known := magicPrograms[strings.ToLower(program)]
+	switch {
+	case !known:
+		if infoLevel >= infoErrors {
+			warning("Unknown program %s in %% !TEX program, it is ignored.", program)
+		}
+	case len(engineFlag) > 0 || mustUseXe:
+		info("The engine is given, % !TEX program = " + program + " is ignored.")
+	default:
+		info("Use " + program + " of % !TEX program.")
+		engineFlag = engine
+	}
+}
+
+var (
+	subfileName         string // the file given on the command line, when it is a subfile compiled through its `% !TEX root`
+	mustNoMagicComments bool   // the --no-magic-comments value: the `% !TEX` comments are ignored (the documents of serve)
+)
+
+// hasParentElement check if the path has a '..' element.
+func hasParentElement(path string) bool {
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// followTeXRoot compile the root document given by the `% !TEX root` comment of the source,
+// in the folder of the root (where its \input paths are relative to), like the editors do.
+// The given subfile is still watched.
+// The root must be in the folder of the subfile or below it: an absolute path or a path with .. is rejected.
+func followTeXRoot() error {
+	if mustWatchOutput || strings.HasSuffix(flag.Arg(0), ".md") {
+		return nil
+	}
+	root := readMagicComments(inBaseOriginal + ".tex")["root"]
+	if len(root) == 0 {
+		return nil
+	}
+	rootName := nativePath(root)
+	if filepath.IsAbs(rootName) || filepath.VolumeName(rootName) != "" || hasParentElement(rootName) {
+		return errors.New("The root " + root + " of " + inBaseOriginal + ".tex (% !TEX root) must be a relative path without '..'.")
+	}
+	rootName = filepath.Join(filepath.Dir(inBaseOriginal), rootName)
+	rootName = strings.TrimSuffix(rootName, ".tex") + ".tex"
+	if isFileMissing(rootName) {
+		return errors.New("The root " + rootName + " of " + inBaseOriginal + ".tex (% !TEX root) is missing.")
+	}
+	absRoot, err := filepath.Abs(rootName)
+	if err != nil {
+		return err
+	}
+	absSubfile, err := filepath.Abs(inBaseOriginal + ".tex")
+	if err != nil || absSubfile == absRoot {
+		return err
+	}
+	info("Compile the root " + rootName + " of " + inBaseOriginal + ".tex (% !TEX root).")
+	if startDir, err = os.Getwd(); err != nil {
+		return fmt.Errorf("Problem getting the current folder: %w", err)
+	}
+	if err := os.Chdir(filepath.Dir(absRoot)); err != nil {
+		return fmt.Errorf("Problem switching to %s: %w", filepath.Dir(absRoot), err)
+	}
+	subfileName = absSubfile
+	if rel, err := filepath.Rel(filepath.Dir(absRoot), absSubfile); err == nil {
+		subfileName = rel
+	}
+	inBaseOriginal = strings.TrimSuffix(filepath.Base(absRoot), ".tex")
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	mustManual       bool   // compile only on request (no file watching)
+	socketAddress    string // the --socket value: unix://path or tcp://host:port
+	socketServer     net.Listener
+	readsStdin       bool // the standard input is read by readStdinRequests
+	mustPauseSignals bool // pause on SIGTSTP (Ctrl-Z) and resume on SIGCONT, in place of the job control
+)
+
+// parseCommand convert a request line to a watch command.
+// An empty line or "compile" asks a compilation, "precompile" also rebuilds the .fmt,
+// and "pause" (or "p") and "resume" (or "r") stop and restart the reaction to the changes.
+func parseCommand(line string) (watchCommand, error) {
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "", "compile":
+		return cmdRebuild, nil
+	case "precompile":
+		return cmdPrecompile, nil
+	case "quit", "exit":
+		return cmdQuit, nil
+	case "pause", "p":
+		return cmdPause, nil
+	case "resume", "r":
+		return cmdResume, nil
+	default:
+		return cmdRebuild, errors.New("Unknown request " + strings.TrimSpace(line) + " [compile|precompile|pause|resume|quit].")
+	}
+}
+
+// readStdinRequests send the requests read on the standard input to the watch loop.
+// At the end of the input the requests are still accepted from the other sources.
+func readStdinRequests() {
+	readsStdin = true
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if answerPending(scanner.Text()) {
+			continue
+		}
+		command, err := parseCommand(scanner.Text())
+		if err != nil {
+			reportError(atStage("request", err))
+			continue
+		}
+		if !sendCommand(command) {
+			return
+		}
+	}
+}
+
+// listenSocket accept the requests (one per line) on the --socket address.
+// The address is unix://path (a unix socket) or tcp://host:port, the transport is never guessed
+// from the address (a Windows path or a socket name can contain a ':').
+// Every request is answered by "ok" or by the error.
+func listenSocket() (err error) {
+	if len(socketAddress) == 0 {
+		return nil
+	}
+	network, address, found := strings.Cut(socketAddress, "://")
+	if !found || len(address) == 0 || network != "unix" && network != "tcp" {
+		return atStage("request", errors.New("Invalid --socket address "+socketAddress+" (use unix://path or tcp://host:port)."))
+	}
+	if socketServer, err = net.Listen(network, address); err != nil {
+		return atStage("request", fmt.Errorf("Problem listening on %s: %w", socketAddress, err))
+	}
+	info("Listen for build requests on", socketAddress)
+	go func() {
+		for {
+			conn, err := socketServer.Accept()
+			if err != nil {
+				return
+			}
+			go serveRequests(conn)
+		}
+	}()
+	return nil
+}
+
+// serveRequests read the requests of a socket connection.
+func serveRequests(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command, err := parseCommand(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(conn, err)
+			continue
+		}
+		if !sendCommand(command) {
+			fmt.Fprintln(conn, "The watching has ended.")
+			return
+		}
+		fmt.Fprintln(conn, "ok")
+	}
+}
+
+// closeSocket stop listening (and remove the unix socket file).
+func closeSocket() {
+	if socketServer != nil {
+		socketServer.Close()
+		socketServer = nil
+	}
+}
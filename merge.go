@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mergeRow is a row of the merge data, with the names of its files.
+type mergeRow struct {
+	number int      // from 1, the header excluded
+	done   bool     // the .pdf is created
+	vars   []string // the --var values (key=value)
+	base   string   // the row source in the merge folder (without extension)
+	output string   // the final .pdf
+}
+
+// readMergeData read the CSV file: the first row gives the variable names.
+// With an empty delimiter, ';' is used if the header has ';' and no ','.
+func readMergeData(fileName, delimiter string) (keys []string, rows [][]string, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	if len(delimiter) == 0 {
+		header, _, _ := strings.Cut(text, "\n")
+		delimiter = ","
+		if strings.Contains(header, ";") && !strings.Contains(header, ",") {
+			delimiter = ";"
+		}
+	}
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = []rune(delimiter)[0]
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil, errors.New("The file " + fileName + " has no data row.")
+	}
+	for _, key := range records[0] {
+		key = strings.TrimSpace(key)
+		if !reVarKey.MatchString(key) {
+			return nil, nil, errors.New("Invalid column name " + key + " in " + fileName + " (use letters, digits, - and _).")
+		}
+		keys = append(keys, key)
+	}
+	return keys, records[1:], nil
+}
+
+// mergeOutputName return the name of the row .pdf from the pattern:
+// the @@key@@ placeholders are replaced by the row values, and @@row@@ by the row number.
+func mergeOutputName(pattern string, keys, values []string, number, count int) string {
+	name := rePlaceholder.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		key := placeholder[2 : len(placeholder)-2]
+		for i, k := range keys {
+			if k == key {
+				return values[i]
+			}
+		}
+		if key == "row" {
+			return fmt.Sprintf("%0*d", len(strconv.Itoa(count)), number)
+		}
+		return placeholder
+	})
+	return strings.TrimSuffix(nativePath(name), ".pdf") + ".pdf"
+}
+
+// texEscaper escape the TeX special characters of the merge values (see escapeTeX).
+var texEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`$`, `\$`,
+	`&`, `\&`,
+	`#`, `\#`,
+	`%`, `\%`,
+	`_`, `\_`,
+	`^`, `\textasciicircum{}`,
+	`~`, `\textasciitilde{}`,
+)
+
+// escapeTeX return the value as text for TeX: its special characters are printed as they are.
+func escapeTeX(value string) string {
+	return texEscaper.Replace(value)
+}
+
+// mergeFormatSet return the files of the precompiled preamble of the row source:
+// the .fmt, the base format (see --base-split) and the state file that validates them.
+func mergeFormatSet(base string) []string {
+	return []string{base + ".fmt", baseName(base) + ".fmt", base + "." + stateExtension}
+}
+
+// preambleVars return the names of the variables used in the preamble of the template.
+func preambleVars(texdata []byte, keys []string) (used []string) {
+	if loc := regexp.MustCompile(defaultSplitPattern).FindIndex(texdata); loc != nil {
+		texdata = texdata[:loc[0]]
+	}
+	for _, key := range keys {
+		if strings.Contains(string(texdata), "@@"+key+"@@") {
+			used = append(used, key)
+		}
+	}
+	return used
+}
+
+// mergeDocuments is the `merge` subcommand: it compiles one .pdf by row of the CSV file,
+// with the row values as template variables (like --var).
+// The preamble is precompiled once, and its .fmt is copied for the other rows, compiled in parallel.
+// The values are escaped for TeX, except with --raw where they are TeX code.
+func mergeDocuments(args []string) error {
+	jobs := runtime.NumCPU()
+	pattern, delimiter := "", ""
+	raw := false
+	options := []string{}
+	files := []string{}
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch {
+		case name == "--jobs":
+			var err error
+			if jobs, err = strconv.Atoi(value); err != nil || jobs < 1 {
+				return errors.New("Bad value in " + arg + ".")
+			}
+		case name == "--output":
+			pattern = value
+		case name == "--delimiter":
+			if len([]rune(value)) != 1 {
+				return errors.New("Bad value in " + arg + " (use a single character).")
+			}
+			delimiter = value
+		case arg == "--raw":
+			raw = true
+		case strings.HasPrefix(arg, "-"):
+			options = append(options, arg)
+		default:
+			files = append(files, nativePath(arg))
+		}
+	}
+	if len(files) != 2 {
+		return errors.New("You should provide the template .tex file and the .csv data file.")
+	}
+	template := strings.TrimSuffix(files[0], ".tex") + ".tex"
+	texdata, err := ioutil.ReadFile(template)
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", template, err)
+	}
+	keys, records, err := readMergeData(files[1], delimiter)
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", files[1], err)
+	}
+	if len(pattern) == 0 {
+		pattern = strings.TrimSuffix(template, ".tex") + "-@@row@@"
+	}
+	// the post-steps (--concat, --impose, --encrypt-pdf...) can be set by the configuration files and the presets
+	if err := parseOptions(options); err != nil {
+		return err
+	}
+	if err := checkPostSteps(); err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Problem finding this program: %w", err)
+	}
+
+	// the row sources and their intermediate files are in a hidden folder next to the template,
+	// and the engine runs in the template folder to find the inputs (images...)
+	templateFolder := filepath.Dir(template)
+	mergeFolder, err := os.MkdirTemp(templateFolder, ".lfc-merge-")
+	if err != nil {
+		return fmt.Errorf("Problem creating the merge folder: %w", err)
+	}
+	defer os.RemoveAll(mergeFolder)
+	relFolder, err := filepath.Rel(templateFolder, mergeFolder)
+	if err != nil {
+		return err
+	}
+	rows := make([]mergeRow, len(records))
+	outputs := make(map[string]int)
+	for i, values := range records {
+		row := mergeRow{number: i + 1, base: filepath.Join(relFolder, fmt.Sprintf("row-%d", i+1))}
+		for j, key := range keys {
+			if j < len(values) {
+				value := values[j]
+				if !raw {
+					value = escapeTeX(value)
+				}
+				row.vars = append(row.vars, key+"="+value)
+			}
+		}
+		row.output = mergeOutputName(pattern, keys, values, row.number, len(records))
+		if other, ok := outputs[row.output]; ok {
+			return fmt.Errorf("The rows %d and %d have the same output %s (see --output).", other, row.number, row.output)
+		}
+		outputs[row.output] = row.number
+		if err := ioutil.WriteFile(filepath.Join(templateFolder, row.base+".tex"), texdata, 0644); err != nil {
+			return fmt.Errorf("Problem while writing the row %d source: %w", row.number, err)
+		}
+		rows[i] = row
+	}
+
+	// the .fmt of the first row is shared, except if the preamble depends on the row
+	shared := true
+	if used := preambleVars(texdata, keys); len(used) > 0 {
+		warning("The preamble uses %s, every row has its own .fmt.", strings.Join(used, ", "))
+		shared = false
+	}
+	info(fmt.Sprintf("Merge %d documents from %s with %s.", len(rows), template, files[1]))
+	compileRow := func(row mergeRow) error {
+		args := append([]string{}, options...)
+		for _, v := range row.vars {
+			args = append(args, "--var="+v)
+		}
+		// the post-steps are done on all the rows
+		args = append(args, "--no-watch", "--no-synctex", "--clear=no", "--temp-folder=", "--concat=", "--impose=", "--encrypt-pdf=", "--sign-pdf=", "--link-output=", "--badge=", row.base+".tex")
+		cmd := exec.Command(self, args...)
+		cmd.Dir = templateFolder
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Problem with the row %d: %w\n%s", row.number, err, strings.TrimSpace(string(output)))
+		}
+		pdfName := filepath.Join(templateFolder, row.base+".pdf")
+		if err := os.MkdirAll(filepath.Dir(row.output), 0755); err != nil {
+			return fmt.Errorf("Problem with the row %d: %w", row.number, err)
+		}
+		// the merge folder can be on another drive than the output
+		if err := moveFile(pdfName, row.output); err != nil {
+			return fmt.Errorf("Problem with the row %d: %w", row.number, err)
+		}
+		info(" create", row.output)
+		return nil
+	}
+
+	// the first row builds the .fmt
+	failed := []int{}
+	if err := compileRow(rows[0]); err != nil {
+		reportError(atStage("merge", err))
+		failed = append(failed, 1)
+	} else {
+		rows[0].done = true
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	running := make(chan struct{}, jobs)
+	for i := 1; i < len(rows); i++ {
+		row := &rows[i]
+		if shared {
+			// without the shared .fmt (the first row failed) the row builds its own
+			sharedSet, rowSet := mergeFormatSet(rows[0].base), mergeFormatSet(row.base)
+			for j := range sharedSet {
+				copyInput(filepath.Join(templateFolder, sharedSet[j]), filepath.Join(templateFolder, rowSet[j]))
+			}
+		}
+		wg.Add(1)
+		running <- struct{}{}
+		go func(row *mergeRow) {
+			defer func() { <-running; wg.Done() }()
+			if err := compileRow(*row); err != nil {
+				mu.Lock()
+				reportError(atStage("merge", err))
+				failed = append(failed, row.number)
+				mu.Unlock()
+			} else {
+				row.done = true
+			}
+		}(row)
+	}
+	wg.Wait()
+
+	// the post-steps on the successful rows
+	done := []string{}
+	for _, row := range rows {
+		if row.done {
+			done = append(done, row.output)
+		}
+	}
+	toFinish := done
+	if len(concatOutput) > 0 && len(done) > 0 {
+		if err := concatPDF(done, concatOutput); err != nil {
+			return err
+		}
+		toFinish = []string{concatOutput}
+	}
+	for _, pdfName := range toFinish {
+		if len(imposeMode) > 0 {
+			if err := imposePDF(pdfName); err != nil {
+				return err
+			}
+		}
+		if hasFinalPDF() {
+			if err := finalizePDF(pdfName); err != nil {
+				return err
+			}
+		}
+	}
+	// the stable link points to the concatenated file, else to the last row
+	if len(linkOutput) > 0 && len(toFinish) > 0 {
+		target, err := filepath.Abs(toFinish[len(toFinish)-1])
+		if err != nil {
+			return err
+		}
+		if err := linkFile(target, linkOutput); err != nil {
+			return atStage("link", err)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Ints(failed)
+		return fmt.Errorf("%d of the %d rows failed: %s.", len(failed), len(rows), strings.Trim(fmt.Sprint(failed), "[]"))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+var (
+	pdfTitle     string // the --pdf-title value
+	pdfAuthor    string // the --pdf-author value
+	pdfSubject   string // the --pdf-subject value
+	pdfKeywords  string // the --pdf-keywords value
+	mustWriteXMP bool   // also write the metadata as XMP with exiftool
+)
+
+// hasMetadata check if some PDF metadata is set (usually in the configuration file).
+func hasMetadata() bool {
+	return len(pdfTitle) > 0 || len(pdfAuthor) > 0 || len(pdfSubject) > 0 || len(pdfKeywords) > 0
+}
+
+// checkMetadata check that exiftool is available for --pdf-xmp.
+func checkMetadata() error {
+	if !mustWriteXMP {
+		return nil
+	}
+	if !hasMetadata() {
+		return errors.New("The --pdf-xmp option needs some metadata (--pdf-title, --pdf-author...).")
+	}
+	if _, err := exec.LookPath("exiftool"); err != nil {
+		return errors.New("Can't find exiftool in the current path (needed by --pdf-xmp).")
+	}
+	return nil
+}
+
+// metadataCode return the (one line) code that sets the PDF metadata at the beginning of the document:
+// with hyperref if it is loaded (so its own settings are replaced), else with \pdfinfo (pdftex)
+// or with a docinfo special (xetex).
+func metadataCode() string {
+	fields := []struct{ value, hyperref, info string }{
+		{pdfTitle, "pdftitle", "Title"},
+		{pdfAuthor, "pdfauthor", "Author"},
+		{pdfSubject, "pdfsubject", "Subject"},
+		{pdfKeywords, "pdfkeywords", "Keywords"},
+	}
+	var hyperref, pdfinfo, docinfo []string
+	for _, f := range fields {
+		if len(f.value) == 0 {
+			continue
+		}
+		hyperref = append(hyperref, f.hyperref+"={"+f.value+"}")
+		pdfinfo = append(pdfinfo, "/"+f.info+" (\\pdfescapestring{"+f.value+"})")
+		// the parentheses of a PDF string are escaped (pdftex does it with \pdfescapestring)
+		escaped := strings.NewReplacer("(", `\string\(`, ")", `\string\)`).Replace(f.value)
+		docinfo = append(docinfo, "/"+f.info+"("+escaped+")")
+	}
+	return `\AtBeginDocument{\ifdefined\hypersetup\hypersetup{` + strings.Join(hyperref, ",") + `}` +
+		`\else\ifdefined\pdfinfo\pdfinfo{` + strings.Join(pdfinfo, " ") + `}` +
+		`\else\special{pdf:docinfo<<` + strings.Join(docinfo, "") + `>>}\fi\fi}`
+}
+
+// addMetadata add the metadata code at the start of the source (on the first line, to keep the line numbers).
+func addMetadata(texdata []byte) []byte {
+	if !hasMetadata() {
+		return texdata
+	}
+	return append([]byte(metadataCode()), texdata...)
+}
+
+// writeXMP write the metadata in the .pdf with exiftool, in the document information and as XMP.
+func writeXMP() error {
+	if !mustWriteXMP {
+		return nil
+	}
+	args := []string{"-overwrite_original", "-quiet"}
+	set := func(value string, tags ...string) {
+		if len(value) > 0 {
+			for _, tag := range tags {
+				args = append(args, "-"+tag+"="+value)
+			}
+		}
+	}
+	set(pdfTitle, "PDF:Title", "XMP-dc:Title")
+	set(pdfAuthor, "PDF:Author", "XMP-dc:Creator")
+	set(pdfSubject, "PDF:Subject", "XMP-dc:Description")
+	set(pdfKeywords, "PDF:Keywords", "XMP-pdf:Keywords")
+	pdfName := outputBase + ".pdf"
+	if err := runTool("Write the XMP metadata of "+pdfName, "exiftool", append(args, pdfName)...); err != nil {
+		return atStage("metadata", err)
+	}
+	return nil
+}
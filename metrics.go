@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the --metrics value: the host:port of the Prometheus endpoint
+var metricsAddress string
+
+var metricsServer *http.Server
+
+// the upper bounds (in seconds) of the duration histogram buckets
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram is a Prometheus histogram with cumulative buckets.
+type histogram struct {
+	counts []uint64 // by bucket of durationBuckets, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+}
+
+// observe add the value to the histogram.
+func (h *histogram) observe(value float64) {
+	i := 0
+	for i < len(durationBuckets) && value > durationBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// write the histogram in the Prometheus text format.
+func (h *histogram) write(b *strings.Builder, name string) {
+	cumulative := uint64(0)
+	for i, bound := range durationBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	cumulative += h.counts[len(durationBuckets)]
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(b, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+// buildStats are the statistics of the builds since the start.
+type buildStats struct {
+	mu                 sync.Mutex
+	compiles           uint64
+	compileFailures    uint64
+	precompiles        uint64
+	precompileFailures uint64
+	retries            uint64 // the engine runs retried after a crash
+	compileDuration    *histogram
+	precompileDuration *histogram
+	pages              int // of the last successful compilation, -1 if unknown
+	lastSuccess        time.Time
+}
+
+var stats = buildStats{compileDuration: newHistogram(), precompileDuration: newHistogram(), pages: -1}
+
+// recordCompile add a compilation to the statistics.
+func recordCompile(duration time.Duration, err error, pages int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.compiles++
+	stats.compileDuration.observe(duration.Seconds())
+	if err != nil {
+		stats.compileFailures++
+		return
+	}
+	stats.lastSuccess = time.Now()
+	if pages >= 0 {
+		stats.pages = pages
+	}
+}
+
+// recordPrecompile add a precompilation to the statistics.
+func recordPrecompile(duration time.Duration, err error) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.precompiles++
+	stats.precompileDuration.observe(duration.Seconds())
+	if err != nil {
+		stats.precompileFailures++
+	}
+}
+
+// writeMetrics write the statistics in the Prometheus text format.
+func writeMetrics(b *strings.Builder) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	b.WriteString("# HELP lfc_compiles_total The compilations of the body.\n# TYPE lfc_compiles_total counter\n")
+	fmt.Fprintf(b, "lfc_compiles_total %d\n", stats.compiles)
+	b.WriteString("# HELP lfc_compile_failures_total The failed compilations of the body.\n# TYPE lfc_compile_failures_total counter\n")
+	fmt.Fprintf(b, "lfc_compile_failures_total %d\n", stats.compileFailures)
+	b.WriteString("# HELP lfc_precompiles_total The precompilations of the preamble.\n# TYPE lfc_precompiles_total counter\n")
+	fmt.Fprintf(b, "lfc_precompiles_total %d\n", stats.precompiles)
+	b.WriteString("# HELP lfc_precompile_failures_total The failed precompilations of the preamble.\n# TYPE lfc_precompile_failures_total counter\n")
+	fmt.Fprintf(b, "lfc_precompile_failures_total %d\n", stats.precompileFailures)
+	b.WriteString("# HELP lfc_engine_retries_total The engine runs retried after a crash.\n# TYPE lfc_engine_retries_total counter\n")
+	fmt.Fprintf(b, "lfc_engine_retries_total %d\n", stats.retries)
+	b.WriteString("# HELP lfc_compile_duration_seconds The duration of the compilations.\n# TYPE lfc_compile_duration_seconds histogram\n")
+	stats.compileDuration.write(b, "lfc_compile_duration_seconds")
+	b.WriteString("# HELP lfc_precompile_duration_seconds The duration of the precompilations.\n# TYPE lfc_precompile_duration_seconds histogram\n")
+	stats.precompileDuration.write(b, "lfc_precompile_duration_seconds")
+	if stats.pages >= 0 {
+		b.WriteString("# HELP lfc_pages The number of pages of the last output.\n# TYPE lfc_pages gauge\n")
+		fmt.Fprintf(b, "lfc_pages %d\n", stats.pages)
+	}
+	if !stats.lastSuccess.IsZero() {
+		b.WriteString("# HELP lfc_last_success_timestamp_seconds The end of the last successful compilation.\n# TYPE lfc_last_success_timestamp_seconds gauge\n")
+		fmt.Fprintf(b, "lfc_last_success_timestamp_seconds %d\n", stats.lastSuccess.Unix())
+	}
+}
+
+// serveMetrics answer the /metrics requests.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// listenMetrics start the HTTP server of the /metrics endpoint on the --metrics address.
+func listenMetrics() error {
+	if len(metricsAddress) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", metricsAddress)
+	if err != nil {
+		return atStage("metrics", fmt.Errorf("Problem listening on %s: %w", metricsAddress, err))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	metricsServer = &http.Server{Handler: mux}
+	info("Serve the metrics on http://" + listener.Addr().String() + "/metrics")
+	go metricsServer.Serve(listener)
+	return nil
+}
+
+// closeMetrics stop the metrics server.
+func closeMetrics() {
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+}
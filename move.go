@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// isCrossDevice check if the rename error is due to another device (EXDEV, or ERROR_NOT_SAME_DEVICE on Windows).
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || runtime.GOOS == "windows" && errors.Is(err, syscall.Errno(17))
+}
+
+// moveFile move the file, even to another device (like a temp folder on a tmpfs).
+// Across devices the file is copied (and synced) next to the destination, and then renamed,
+// so the destination is replaced in one step and is never seen half written.
+func moveFile(src, dst string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Error while moving %s to %s: %w", src, dst, err)
+		}
+	}()
+	err = os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	partial := dst + ".part"
+	if err = copySynced(src, partial); err == nil {
+		err = copyAttributes(src, partial)
+	}
+	if err == nil {
+		err = os.Rename(partial, dst)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copySynced copy the file and wait for the copy to be on the disk.
+func copySynced(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
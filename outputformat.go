@@ -0,0 +1,47 @@
+package main
+
+import "errors"
+
+// the --output-format value: pdf, or dvi to stop before the .pdf (the .xdv of xetex),
+// for a custom post-processor
+var outputFormat string
+
+// checkOutputFormat check the --output-format value, and the steps that need a .pdf.
+func checkOutputFormat() error {
+	switch outputFormat {
+	case "pdf":
+		return nil
+	case "dvi":
+	default:
+		return errors.New("Invalid --output-format value " + outputFormat + " (use pdf or dvi).")
+	}
+	if len(imposeMode) > 0 || mustCheckTagging || mustWriteXMP || hasFinalPDF() {
+		return errors.New("The --impose, --check-tagging, --pdf-xmp, --encrypt-pdf and --sign-pdf options need a .pdf, they can't be used with --output-format=dvi.")
+	}
+	return nil
+}
+
+// outputExtension return the extension of the output: pdf, dvi, or xdv (the extended dvi of xetex and tectonic).
+func outputExtension() string {
+	if outputFormat != "dvi" {
+		return "pdf"
+	}
+	if texCompiler == "xetex" || usesTectonic() {
+		return "xdv"
+	}
+	return "dvi"
+}
+
+// outputFormatOptions return the engine options that write a .dvi (or .xdv) in place of the .pdf.
+// The DVI engines (platex...) write it anyway, without dvipdfmx.
+func outputFormatOptions() []string {
+	switch {
+	case outputFormat != "dvi" || writesDVI():
+		return nil
+	case texCompiler == "xetex":
+		return []string{"-no-pdf"}
+	case usesTectonic():
+		return []string{"--outfmt", "xdv"}
+	}
+	return []string{"-output-format=dvi"}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// nativePath accept a path with / or \ separators (like in a configuration file shared
+// between Windows and the other systems), and return it with the separators of the current system.
+func nativePath(path string) string {
+	return filepath.FromSlash(strings.ReplaceAll(path, `\`, "/"))
+}
+
+// texPath return the path with / separators, understood by the engines on all systems.
+// On Windows a \ in the first line would be read by TeX as the start of a command.
+func texPath(path string) string {
+	return filepath.ToSlash(path)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// the interval of the polling of the folders that can't be watched
+const pollInterval = time.Second
+
+// isWatchLimit check if the error is the limit of the watched folders of the system
+// (ENOSPC for the inotify watches, EMFILE for the kqueue file descriptors).
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// watchLimitAdvice return how to raise the limit of the watched folders.
+func watchLimitAdvice() string {
+	if runtime.GOOS == "linux" {
+		return "raise fs.inotify.max_user_watches (like `sudo sysctl fs.inotify.max_user_watches=524288`)"
+	}
+	return "raise the limit of the open files (like `ulimit -n 4096`)"
+}
+
+// fileStamp is what the polling compares to find the changes of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// scanFolders return the stamps of the files of the folders (not of their sub folders).
+func scanFolders(folders []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, folder := range folders {
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				stamps[filepath.Join(folder, entry.Name())] = fileStamp{info.ModTime(), info.Size()}
+			}
+		}
+	}
+	return stamps
+}
+
+// startPolling start the polling of the folders that can't be watched, if any,
+// and return the channel of their events (nil without such folder).
+func startPolling(folders []string) <-chan fsnotify.Event {
+	if len(folders) == 0 {
+		return nil
+	}
+	if infoLevel >= infoErrors {
+		warning("The system limit of the watched folders is reached, %d folder(s) are polled every %v instead: %s.", len(folders), pollInterval, watchLimitAdvice())
+	}
+	events := make(chan fsnotify.Event)
+	go pollFolders(folders, events)
+	return events
+}
+
+// pollFolders send the changes of the files of the folders as file system events,
+// found by comparing the files every pollInterval.
+// It replaces the watcher for the folders that can't be watched (see isWatchLimit).
+func pollFolders(folders []string, events chan<- fsnotify.Event) {
+	last := scanFolders(folders)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current := scanFolders(folders)
+		for name, stamp := range current {
+			if old, ok := last[name]; !ok {
+				events <- fsnotify.Event{Name: name, Op: fsnotify.Create}
+			} else if old != stamp {
+				events <- fsnotify.Event{Name: name, Op: fsnotify.Write}
+			}
+		}
+		for name := range last {
+			if _, ok := current[name]; !ok {
+				events <- fsnotify.Event{Name: name, Op: fsnotify.Remove}
+			}
+		}
+		last = current
+	}
+}
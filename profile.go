@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// the line of the class, the first step of the preamble profile
+var reDocumentClass = regexp.MustCompile(`\\documentclass\b`)
+
+// profileStep is a prefix of the preamble, ending after the line of the class or of some packages.
+type profileStep struct {
+	line   int    // the last line of the prefix
+	loaded string // the class or the packages loaded on this line
+	prefix string
+	time   time.Duration // the best dump time of the prefix
+	size   int64         // the size of the .fmt of the prefix
+}
+
+// profileSteps cut the preamble after the class, after every line loading packages, and at its end.
+func profileSteps(preamble string) (steps []profileStep) {
+	lines := strings.SplitAfter(preamble, "\n")
+	length := 0
+	for i, line := range lines {
+		length += len(line)
+		code := strings.TrimSpace(line)
+		if strings.HasPrefix(code, "%") {
+			continue
+		}
+		loaded := []string{}
+		if reDocumentClass.MatchString(code) && len(steps) == 0 {
+			loaded = append(loaded, "class")
+		}
+		for _, match := range reLoadPackage.FindAllStringSubmatch(code, -1) {
+			for _, name := range strings.Split(match[1], ",") {
+				if name = strings.TrimSpace(name); len(name) > 0 {
+					loaded = append(loaded, name)
+				}
+			}
+		}
+		if len(loaded) > 0 {
+			steps = append(steps, profileStep{line: i + 1, loaded: strings.Join(loaded, ","), prefix: preamble[:length]})
+		}
+	}
+	if len(strings.TrimSpace(preamble[len(lastPrefix(steps)):])) > 0 {
+		steps = append(steps, profileStep{line: strings.Count(strings.TrimRight(preamble, "\n"), "\n") + 1, loaded: "the rest", prefix: preamble})
+	}
+	return steps
+}
+
+// lastPrefix return the prefix of the last step, "" if none.
+func lastPrefix(steps []profileStep) string {
+	if len(steps) == 0 {
+		return ""
+	}
+	return steps[len(steps)-1].prefix
+}
+
+// profileOptions return the precompilation options that dump the prefix file in the folder.
+func profileOptions(folder, job string) []string {
+	options := []string{}
+	for _, option := range precompileOptions[:len(precompileOptions)-1] {
+		if strings.HasPrefix(option, "-jobname=") || strings.HasPrefix(option, "-output-directory=") || strings.HasPrefix(option, "-aux-directory=") || option == "-recorder" {
+			continue
+		}
+		options = append(options, option)
+	}
+	return append(options, "-output-directory="+texPath(folder), "-jobname="+job, "&"+latexFormat+" "+texFileName(filepath.Join(folder, job+".tex")))
+}
+
+// profilePreamble is the `profile-preamble` subcommand. It dumps the preamble cumulatively,
+// up to the class and up to every line loading packages, and reports the cost of every step
+// (the time and the .fmt size added to the previous step), to find the packages worth trimming or moving to the body.
+// With --runs=N every step is dumped N times, and its best time is kept.
+func profilePreamble(args []string) error {
+	runs, options := 1, []string{"--no-watch", "--base-split="}
+	for _, arg := range args {
+		if value := strings.TrimPrefix(arg, "--runs="); value != arg {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return errors.New("Invalid --runs value " + value + " (use a positive number).")
+			}
+			runs = n
+			continue
+		}
+		options = append(options, arg)
+	}
+	os.Args = append(os.Args[:1], options...)
+	if err := SetParameters(); err != nil {
+		return atStage("parameters", err)
+	}
+	if mustCompileAll {
+		return errors.New("The preamble of " + inBaseOriginal + ".tex is not precompiled (--skip-fmt, tectonic or the ctex classes).")
+	}
+	// the messages of the split are not useful here
+	level := infoLevel
+	infoLevel = infoErrors
+	err := convertMarkdown()
+	if err == nil {
+		err = splitTeX()
+	}
+	defer clearTeX()
+	infoLevel = level
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(inBase + ".preamble.tex")
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", inBase+".preamble.tex", err)
+	}
+	steps := profileSteps(strings.TrimSuffix(string(data), "\\dump"))
+	if len(steps) == 0 {
+		return errors.New("The preamble of " + inBaseOriginal + ".tex is empty.")
+	}
+
+	// the steps are dumped in a hidden folder, so the engine finds the files of the source
+	folder, err := os.MkdirTemp(".", ".lfc-profile-")
+	if err != nil {
+		return fmt.Errorf("Problem creating the profile folder: %w", err)
+	}
+	for i := range steps {
+		step := &steps[i]
+		job := fmt.Sprintf("step-%d", i+1)
+		if err := ioutil.WriteFile(filepath.Join(folder, job+".tex"), []byte(step.prefix+"\\dump"), 0644); err != nil {
+			os.RemoveAll(folder)
+			return fmt.Errorf("Problem writing the profile step: %w", err)
+		}
+		info(" dump up to line", step.line, "("+step.loaded+")")
+		for run := 0; run < runs; run++ {
+			start := time.Now()
+			if err := engineCommand(context.Background(), texCompiler, profileOptions(folder, job)...).Run(); err != nil {
+				// the folder is kept to read the log
+				return fmt.Errorf("The preamble can't be dumped up to line %d (%s), see %s: %w", step.line, step.loaded, filepath.Join(folder, job+".log"), err)
+			}
+			if elapsed := time.Since(start); run == 0 || elapsed < step.time {
+				step.time = elapsed
+			}
+		}
+		if fileInfo, err := os.Stat(filepath.Join(folder, job+".fmt")); err == nil {
+			step.size = fileInfo.Size()
+		}
+		os.Remove(filepath.Join(folder, job+".fmt"))
+	}
+	os.RemoveAll(folder)
+	infoLevel = infoErrors
+	printProfile(steps)
+	return nil
+}
+
+// printProfile print the cost of the steps, the most expensive first.
+// The first step also has the cost of the LaTeX format and of the engine start.
+func printProfile(steps []profileStep) {
+	type cost struct {
+		step profileStep
+		time time.Duration
+		size int64
+	}
+	costs := make([]cost, len(steps))
+	for i, step := range steps {
+		costs[i] = cost{step: step, time: step.time, size: step.size}
+		if i > 0 {
+			costs[i].time -= steps[i-1].time
+			costs[i].size -= steps[i-1].size
+		}
+		// the noise of the measure
+		if costs[i].time < 0 {
+			costs[i].time = 0
+		}
+	}
+	sort.SliceStable(costs, func(i, j int) bool { return costs[i].time > costs[j].time })
+	total := steps[len(steps)-1]
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "line\tloaded\ttime\tshare\tfmt size")
+	for _, c := range costs {
+		share := 0.0
+		if total.time > 0 {
+			share = 100 * float64(c.time) / float64(total.time)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%.0f%%\t%+.2f MB\n", c.step.line, c.step.loaded, c.time.Round(time.Millisecond), share, float64(c.size)/(1<<20))
+	}
+	fmt.Fprintf(w, "\ttotal\t%s\t100%%\t%.2f MB\n", total.time.Round(time.Millisecond), float64(total.size)/(1<<20))
+	w.Flush()
+	fmt.Println()
+	fmt.Println("The class step includes the start of the engine and the loading of the", latexFormat, "format.")
+}
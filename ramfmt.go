@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// keep the .fmt in memory (tmpfs) and leave only a link to it next to the outputs
+var mustFmtInRAM bool
+
+// ramFolder return the folder where the .fmt is kept in memory:
+// /dev/shm if it exists (a tmpfs on Linux), the temp folder of the OS otherwise.
+func ramFolder() string {
+	if !isFolderMissing("/dev/shm") {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// ramFormatName return the in-memory name of the base.fmt (the .fmt of the document, or its base layer).
+// The sub folder is named after the hash of the absolute .fmt path,
+// so two documents with the same name do not share their format.
+func ramFormatName(base string) string {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		absBase = base
+	}
+	sum := sha256.Sum256([]byte(absBase))
+	return filepath.Join(ramFolder(), fmt.Sprintf("latex-fast-compile-%x", sum[:6]), filepath.Base(base)+".fmt")
+}
+
+// isFormatLinked check if the base.fmt is a link (to the in-memory one).
+func isFormatLinked(base string) bool {
+	fileInfo, err := os.Lstat(base + ".fmt")
+	return err == nil && fileInfo.Mode()&os.ModeSymlink != 0
+}
+
+// unlinkFormat remove the link to the in-memory base.fmt, so that the precompilation
+// writes a new .fmt (the in-memory one can be gone after a reboot).
+func unlinkFormat(base string) {
+	if isFormatLinked(base) {
+		os.Remove(base + ".fmt")
+	}
+}
+
+// moveFormatToRAM copy the new base.fmt in memory, and replace it by a link to this copy.
+// If the link can't be created (on Windows without the needed privilege),
+// the .fmt stays on disk and the option is dropped.
+func moveFormatToRAM(base string) {
+	if !mustFmtInRAM || isFormatLinked(base) || isFileMissing(base+".fmt") {
+		return
+	}
+	ramName := ramFormatName(base)
+	err := os.MkdirAll(filepath.Dir(ramName), 0700)
+	if err == nil {
+		err = copyFile(base+".fmt", ramName)
+	}
+	if err == nil {
+		// the link replace the .fmt in one step
+		linkName := base + ".fmt.link"
+		os.Remove(linkName)
+		if err = os.Symlink(ramName, linkName); err == nil {
+			err = os.Rename(linkName, base+".fmt")
+		}
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(ramName))
+		mustFmtInRAM = false
+		if infoLevel >= infoErrors {
+			warning("Can't keep the .fmt in memory, it stays on disk: %v", err)
+		}
+		return
+	}
+	info(" link", base+".fmt", "to", ramName)
+}
+
+// clearFormatInRAM remove the in-memory base.fmt if its link was removed.
+func clearFormatInRAM(base string) {
+	if !mustFmtInRAM || isFormatLinked(base) {
+		return
+	}
+	ramName := ramFormatName(base)
+	if isFolderMissing(filepath.Dir(ramName)) {
+		return
+	}
+	if infoLevel >= infoActions {
+		info(" remove", ramName)
+	}
+	os.RemoveAll(filepath.Dir(ramName))
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+var recordFile string // the --record value: the .zip archive of the session
+
+// recordedCommand is an engine command run during the recorded session.
+type recordedCommand struct {
+	Args  []string `json:"args"`
+	Env   []string `json:"env,omitempty"` // the variables set by this program
+	Error string   `json:"error,omitempty"`
+	Note  string   `json:"note,omitempty"` // why the command was not run
+}
+
+// recordedSession is the description of the session, saved as session.json in the archive.
+type recordedSession struct {
+	Version    string            `json:"version"`
+	OS         string            `json:"os"`
+	Distro     string            `json:"distro"`
+	Engine     string            `json:"engine"`
+	Date       string            `json:"date"`
+	Args       []string          `json:"args"`
+	Env        []string          `json:"env"` // the TeX related variables
+	Commands   []recordedCommand `json:"commands"`
+	Files      []string          `json:"files"`
+	Logs       []string          `json:"logs"`
+	Error      string            `json:"error,omitempty"`
+	TempFolder string            `json:"tempFolder,omitempty"`
+}
+
+// the commands of the last build (the ones of the previous builds are forgotten at every preparation)
+var recordedCommands []recordedCommand
+
+// the name of the session description in the archive
+const sessionFileName = "session.json"
+
+// recordCommand remember the engine command (and its result) if the session is recorded.
+func recordCommand(args []string, err error) {
+	if len(recordFile) == 0 {
+		return
+	}
+	command := recordedCommand{Args: args, Env: engineEnv}
+	if err != nil {
+		command.Error = err.Error()
+	}
+	recordedCommands = append(recordedCommands, command)
+}
+
+// forgetCommands start the recording of a new build.
+func forgetCommands() {
+	recordedCommands = nil
+}
+
+// texEnvironment return the environment variables that can change the TeX run
+// (the other ones, like the tokens of other programs, are never recorded).
+func texEnvironment() (env []string) {
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		upper := strings.ToUpper(name)
+		if strings.HasPrefix(upper, "TEX") || strings.HasPrefix(upper, "LATEX_FAST_COMPILE") ||
+			strings.HasPrefix(upper, "LC_") || upper == "LANG" || upper == "SOURCE_DATE_EPOCH" ||
+			upper == "MAX_PRINT_LINE" || upper == "OPENOUT_ANY" || upper == "OPENIN_ANY" ||
+			strings.HasPrefix(upper, "MIKTEX") || upper == "BIBINPUTS" || upper == "BSTINPUTS" {
+			env = append(env, v)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// inputFiles return the files included (recursively) by `\input` and `\include` in the .tex file.
+func inputFiles(fileName string, depth int) (files []string) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil || depth > 10 {
+		return nil
+	}
+	for _, match := range reInput.FindAllStringSubmatch(stripComments(string(data)), -1) {
+		if included := includedPath(match[1], ".tex", fileName); len(included) > 0 {
+			files = append(files, included)
+			files = append(files, inputFiles(included, depth+1)...)
+		}
+	}
+	return files
+}
+
+// sessionFiles return the files needed to replay the session: the sources, the split files and the configuration.
+func sessionFiles() []string {
+	files := append([]string{}, watchedFiles()...)
+	files = append(files, inputFiles(inBaseOriginal+".tex", 0)...)
+	if bibs, err := bibFiles(inBaseOriginal+".tex", 0); err == nil {
+		files = append(files, bibs...)
+	}
+	files = append(files, inBase+".preamble.tex", inBase+".body.tex", fullSourceName(), configFileName)
+	return files
+}
+
+// archiveName return the name of the file in the archive, relative to the current folder.
+// The files outside of it are stored by their base name.
+func archiveName(fileName string) string {
+	name := filepath.ToSlash(filepath.Clean(fileName))
+	if filepath.IsAbs(fileName) || strings.HasPrefix(name, "../") {
+		name = filepath.Base(fileName)
+	}
+	return name
+}
+
+// addToArchive add the file to the archive, in the folder.
+func addToArchive(archive *zip.Writer, folder, fileName string) (string, error) {
+	name := folder + "/" + archiveName(fileName)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return "", err
+	}
+	// the modification times are kept
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return "", err
+	}
+	header.Name, header.Method = name, zip.Deflate
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(data)
+	return name, err
+}
+
+// writeRecord write the archive of the last build: the split files, the engine commands,
+// the environment, the logs and the versions, to attach to a bug report.
+func writeRecord(buildErr error) error {
+	if len(recordFile) == 0 {
+		return nil
+	}
+	session := recordedSession{
+		Version:    version,
+		OS:         runtime.GOOS + "/" + runtime.GOARCH,
+		Distro:     distro.name,
+		Engine:     texVersionStr,
+		Date:       time.Now().Format(time.RFC3339),
+		Args:       os.Args,
+		Env:        texEnvironment(),
+		Commands:   recordedCommands,
+		TempFolder: tempFolderName,
+	}
+	if buildErr != nil {
+		session.Error = buildErr.Error()
+	}
+	// the .fmt is not in the archive, so its precompilation is needed to replay the compilation
+	if !mustCompileAll && (len(recordedCommands) == 0 || !reflect.DeepEqual(recordedCommands[0].Args[1:], precompileOptions)) {
+		precompileCommand := recordedCommand{Args: append([]string{texCompiler}, precompileOptions...), Env: engineEnv, Note: "the .fmt was up to date"}
+		session.Commands = append([]recordedCommand{precompileCommand}, recordedCommands...)
+	}
+	file, err := os.Create(recordFile)
+	if err != nil {
+		return fmt.Errorf("Problem creating %s: %w", recordFile, err)
+	}
+	archive := zip.NewWriter(file)
+	seen := make(map[string]bool)
+	for _, fileName := range sessionFiles() {
+		if seen[fileName] || isFileMissing(fileName) {
+			continue
+		}
+		seen[fileName] = true
+		name, err := addToArchive(archive, "files", fileName)
+		if err != nil {
+			archive.Close()
+			file.Close()
+			return fmt.Errorf("Problem adding %s to %s: %w", fileName, recordFile, err)
+		}
+		session.Files = append(session.Files, name)
+	}
+	if !isFileMissing(outBase + ".log") {
+		if name, err := addToArchive(archive, "logs", outBase+".log"); err == nil {
+			session.Logs = append(session.Logs, name)
+		}
+	}
+	data, _ := json.MarshalIndent(session, "", "  ")
+	if w, err := archive.Create(sessionFileName); err == nil {
+		w.Write(data)
+	}
+	err = archive.Close()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Problem writing %s: %w", recordFile, err)
+	}
+	info(" create", recordFile)
+	return nil
+}
+
+// extractArchive extract the files of the archive to the folder.
+func extractArchive(archive *zip.ReadCloser, folder string) error {
+	for _, f := range archive.File {
+		target := filepath.Join(folder, filepath.FromSlash(f.Name))
+		// the names can't go out of the folder
+		if rel, err := filepath.Rel(folder, target); err != nil || strings.HasPrefix(rel, "..") {
+			return errors.New("Bad file name " + f.Name + " in the archive.")
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		w, err := os.Create(target)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandJobBase return the base name of the files written by the engine command (with their folder).
+func commandJobBase(args []string) string {
+	folder, job := "", ""
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "-jobname="):
+			job = strings.TrimPrefix(arg, "-jobname=")
+		case strings.HasPrefix(arg, "-output-directory="):
+			folder = strings.TrimPrefix(arg, "-output-directory=")
+		case strings.HasPrefix(arg, "-aux-directory="):
+			folder = strings.TrimPrefix(arg, "-aux-directory=")
+		}
+	}
+	return filepath.Join(nativePath(strings.Trim(folder, `"`)), job)
+}
+
+// replaySession is the `replay` subcommand: it extracts a session recorded with --record
+// and runs again its engine commands, with the recorded environment, to reproduce a bug report.
+func replaySession(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("You should provide the .zip archive of the session (and the folder to replay it).")
+	}
+	zipName := args[0]
+	folder := strings.TrimSuffix(zipName, ".zip") + "-replay"
+	if len(args) == 2 {
+		folder = args[1]
+	}
+	archive, err := zip.OpenReader(zipName)
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", zipName, err)
+	}
+	defer archive.Close()
+	var session recordedSession
+	for _, f := range archive.File {
+		if f.Name == sessionFileName {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = json.NewDecoder(r).Decode(&session)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("Problem reading %s in %s: %w", sessionFileName, zipName, err)
+			}
+		}
+	}
+	if len(session.Args) == 0 {
+		return errors.New("The file " + zipName + " is not a recorded session.")
+	}
+	if entries, _ := os.ReadDir(folder); len(entries) > 0 {
+		return errors.New("The folder " + folder + " is not empty.")
+	}
+	if err := extractArchive(archive, folder); err != nil {
+		return fmt.Errorf("Problem extracting %s: %w", zipName, err)
+	}
+
+	fmt.Println("recorded on:", session.Date, "("+session.OS+")")
+	fmt.Println("command:", quoteArgs(session.Args))
+	fmt.Println("version:", session.Version, "| tex distribution:", session.Distro, "|", session.Engine)
+	if len(session.Error) > 0 {
+		fmt.Println("error:", session.Error)
+	}
+	if session.Version != version {
+		warning("The session was recorded by the version %s, this is %s.", session.Version, version)
+	}
+	// the commands run in the files folder, where the sources are
+	filesFolder := filepath.Join(folder, "files")
+	if len(session.TempFolder) > 0 && !filepath.IsAbs(session.TempFolder) {
+		os.MkdirAll(filepath.Join(filesFolder, session.TempFolder), 0755)
+	}
+	defineFlags()
+	reSanitize = regexp.MustCompile(logSanitize)
+	info(fmt.Sprintf("Replay %d engine command(s) in %s.", len(session.Commands), filesFolder))
+	for _, command := range session.Commands {
+		if len(command.Args) == 0 {
+			continue
+		}
+		cmd := engineCommand(context.Background(), command.Args[0], command.Args[1:]...)
+		cmd.Dir = filesFolder
+		cmd.Env = append(append(os.Environ(), session.Env...), command.Env...)
+		// the log of the command is shown in case of error
+		outBase = filepath.Join(filesFolder, commandJobBase(command.Args))
+		startTime := printAction("Run " + command.Args[0])
+		err := runEnd(cmd, startTime, cmd.Run())
+		switch {
+		case len(command.Note) > 0:
+			info("This command was not run in the recorded session (" + command.Note + ").")
+		case err != nil && len(command.Error) == 0:
+			warning("This command failed (%v), but not in the recorded session.", err)
+		case err == nil && len(command.Error) > 0:
+			warning("This command failed in the recorded session (%s), but not now.", command.Error)
+		case err != nil:
+			info("This command also failed in the recorded session (" + command.Error + ").")
+		}
+	}
+	for _, log := range session.Logs {
+		info("The recorded log is " + filepath.Join(folder, filepath.FromSlash(log)) + ".")
+	}
+	return nil
+}
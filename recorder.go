@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// the --no-recorder value: do not watch the files listed in the .fls of the engine
+var mustNoRecorder bool
+
+// the project files read by the last precompilation and compilation (from their .fls)
+var recordedPreamble, recordedBody []string
+
+// usesRecorder check if the engine lists the files it reads in the .fls (-recorder), to watch them.
+// This is only useful while watching (the region preview is compiled once).
+func usesRecorder() bool {
+	return !mustNoRecorder && !mustNoWatch && !mustManual && len(regionFlag) == 0 && !usesTectonic()
+}
+
+// recordedInputs return the project files read by the engine, from the INPUT lines of the .fls.
+// The files of the distribution (outside of the project folder), the files written by the same run
+// (the OUTPUT lines, like the .aux) and the ones of the job (like the .fmt) are skipped.
+func recordedInputs(flsName string) []string {
+	data, err := ioutil.ReadFile(flsName)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	pwd, inputs, outputs := "", []string{}, map[string]bool{}
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "PWD "):
+			pwd = strings.TrimPrefix(line, "PWD ")
+		case strings.HasPrefix(line, "OUTPUT "):
+			outputs[recordedName(pwd, strings.TrimPrefix(line, "OUTPUT "))] = true
+		case strings.HasPrefix(line, "INPUT "):
+			inputs = append(inputs, recordedName(pwd, strings.TrimPrefix(line, "INPUT ")))
+		}
+	}
+	jobPrefix := filepath.Base(inBase) + "."
+	seen := map[string]bool{filepath.Clean(inBaseOriginal + ".tex"): true}
+	files := []string{}
+	for _, name := range inputs {
+		if len(name) == 0 || seen[name] || outputs[name] || strings.HasPrefix(filepath.Base(name), jobPrefix) || isFileMissing(name) {
+			continue
+		}
+		seen[name] = true
+		files = append(files, name)
+	}
+	return files
+}
+
+// recordedName return the path of the .fls file relative to the working folder,
+// or "" if it is outside of it (absolute, like the files of the distribution).
+func recordedName(pwd, name string) string {
+	if filepath.IsAbs(name) {
+		if len(pwd) == 0 {
+			return ""
+		}
+		rel, err := filepath.Rel(pwd, name)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return ""
+		}
+		name = rel
+	}
+	return filepath.Clean(name)
+}
+
+// recordInputs read the .fls of the last engine run, and watch the files it read.
+// The files read by the precompilation are used by the preamble, so their changes rebuild the .fmt.
+func recordInputs(preamble bool) {
+	if !usesRecorder() {
+		return
+	}
+	files := recordedInputs(outBase + ".fls")
+	trace("watch", "Recorded in", outBase+".fls:", files)
+	inputMu.Lock()
+	if preamble {
+		recordedPreamble = files
+	} else {
+		recordedBody = files
+	}
+	inputMu.Unlock()
+	updateInputWatch()
+}
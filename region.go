@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	regionFlag             string // the --region value: start:end lines of the source
+	regionStart, regionEnd int    // the first and the last line of the region
+)
+
+// checkRegion check the --region lines. The region is compiled once, without watching.
+func checkRegion() error {
+	if len(regionFlag) == 0 {
+		return nil
+	}
+	start, end, found := strings.Cut(regionFlag, ":")
+	var errStart, errEnd error
+	regionStart, errStart = strconv.Atoi(strings.TrimSpace(start))
+	regionEnd, errEnd = strconv.Atoi(strings.TrimSpace(end))
+	if !found || errStart != nil || errEnd != nil || regionStart < 1 || regionEnd < regionStart {
+		return errors.New("Invalid --region value " + regionFlag + " (use start:end source lines, like 120:180).")
+	}
+	if mustCompileAll {
+		return errors.New("The --region option needs the precompiled preamble, it can't be used with --skip-fmt (or tectonic, or the ctex classes).")
+	}
+	mustNoWatch = true
+	return nil
+}
+
+// regionBase return the job name of the region preview (like cylinder-region).
+func regionBase(base string) string {
+	return base + "-region"
+}
+
+// writeRegion write the .region.tex: the beginning of the .body.tex (up to the \begin{document} line),
+// empty lines up to the region, the region and \end{document}.
+// So the line numbers of the errors and of the .synctex are the ones of the source.
+func writeRegion() error {
+	body, err := ioutil.ReadFile(inBase + ".body.tex")
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", inBase+".body.tex", err)
+	}
+	loc := reBeginDocument.FindIndex(body)
+	if loc == nil {
+		return errors.New("No \\begin{document} in " + inBase + ".body.tex.")
+	}
+	lines := strings.Split(string(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))), "\n")
+	beginLine := bytes.Count(body[:loc[0]], []byte("\n")) + 1
+	lastLine := len(lines)
+	if len(lines[lastLine-1]) == 0 {
+		lastLine--
+	}
+	if regionStart <= beginLine || regionEnd > lastLine {
+		return fmt.Errorf("The region %d:%d is not in the body of the document (lines %d to %d).", regionStart, regionEnd, beginLine+1, lastLine)
+	}
+	region := strings.Join(lines[:beginLine], "\n") +
+		strings.Repeat("\n", regionStart-beginLine) +
+		strings.Join(lines[regionStart-1:regionEnd], "\n") +
+		"\n\\end{document}\n"
+	record(0, "add to region", "\\end{document}", fmt.Sprintf("Only the lines %d to %d of the body are compiled (--region).", regionStart, regionEnd))
+	info(" create", inBase+".region.tex")
+	if err := ioutil.WriteFile(inBase+".region.tex", []byte(region), 0644); err != nil {
+		return fmt.Errorf("Problem while writing %s: %w", inBase+".region.tex", err)
+	}
+	return nil
+}
+
+// regionOptions return the compilation options for the region: the ones of the body,
+// with the region job name and file.
+func regionOptions() []string {
+	options := make([]string, len(compileOptions))
+	for i, option := range compileOptions {
+		switch {
+		case option == "-jobname="+inBase:
+			option = "-jobname=" + regionBase(inBase)
+		case strings.HasSuffix(option, texFileName(inBase+".body.tex")):
+			option = strings.TrimSuffix(option, texFileName(inBase+".body.tex")) + texFileName(inBase+".region.tex")
+		}
+		options[i] = option
+	}
+	return options
+}
+
+// compileRegion compile only the --region lines of the body against the precompiled preamble,
+// to a preview (like cylinder-region.pdf), for the "compile selection" of the editors.
+func compileRegion() error {
+	if err := writeRegion(); err != nil {
+		return atStage("region", err)
+	}
+	lockOutFolder()
+	defer unlockOutFolder()
+	regionOut, regionOutput := regionBase(outBase), regionBase(outputBase)
+	if err := run(fmt.Sprintf("Compile region %d:%d", regionStart, regionEnd), texCompiler, regionOptions()...); err != nil {
+		return atStage("compile", err)
+	}
+	if writesDVI() && outputFormat == "pdf" {
+		if err := dviToPDF(regionOut); err != nil {
+			return atStage(dviDriver, err)
+		}
+	}
+	// the .synctex points to the source, not to the .region.tex
+	if !mustNotSync && !isFileMissing(regionOut+".synctex") {
+		info(" modify", regionOut+".synctex")
+		syncdata, err := ioutil.ReadFile(regionOut + ".synctex")
+		if err != nil {
+			return atStage("synctex", fmt.Errorf("Problem reading %s: %w", regionOut+".synctex", err))
+		}
+		syncdata = bytes.Replace(syncdata, []byte(inBase+".region.tex"), []byte(inBaseOriginal+".tex"), 1)
+		if err := ioutil.WriteFile(regionOut+".synctex", syncdata, 0644); err != nil {
+			return atStage("synctex", fmt.Errorf("Problem modifying %s: %w", regionOut+".synctex", err))
+		}
+	}
+	if regionOut != regionOutput && !usesAuxDirectory() {
+		for _, ext := range []string{"." + outputExtension(), ".synctex"} {
+			if isFileMissing(regionOut + ext) {
+				continue
+			}
+			info(" move", regionOut+ext, "to", regionOutput+ext)
+			if err := moveFile(regionOut+ext, regionOutput+ext); err != nil {
+				return atStage("output", err)
+			}
+		}
+	}
+	return nil
+}
+
+// clearRegion clear the auxiliary files of the region preview (its .aux is not the one of the document).
+func clearRegion() {
+	if len(regionFlag) > 0 {
+		clearFiles(regionBase(outBase), safeExtensions(regionBase(outBase), auxExtensions))
+	}
+}
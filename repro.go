@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// shellQuote quote the argument for the shell of the system (sh, or cmd on Windows), if needed.
+func shellQuote(arg string) string {
+	if runtime.GOOS == "windows" {
+		if len(arg) > 0 && !strings.ContainsAny(arg, " \t\"&|<>^%()") {
+			return arg
+		}
+		return `"` + strings.ReplaceAll(arg, `"`, `""`) + `"`
+	}
+	if len(arg) > 0 && !strings.ContainsAny(arg, " \t\n\"'\\$`!*?[]{}()<>|&;#~") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// reproductionEnv return the variables that change the engine run:
+// the ones set by this program, then the TeX related ones of the environment.
+func reproductionEnv() []string {
+	env := append([]string{}, engineEnv...)
+	for _, v := range texEnvironment() {
+		if !strings.HasPrefix(strings.ToUpper(v), "LATEX_FAST_COMPILE") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// reproductionCommand return the command line that runs the command with the environment
+// in the folder, to be pasted in a terminal (sh, or cmd on Windows).
+func reproductionCommand(folder string, args, env []string) string {
+	parts := []string{}
+	if runtime.GOOS == "windows" {
+		parts = append(parts, "cd /d "+shellQuote(folder))
+		for _, v := range env {
+			parts = append(parts, `set "`+v+`"`)
+		}
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return strings.Join(append(parts, strings.Join(quoted, " ")), " && ")
+	}
+	command := []string{}
+	for _, v := range env {
+		name, value, _ := strings.Cut(v, "=")
+		command = append(command, name+"="+shellQuote(value))
+	}
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+	return "cd " + shellQuote(folder) + " && " + strings.Join(command, " ")
+}
+
+// printReproduction print the command that reproduces the failed engine run outside of this program,
+// to separate its problems from the TeX ones.
+// The files that are removed at the end (split files, isolated folder) are reminded.
+func printReproduction(folder string, args []string) {
+	if infoLevel < infoErrors || jobContext().Err() != nil {
+		return
+	}
+	if len(folder) == 0 {
+		folder, _ = os.Getwd()
+	}
+	fmt.Println("To reproduce this run outside of latex-fast-compile:")
+	fmt.Println("  " + reproductionCommand(folder, args, reproductionEnv()))
+	if len(isolatedDir) > 0 {
+		fmt.Println("The isolated folder is removed at the end, compile without --isolated to keep its files.")
+		return
+	}
+	if mustKeepIntermediate || infoLevel == infoDebug {
+		return
+	}
+	for _, arg := range args {
+		if strings.HasSuffix(arg, ".preamble.tex") || strings.HasSuffix(arg, ".body.tex") || strings.HasSuffix(arg, ".full.tex") {
+			fmt.Println("Use --keep-intermediate to keep the split files used by this command.")
+			return
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "errors"
+
+// the engine runs retried after a crash since the last build result
+var buildRetries int
+
+// isCrash check if the engine crashed, rather than failed on the document (that gives the status 1):
+// it is killed by a signal (out of memory...) or exits with a bigger status (like the Windows
+// access violations caused by the antivirus), before writing its log.
+// The cancelled runs (the source changed again) are not crashes.
+func isCrash(err error) bool {
+	var ce *commandError
+	if !errors.As(err, &ce) || jobContext().Err() != nil {
+		return false
+	}
+	return !ce.hasLog && (len(ce.signal) > 0 || ce.status > 1)
+}
+
+// noteRetry warn about the crash before the retry, and count it for the build result and the metrics.
+func noteRetry(err error) {
+	if infoLevel >= infoErrors {
+		warning("The engine crashed (%v), it is run again.", err)
+	}
+	buildRetries++
+	stats.mu.Lock()
+	stats.retries++
+	stats.mu.Unlock()
+}
+
+// reportRetries remind the retries with the build result, as they can hide a problem of the system.
+func reportRetries() {
+	if buildRetries > 0 && infoLevel >= infoErrors {
+		warning("This build needed %d engine run(s) after a crash.", buildRetries)
+	}
+	buildRetries = 0
+}
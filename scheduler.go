@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// jobPriority order the waiting jobs: the lowest value runs first.
+type jobPriority int
+
+const (
+	priorityPrecompile jobPriority = iota // convert, split and precompile the source
+	priorityCompile                       // compile the body
+	priorityPostTool                      // the tools using the outputs (exports...)
+	priorityCheck                         // the checks of the outputs (see --verify-against-full)
+)
+
+// job is a unit of work run by the scheduler.
+type job struct {
+	name     string // a job is not queued twice: the jobs with the same name are coalesced
+	priority jobPriority
+	run      func() error
+}
+
+// the context of the running job: the commands started by run and runTool
+// are killed when it is cancelled (see jobContext)
+var (
+	runContextMu sync.Mutex
+	runContext   = context.Background()
+)
+
+// jobContext return the context of the running job, or the background context outside of the jobs.
+// It is set by the scheduler goroutine and read by the others.
+func jobContext() context.Context {
+	runContextMu.Lock()
+	defer runContextMu.Unlock()
+	return runContext
+}
+
+// setJobContext set the context of the running job.
+func setJobContext(ctx context.Context) {
+	runContextMu.Lock()
+	defer runContextMu.Unlock()
+	runContext = ctx
+}
+
+// scheduler run the submitted jobs one at a time, by priority,
+// and in submission order for the same priority.
+// It can be used from any goroutine.
+type scheduler struct {
+	mu       sync.Mutex
+	pending  []job
+	running  *job
+	cancelFn context.CancelFunc
+	wake     chan struct{}
+	idle     func() // called when there is no more job to run
+	busy     bool   // the jobs (or idle) are running
+	stopped  bool   // no more job is run (see stop)
+	finished *sync.Cond
+}
+
+// the scheduler used in watch mode
+var jobs *scheduler
+
+// newScheduler create a scheduler and start its worker goroutine.
+func newScheduler(idle func()) *scheduler {
+	s := &scheduler{wake: make(chan struct{}, 1), idle: idle}
+	s.finished = sync.NewCond(&s.mu)
+	go s.loop()
+	return s
+}
+
+// submit queue the job, except if a job with the same name is already waiting.
+func (s *scheduler) submit(j job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pending {
+		if p.name == j.name {
+			if infoLevel >= infoDebug {
+				info("Job", j.name, "already queued.")
+			}
+			return
+		}
+	}
+	// insert after the jobs with the same or a higher priority
+	i := len(s.pending)
+	for i > 0 && s.pending[i-1].priority > j.priority {
+		i--
+	}
+	s.pending = append(s.pending, job{})
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = j
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cancel remove the waiting jobs with the given or a lower priority,
+// and stop the running one if it has such priority.
+func (s *scheduler) cancel(from jobPriority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.pending[:0]
+	for _, p := range s.pending {
+		if p.priority < from {
+			kept = append(kept, p)
+		} else if infoLevel >= infoDebug {
+			info("Job", p.name, "cancelled.")
+		}
+	}
+	s.pending = kept
+	if s.running != nil && s.running.priority >= from {
+		s.cancelFn()
+	}
+}
+
+// next remove the first waiting job from the queue and mark it as running.
+func (s *scheduler) next() (j job, ctx context.Context, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 || s.stopped {
+		return j, nil, false
+	}
+	j = s.pending[0]
+	s.pending = s.pending[1:]
+	s.running = &j
+	ctx, s.cancelFn = context.WithCancel(context.Background())
+	return j, ctx, true
+}
+
+// done mark the running job as finished.
+func (s *scheduler) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelFn()
+	s.running = nil
+}
+
+// stop cancel all the jobs, and wait for the end of the running one (and of idle),
+// so the files can be cleared without an engine still writing them.
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.cancel(priorityPrecompile)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.busy {
+		s.finished.Wait()
+	}
+}
+
+// setBusy mark the loop as running jobs or not, and return false if the scheduler is stopped.
+func (s *scheduler) setBusy(busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = busy && !s.stopped
+	if !s.busy {
+		s.finished.Broadcast()
+	}
+	return s.busy
+}
+
+// loop run the jobs as they come. The errors are reported, but never stop the loop.
+func (s *scheduler) loop() {
+	for range s.wake {
+		if !s.setBusy(true) {
+			return
+		}
+		ran := false
+		for {
+			j, ctx, ok := s.next()
+			if !ok {
+				break
+			}
+			ran = true
+			setJobContext(ctx)
+			err := j.run()
+			setJobContext(context.Background())
+			cancelled := ctx.Err() != nil
+			s.done()
+			if cancelled {
+				info("The", j.name, "was cancelled.")
+			} else if !errors.Is(err, errSourceGone) {
+				reportError(err)
+			}
+		}
+		if ran && s.idle != nil && s.setBusy(true) {
+			s.idle()
+		}
+		s.setBusy(false)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	encryptPDF string // the --encrypt-pdf value: the "user:owner" passwords
+	signPDF    string // the --sign-pdf value: the signing command, with {in} and {out}
+)
+
+// hasFinalPDF check if a final (encrypted or signed) .pdf is produced.
+func hasFinalPDF() bool {
+	return len(encryptPDF) > 0 || len(signPDF) > 0
+}
+
+// checkFinalSteps check the --encrypt-pdf and --sign-pdf values, and the tools they need.
+func checkFinalSteps() error {
+	if len(encryptPDF) > 0 {
+		if _, owner, found := strings.Cut(encryptPDF, ":"); !found || len(owner) == 0 {
+			return errors.New("Invalid --encrypt-pdf value (use user:owner, the user password can be empty).")
+		}
+		if _, err := exec.LookPath("qpdf"); err != nil {
+			return errors.New("Can't find qpdf in the current path (needed by --encrypt-pdf).")
+		}
+	}
+	if len(signPDF) > 0 {
+		args, err := splitWords(signPDF, false)
+		if err != nil || len(args) == 0 || !strings.Contains(signPDF, "{in}") {
+			return errors.New("Invalid --sign-pdf command " + signPDF + " (the input is given by {in}).")
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return errors.New("Can't find " + args[0] + " in the current path (needed by --sign-pdf).")
+		}
+	}
+	return nil
+}
+
+// finalName return the name of the final .pdf, like cylinder-final.pdf.
+func finalName(pdfName string) string {
+	return strings.TrimSuffix(pdfName, ".pdf") + "-final.pdf"
+}
+
+// finalizePDF produce the final .pdf: a copy of the .pdf encrypted with qpdf (--encrypt-pdf),
+// and then signed by the external tool (--sign-pdf), as the signature must be the last change.
+// The .pdf itself is kept, so the viewer and synctex still work while watching.
+func finalizePDF(pdfName string) (err error) {
+	final := finalName(pdfName)
+	encrypted, signed := final+".encrypted", final+".signed"
+	defer os.Remove(encrypted)
+	defer os.Remove(signed)
+	current := pdfName
+	if len(encryptPDF) > 0 {
+		// the passwords are given in an arguments file, so they are not visible in the process list
+		user, owner, _ := strings.Cut(encryptPDF, ":")
+		argsFile, err := ioutil.TempFile("", "latex-fast-compile-qpdf-")
+		if err != nil {
+			return atStage("encrypt", err)
+		}
+		defer os.Remove(argsFile.Name())
+		args := []string{"--encrypt", user, owner, "256", "--modify=none", "--extract=n", "--", current, encrypted}
+		_, err = argsFile.WriteString(strings.Join(args, "\n") + "\n")
+		if closeErr := argsFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = runTool("Encrypt "+pdfName, "qpdf", "@"+argsFile.Name())
+		}
+		if err != nil {
+			return atStage("encrypt", err)
+		}
+		current = encrypted
+	}
+	if len(signPDF) > 0 {
+		args, _ := splitWords(signPDF, false)
+		if !strings.Contains(signPDF, "{out}") {
+			// the tool signs in place, so it works on a copy
+			if err := copyInput(current, signed); err != nil {
+				return atStage("sign", err)
+			}
+			current = signed
+		}
+		for i, arg := range args {
+			args[i] = strings.NewReplacer("{in}", current, "{out}", signed).Replace(arg)
+		}
+		if err := runTool("Sign "+pdfName, args[0], args[1:]...); err != nil {
+			return atStage("sign", err)
+		}
+		current = signed
+	}
+	info(" create", final)
+	if err := moveFile(current, final); err != nil {
+		return atStage("final", fmt.Errorf("Problem creating %s: %w", final, err))
+	}
+	return nil
+}
+
+// finalizeDocument produce the final .pdf of the compilation (if asked).
+func finalizeDocument() error {
+	if !hasFinalPDF() {
+		return nil
+	}
+	return finalizePDF(outputBase + ".pdf")
+}
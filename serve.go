@@ -0,0 +1,463 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the default address of the compile service
+const defaultServeAddress = "localhost:9124"
+
+// the largest accepted request body (a .tex or a .zip project)
+const maxUploadSize = 64 << 20
+
+// the limits of an extracted .zip project, so a small zip bomb can't fill the disk
+const (
+	maxExtractedSize  = 512 << 20
+	maxExtractedFiles = 10000
+)
+
+// the name of the main file in the request folder, so the outputs have a known name
+const serveJobName = "document"
+
+// compileService is the HTTP compile service of the `serve` subcommand.
+type compileService struct {
+	self     string        // this program, run for every request
+	options  []string      // the options given to every compilation
+	cache    string        // the folder of the cached formats, by preamble hash
+	cacheMax int           // the number of cached formats kept
+	running  chan struct{} // the running compilations (its capacity is the concurrency limit)
+	timeout  time.Duration // the longest compilation
+	queueMax int32         // the number of waiting requests accepted
+	waiting  int32         // the number of waiting requests
+}
+
+// the options of the service itself, not given to the compilations
+var (
+	serveJobs     = runtime.NumCPU()
+	serveQueue    = 32
+	serveTimeout  = 2 * time.Minute
+	serveCacheMax = 20
+)
+
+// logMessage is an error found in the log.
+type logMessage struct {
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"` // the line in the source, if known
+}
+
+// compileResponse is the JSON answer of a compilation request.
+type compileResponse struct {
+	Success  bool         `json:"success"`
+	Errors   []logMessage `json:"errors"`
+	Warnings []string     `json:"warnings"`
+	Pages    int          `json:"pages,omitempty"`
+	Output   string       `json:"output"`        // the messages of latex-fast-compile
+	PDF      []byte       `json:"pdf,omitempty"` // base64 encoded
+}
+
+// the errors and their line numbers in the log
+var (
+	reLogError = regexp.MustCompile(`(?m)^! (.*)$`)
+	reLogLine  = regexp.MustCompile(`(?m)^l\.(\d+) `)
+)
+
+// parseErrors return the errors found in the log, with their line numbers.
+func parseErrors(log []byte) (messages []logMessage) {
+	matches := reLogError.FindAllSubmatchIndex(log, -1)
+	for i, match := range matches {
+		message := logMessage{Message: strings.TrimSpace(string(log[match[2]:match[3]]))}
+		// the line number is given after the error, before the next one
+		end := len(log)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		if line := reLogLine.FindSubmatch(log[match[1]:end]); line != nil {
+			message.Line, _ = strconv.Atoi(string(line[1]))
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// serve is the `serve` subcommand: a local HTTP compile service.
+// The options (in the --name=value form) are given to every compilation,
+// and the other parameter is the address to listen on.
+func serve(args []string) error {
+	address := defaultServeAddress
+	service := &compileService{options: []string{"--no-watch", "--no-synctex", "--clear=no", "--info=errors"}}
+	shellOption := false
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		var err error
+		switch name {
+		case "--jobs":
+			serveJobs, err = strconv.Atoi(value)
+		case "--queue":
+			serveQueue, err = strconv.Atoi(value)
+		case "--timeout":
+			serveTimeout, err = time.ParseDuration(value)
+		case "--cache-max":
+			serveCacheMax, err = strconv.Atoi(value)
+		}
+		if err != nil || serveJobs < 1 || serveQueue < 0 || serveTimeout <= 0 || serveCacheMax < 0 {
+			return errors.New("Bad value in " + arg + ".")
+		}
+		if name == "--jobs" || name == "--queue" || name == "--timeout" || name == "--cache-max" {
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			service.options = append(service.options, arg)
+			shellOption = shellOption || strings.HasPrefix(arg, "--shell")
+		} else {
+			address = arg
+		}
+	}
+	// the uploaded documents can't run commands, except if asked
+	if !shellOption {
+		service.options = append(service.options, "--no-shell-escape")
+	}
+	// the warnings of the responses ignore the --suppress-warning warnings
+	if err := parseOptions(service.options); err != nil {
+		return err
+	}
+	var err error
+	if service.self, err = os.Executable(); err != nil {
+		return fmt.Errorf("Problem finding this program: %w", err)
+	}
+	cacheRoot, err := os.UserCacheDir()
+	if err != nil {
+		cacheRoot = os.TempDir()
+	}
+	service.cache = filepath.Join(cacheRoot, "latex-fast-compile", "formats")
+	service.cacheMax = serveCacheMax
+	service.running = make(chan struct{}, serveJobs)
+	service.timeout = serveTimeout
+	service.queueMax = int32(serveQueue)
+	// the log lines are joined like in the compilations
+	texCompiler = "pdftex"
+	setDistro()
+	setLogLineWidth()
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Problem listening on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/compile", service.handleCompile)
+	mux.HandleFunc("/metrics", serveMetrics)
+	info("Serve the compilations on http://" + listener.Addr().String() + "/compile")
+	info("The formats are cached in", service.cache)
+	info(fmt.Sprintf("Up to %d compilations at once, %d waiting requests, %v by compilation.", serveJobs, serveQueue, serveTimeout))
+	return http.Serve(listener, mux)
+}
+
+// handleCompile compile the posted .tex (or .zip project) and answer the result as JSON,
+// or as PDF if the `format=pdf` parameter is given and the compilation succeeded.
+func (s *compileService) handleCompile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Post a .tex or a .zip file.", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		http.Error(w, "Problem reading the request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// wait for a free place, if the queue is not full
+	if atomic.AddInt32(&s.waiting, 1) > s.queueMax+int32(cap(s.running)) {
+		atomic.AddInt32(&s.waiting, -1)
+		http.Error(w, "Too many requests, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case s.running <- struct{}{}:
+	case <-r.Context().Done():
+		atomic.AddInt32(&s.waiting, -1)
+		return
+	}
+	defer func() {
+		<-s.running
+		atomic.AddInt32(&s.waiting, -1)
+	}()
+
+	// every request has its own folder
+	dir, err := os.MkdirTemp("", "latex-fast-compile-request-")
+	if err != nil {
+		http.Error(w, "Problem creating the request folder: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	if err := writeProject(dir, body, r.URL.Query().Get("main")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.compile(r.Context(), dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if response.Success && r.URL.Query().Get("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(response.PDF)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Success {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// compile run the compilation of the project prepared in dir.
+// The formats are shared by the projects with the same preamble, but the other
+// intermediate files (.aux, .toc...) stay in the request folder.
+func (s *compileService) compile(ctx context.Context, dir string) (response compileResponse, err error) {
+	hash, err := projectHash(dir)
+	if err != nil {
+		return response, err
+	}
+	tempFolder := filepath.Join(dir, ".lfc")
+	jobFolder := filepath.Join(tempFolder, serveJobName)
+	if err := os.MkdirAll(jobFolder, 0755); err != nil {
+		return response, err
+	}
+	cached := s.restoreFormat(hash, jobFolder)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	// the magic comments of the uploaded source can't change the folder or the engine options
+	args := append(append([]string{}, s.options...), "--no-magic-comments", "--temp-folder="+tempFolder, serveJobName+".tex")
+	cmd := exec.CommandContext(ctx, s.self, args...)
+	cmd.Dir = dir
+	inProcessGroup(cmd)
+	startTime := time.Now()
+	output, runErr := cmd.CombinedOutput()
+	response.Output = string(output)
+	response.Success = runErr == nil
+	if ctx.Err() == context.DeadlineExceeded {
+		response.Output += fmt.Sprintf("The compilation was stopped after %v.\n", s.timeout)
+	}
+	if response.Success && !cached {
+		s.storeFormat(hash, jobFolder)
+	}
+
+	logName := filepath.Join(jobFolder, serveJobName+".log")
+	if log, err := ioutil.ReadFile(logName); err == nil {
+		log = unwrapLog(log)
+		response.Errors = parseErrors(log)
+		response.Warnings = parseWarnings(log)
+	}
+	pages := -1
+	if response.Success {
+		if pages = logPages(logName); pages > 0 {
+			response.Pages = pages
+		}
+		if response.PDF, err = ioutil.ReadFile(filepath.Join(dir, serveJobName+".pdf")); err != nil {
+			response.Success = false
+			response.Errors = append(response.Errors, logMessage{Message: "No pdf produced."})
+		}
+	}
+	if response.Errors == nil {
+		response.Errors = []logMessage{}
+	}
+	if response.Warnings == nil {
+		response.Warnings = []string{}
+	}
+	if !response.Success {
+		runErr = errors.New("compilation failed")
+	}
+	recordCompile(time.Since(startTime), runErr, pages)
+	return response, nil
+}
+
+// the files of a cached format: the .fmt and the state file (with the preamble warnings)
+var cachedExtensions = []string{"fmt", stateExtension}
+
+// restoreFormat copy the cached format of the preamble hash (if any) to the job folder.
+func (s *compileService) restoreFormat(hash, jobFolder string) bool {
+	cacheFolder := filepath.Join(s.cache, hash)
+	for _, ext := range cachedExtensions {
+		if err := copyInput(filepath.Join(cacheFolder, serveJobName+"."+ext), filepath.Join(jobFolder, serveJobName+"."+ext)); err != nil {
+			return false
+		}
+	}
+	// the recently used formats are the last to be evicted
+	now := time.Now()
+	os.Chtimes(cacheFolder, now, now)
+	return true
+}
+
+// storeFormat copy the new format of the job folder to the cache, and evict the oldest formats.
+// The files are renamed at the end, so a concurrent request never reads a partial file.
+func (s *compileService) storeFormat(hash, jobFolder string) {
+	if s.cacheMax == 0 {
+		return
+	}
+	cacheFolder := filepath.Join(s.cache, hash)
+	if err := os.MkdirAll(cacheFolder, 0755); err != nil {
+		return
+	}
+	for _, ext := range cachedExtensions {
+		name := serveJobName + "." + ext
+		partial := filepath.Join(cacheFolder, fmt.Sprintf(".%s.%d", name, time.Now().UnixNano()))
+		if err := copyInput(filepath.Join(jobFolder, name), partial); err != nil {
+			os.Remove(partial)
+			return
+		}
+		os.Rename(partial, filepath.Join(cacheFolder, name))
+	}
+	s.evictFormats()
+}
+
+// evictFormats remove the least recently used formats, to keep at most cacheMax of them.
+func (s *compileService) evictFormats() {
+	entries, err := os.ReadDir(s.cache)
+	if err != nil {
+		return
+	}
+	folders := []os.FileInfo{}
+	for _, entry := range entries {
+		if fileInfo, err := entry.Info(); err == nil && entry.IsDir() {
+			folders = append(folders, fileInfo)
+		}
+	}
+	if len(folders) <= s.cacheMax {
+		return
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].ModTime().Before(folders[j].ModTime()) })
+	for _, folder := range folders[:len(folders)-s.cacheMax] {
+		info(" evict the cached format", folder.Name())
+		os.RemoveAll(filepath.Join(s.cache, folder.Name()))
+	}
+}
+
+// writeProject write the posted .tex, or extract the posted .zip project, in dir.
+// The main file is copied to document.tex: it is the one given by the main parameter,
+// or the only .tex file of the project root with \documentclass.
+func writeProject(dir string, body []byte, main string) error {
+	if !bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		return ioutil.WriteFile(filepath.Join(dir, serveJobName+".tex"), body, 0644)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return fmt.Errorf("Bad zip file: %w", err)
+	}
+	if len(archive.File) > maxExtractedFiles {
+		return fmt.Errorf("The zip file has more than %d files.", maxExtractedFiles)
+	}
+	// the sizes given by the archive can lie, the extracted bytes are counted
+	budget := int64(maxExtractedSize)
+	candidates := []string{}
+	for _, file := range archive.File {
+		name := filepath.Clean(filepath.FromSlash(file.Name))
+		// no file outside the folder, and no configuration of latex-fast-compile
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) || filepath.Base(name) == configFileName {
+			continue
+		}
+		target := filepath.Join(dir, name)
+		if file.FileInfo().IsDir() {
+			os.MkdirAll(target, 0755)
+			continue
+		}
+		if err := extractFile(file, target, &budget); err != nil {
+			return err
+		}
+		if filepath.Dir(name) == "." && filepath.Ext(name) == ".tex" {
+			if data, err := ioutil.ReadFile(target); err == nil && bytes.Contains(data, []byte(`\documentclass`)) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	if len(main) == 0 {
+		if len(candidates) != 1 {
+			return fmt.Errorf("Can't find the main file in %v, use the main parameter.", candidates)
+		}
+		main = candidates[0]
+	}
+	main = filepath.Clean(filepath.FromSlash(main))
+	if strings.HasPrefix(main, "..") {
+		return errors.New("The main file should be in the project.")
+	}
+	return copyInput(filepath.Join(dir, main), filepath.Join(dir, serveJobName+".tex"))
+}
+
+// extractFile write a file of the zip archive, and remove its size from the budget.
+// It fails when the budget is exceeded.
+func extractFile(file *zip.File, target string, budget *int64) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	in, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Problem reading %s in the zip file: %w", file.Name, err)
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(in, *budget+1))
+	*budget -= n
+	if err == nil && *budget < 0 {
+		return fmt.Errorf("The zip file is larger than %d MB once extracted.", maxExtractedSize>>20)
+	}
+	return err
+}
+
+// projectHash return the hash of what the format depends on: the preamble of the main file,
+// and the packages and classes of the project (.sty, .cls, .cfg and .def files).
+func projectHash(dir string) (string, error) {
+	texdata, err := ioutil.ReadFile(filepath.Join(dir, serveJobName+".tex"))
+	if err != nil {
+		return "", err
+	}
+	preamble := texdata
+	if loc := regexp.MustCompile(defaultSplitPattern).FindIndex(texdata); loc != nil {
+		preamble = texdata[:loc[0]]
+	}
+	hash := sha256.New()
+	hash.Write(preamble)
+	files := []string{}
+	filepath.Walk(dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err == nil && !fileInfo.IsDir() {
+			switch filepath.Ext(path) {
+			case ".sty", ".cls", ".cfg", ".def":
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(dir, name)
+		fmt.Fprintf(hash, "\x00%s\x00", filepath.ToSlash(rel))
+		hash.Write(data)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)[:8]), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		log  string
+		want []logMessage
+	}{
+		{"", nil},
+		{"This is pdfTeX\nOutput written on a.pdf.\n", nil},
+		{
+			"! Undefined control sequence.\nl.12 \\foo\n",
+			[]logMessage{{Message: "Undefined control sequence.", Line: 12}},
+		},
+		{
+			"! Emergency stop.\n<*> a.tex\n",
+			[]logMessage{{Message: "Emergency stop."}},
+		},
+		{
+			"! Missing $ inserted.  \r\n<inserted text>\nl.3 a_\nb\n! Undefined control sequence.\nl.7 \\bar\n",
+			[]logMessage{{Message: "Missing $ inserted.", Line: 3}, {Message: "Undefined control sequence.", Line: 7}},
+		},
+		{
+			// the line of the second error is not given to the first one
+			"! First.\n! Second.\nl.5 x\n",
+			[]logMessage{{Message: "First."}, {Message: "Second.", Line: 5}},
+		},
+		{
+			// a "! " that is not at the start of a line is not an error
+			"text ! not an error\nl.4 x\n",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		if got := parseErrors([]byte(test.log)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseErrors(%q) = %+v, want %+v", test.log, got, test.want)
+		}
+	}
+}
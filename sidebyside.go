@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	engineList []string // the engines of the side by side builds (--engines)
+	engineRun  string   // the engine of this build, if it is one of the side by side builds
+)
+
+// the running side by side builds
+var (
+	engineRunsMu   sync.Mutex
+	engineRuns     []*exec.Cmd
+	engineRunsDone sync.WaitGroup // the builds and the printing of their outputs
+)
+
+// runsEngines check if this process only runs the side by side builds.
+func runsEngines() bool {
+	return len(engineList) > 0 && len(engineRun) == 0
+}
+
+// checkEngineNames check that the engines can be used for side by side builds.
+func checkEngineNames(names []string) error {
+	for _, name := range names {
+		if name != "pdflatex" && name != "xelatex" {
+			return errors.New("Invalid engine " + name + " (use pdflatex or xelatex).")
+		}
+	}
+	return nil
+}
+
+// runEngines build the document with every engine of --engines, side by side.
+// Every build is a new process of this program, with the same parameters and --engine-run,
+// and its output lines are prefixed by the engine name.
+func runEngines() error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Problem finding this program: %w", err)
+	}
+	var printing sync.Mutex
+	failed := []string{}
+	for _, engine := range engineList {
+		cmd := exec.Command(self, append(os.Args[1:], "--engine-run="+engine)...)
+		output, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		cmd.Stderr = cmd.Stdout
+		engineRunsMu.Lock()
+		err = cmd.Start()
+		if err == nil {
+			engineRuns = append(engineRuns, cmd)
+		}
+		engineRunsMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Problem starting the %s build: %w", engine, err)
+		}
+		engineRunsDone.Add(1)
+		go func(engine string, cmd *exec.Cmd, output io.Reader) {
+			defer engineRunsDone.Done()
+			prefix := fmt.Sprintf("[%s] ", engine)
+			scanner := bufio.NewScanner(output)
+			for scanner.Scan() {
+				printing.Lock()
+				fmt.Println(prefix + scanner.Text())
+				printing.Unlock()
+			}
+			if cmd.Wait() != nil {
+				printing.Lock()
+				failed = append(failed, engine)
+				printing.Unlock()
+			}
+		}(engine, cmd, output)
+	}
+	engineRunsDone.Wait()
+	if len(failed) > 0 {
+		return errors.New("The builds with " + strings.Join(failed, ", ") + " failed.")
+	}
+	return nil
+}
+
+// stopEngines interrupt the side by side builds and wait for them.
+func stopEngines() {
+	engineRunsMu.Lock()
+	for _, cmd := range engineRuns {
+		if runtime.GOOS == "windows" {
+			// no interrupt signal on Windows
+			cmd.Process.Kill()
+		} else {
+			cmd.Process.Signal(os.Interrupt)
+		}
+	}
+	engineRuns = nil
+	engineRunsMu.Unlock()
+	engineRunsDone.Wait()
+}
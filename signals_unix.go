@@ -0,0 +1,41 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRequestSignals send the build requests received as signals to the watch loop:
+// SIGUSR1 asks a compilation and SIGUSR2 a compilation with precompile.
+func notifyRequestSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range c {
+			if s == syscall.SIGUSR2 {
+				sendCommand(cmdPrecompile)
+			} else {
+				sendCommand(cmdRebuild)
+			}
+		}
+	}()
+}
+
+// notifyPauseSignals pause the watching on SIGTSTP (Ctrl-Z) and resume it on SIGCONT (see --pause-signals).
+// So Ctrl-Z doesn't suspend the process any more, this is why it must be asked.
+func notifyPauseSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTSTP, syscall.SIGCONT)
+	go func() {
+		for s := range c {
+			if s == syscall.SIGTSTP {
+				sendCommand(cmdPause)
+			} else {
+				sendCommand(cmdResume)
+			}
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// notifyRequestSignals does nothing: there are no user signals on Windows.
+func notifyRequestSignals() {}
+
+// notifyPauseSignals does nothing: the watching is paused by the keys or the socket on Windows.
+func notifyPauseSignals() {}
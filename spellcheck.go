@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	spellLanguage   string // the --spellcheck value: the language, "default" for the one of the tool, "" for no spellcheck
+	spellDictionary string // the --spell-dictionary value: the project words, one by line
+	spellTool       string // hunspell or aspell
+)
+
+// the default project dictionary (in the current folder)
+const defaultSpellDictionary = "latex-fast-compile.dic"
+
+// checkSpellcheck find the spellcheck tool: hunspell, or aspell.
+func checkSpellcheck() error {
+	if len(spellLanguage) == 0 {
+		return nil
+	}
+	for _, tool := range []string{"hunspell", "aspell"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			spellTool = tool
+			return nil
+		}
+	}
+	return errors.New("Can't find hunspell or aspell in the current path (needed by --spellcheck).")
+}
+
+// spellArgs return the arguments of the spellcheck tool, in TeX mode, listing the misspelled words.
+func spellArgs() []string {
+	if spellTool == "hunspell" {
+		args := []string{"-t", "-l"}
+		if spellLanguage != "default" {
+			args = append(args, "-d", spellLanguage)
+		}
+		return args
+	}
+	args := []string{"--mode=tex", "list"}
+	if spellLanguage != "default" {
+		args = append(args, "--lang="+spellLanguage)
+	}
+	return args
+}
+
+// projectWords read the words of the project dictionary (the lines starting with # are comments).
+func projectWords() map[string]bool {
+	words := make(map[string]bool)
+	file, err := os.Open(spellDictionary)
+	if err != nil {
+		return words
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); len(word) > 0 && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// misspellings return the sorted misspelled words of the source (with its \input files),
+// without the words of the project dictionary.
+func misspellings() ([]string, error) {
+	text, err := flattenTeX(inBaseOriginal+".tex", 0)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading the source: %w", err)
+	}
+	cmd := exec.Command(spellTool, spellArgs()...)
+	cmd.Stdin = strings.NewReader(text)
+	if tracing("exec") {
+		fmt.Println(delimit("command", "", quoteArgs(cmd.Args)))
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Problem running %s: %w", spellTool, err)
+	}
+	known := projectWords()
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range strings.Fields(string(output)) {
+		if !known[word] && !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	sort.Strings(words)
+	return words, nil
+}
+
+// wordLine return the first line of the source with the word, or 0.
+func wordLine(lines []string, word string) int {
+	re := regexp.MustCompile(`(^|[^\pL])` + regexp.QuoteMeta(word) + `($|[^\pL])`)
+	for i, line := range lines {
+		if re.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// spellcheck print the misspelled words that are new since the last run
+// (the previous ones are kept in the state file).
+func spellcheck() error {
+	if len(spellLanguage) == 0 {
+		return nil
+	}
+	words, err := misspellings()
+	if err != nil {
+		return atStage("spellcheck", err)
+	}
+	state := loadState()
+	previous := make(map[string]bool)
+	for _, word := range state.Misspellings {
+		previous[word] = true
+	}
+	var added []string
+	for _, word := range words {
+		if !previous[word] {
+			added = append(added, word)
+		}
+	}
+	state.Misspellings = words
+	if err := saveState(state); err != nil && infoLevel >= infoErrors {
+		warning("Problem saving %s: %v", stateFileName(), err)
+	}
+	if len(added) == 0 {
+		if infoLevel >= infoActions {
+			info(fmt.Sprintf("Spellcheck: %d misspelled words, none is new.", len(words)))
+		}
+		return nil
+	}
+	if infoLevel < infoErrors {
+		return nil
+	}
+	warning("Spellcheck: %d misspelled words, %d new (add the good ones to %s):", len(words), len(added), spellDictionary)
+	data, _ := os.ReadFile(inBaseOriginal + ".tex")
+	lines := strings.Split(string(data), "\n")
+	for _, word := range added {
+		if line := wordLine(lines, word); line > 0 {
+			fmt.Printf("  %s (line %d)\n", word, line)
+		} else {
+			fmt.Println(" ", word)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	splitOnlyMode        string // the --split-only value: "files", "stdout", or "" to compile
+	mustKeepIntermediate bool   // keep the split files at the end (--keep-intermediate)
+)
+
+// checkSplitOnly check the --split-only value. Nothing is compiled nor watched in this mode.
+func checkSplitOnly() error {
+	switch splitOnlyMode {
+	case "":
+		return nil
+	case "files", "stdout":
+	default:
+		return errors.New("Invalid --split-only value " + splitOnlyMode + ".")
+	}
+	if len(splitPattern) == 0 {
+		return errors.New("The --split-only option needs a --split pattern.")
+	}
+	mustNoWatch, mustClear = true, false
+	mustKeepIntermediate = mustKeepIntermediate || splitOnlyMode == "files"
+	// only the split files are printed
+	if splitOnlyMode == "stdout" && infoLevel > infoErrors {
+		infoLevel = infoErrors
+	}
+	return nil
+}
+
+// splitOnly split the source without running TeX: the .preamble.tex and .body.tex files
+// are kept (files), or printed and then removed (stdout).
+func splitOnly() error {
+	// the split is done even if the .fmt is not needed (--skip-fmt)
+	mustBuildFormat = true
+	if err := convertMarkdown(); err != nil {
+		return err
+	}
+	if err := splitTeX(); err != nil {
+		return err
+	}
+	if splitOnlyMode == "files" {
+		return nil
+	}
+	fileNames := []string{inBase + ".preamble.tex", inBase + ".body.tex"}
+	if len(baseHash) > 0 {
+		fileNames = append([]string{baseName(inBase) + ".tex"}, fileNames...)
+	}
+	for _, fileName := range fileNames {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return atStage("split", fmt.Errorf("Problem reading %s: %w", fileName, err))
+		}
+		fmt.Println(delimit(fileName, "end "+fileName, string(data)))
+	}
+	return nil
+}
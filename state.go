@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// buildState is the state of the document kept between runs (in the sidecar state file).
+type buildState struct {
+	// the warnings of the last successful full build (precompile or compile of the whole source)
+	PreambleWarnings []string `json:"preambleWarnings,omitempty"`
+	// the misspelled words of the last spellcheck (--spellcheck)
+	Misspellings []string `json:"misspellings,omitempty"`
+	// the hash of the inputs of the last biber or bibtex run (the citations and the .bib files)
+	Bibliography string `json:"bibliography,omitempty"`
+	// the hash of the .idx of the last makeindex or xindy run
+	Index string `json:"index,omitempty"`
+	// the hash of the base preamble in the base format (see --base-split)
+	BaseFormat string `json:"baseFormat,omitempty"`
+	// the origin of the .fmt, to find the outdated ones (see the fmt subcommand)
+	Format *formatState `json:"format,omitempty"`
+}
+
+// the extension of the sidecar state file, stored next to the .fmt
+const stateExtension = "lfc.json"
+
+// the first line of the LaTeX, class and package warnings in the (unwrapped) log
+var reWarning = regexp.MustCompile(`(?m)^(?:LaTeX|Package|Class)(?: \S+)? Warning: .*$`)
+
+// stateFileName return the name of the sidecar state file of the document.
+func stateFileName() string {
+	return outBase + "." + stateExtension
+}
+
+// loadState read the sidecar state file, or return an empty state if there is none.
+func loadState() (state buildState) {
+	data, err := ioutil.ReadFile(stateFileName())
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil && infoLevel >= infoDebug {
+		fmt.Println("Ignore the bad state file", stateFileName()+":", err)
+	}
+	return state
+}
+
+// saveState write the sidecar state file.
+func saveState(state buildState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFileName(), data, 0644)
+}
+
+// logWarnings return the warnings found in the current log (without duplicates).
+func logWarnings() []string {
+	log, err := ioutil.ReadFile(outBase + ".log")
+	if err != nil {
+		return nil
+	}
+	return parseWarnings(log)
+}
+
+// parseWarnings return the warnings found in the log (without duplicates),
+// except the ones suppressed by --suppress-warning.
+func parseWarnings(log []byte) (warnings []string) {
+	seen := make(map[string]bool)
+	for _, warning := range reWarning.FindAllString(string(unwrapLog(log)), -1) {
+		warning = strings.TrimSpace(warning)
+		if !seen[warning] && !isSuppressed(warning) {
+			seen[warning] = true
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// rememberWarnings save the warnings of a successful full build in the state file.
+func rememberWarnings() {
+	state := loadState()
+	state.PreambleWarnings = logWarnings()
+	if err := saveState(state); err != nil && infoLevel >= infoErrors {
+		warning("Problem saving %s: %v", stateFileName(), err)
+	}
+}
+
+// remindWarnings print the warnings of the last full build that are missing in the body-only log,
+// as the preamble is not compiled any more.
+func remindWarnings() {
+	if infoLevel < infoActions {
+		return
+	}
+	current := make(map[string]bool)
+	for _, warning := range logWarnings() {
+		current[warning] = true
+	}
+	var missing []string
+	for _, warning := range loadState().PreambleWarnings {
+		if !current[warning] {
+			missing = append(missing, warning)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	warning("Warnings from the last full build (the preamble is precompiled):")
+	for _, warning := range missing {
+		fmt.Println(" ", warning)
+	}
+}
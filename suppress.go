@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// warningFilters are the built-in filters of --silence: the --suppress-warning regexes of the common harmless warnings.
+var warningFilters = map[string][]string{
+	"microtype":       {`^Package microtype Warning:`},
+	"hyperref-tokens": {`^Package hyperref Warning: Token not allowed in a PDF string`, `^Package hyperref Warning: Option .* has already been used`},
+	"font-shapes":     {`^LaTeX Font Warning: Font shape .* (undefined|in size .* not available)`, `^LaTeX Font Warning: Some font shapes were not available`, `^LaTeX Font Warning: Size substitutions`},
+	"fancyhdr":        {`^Package fancyhdr Warning: \\headheight is too small`},
+	"unused-options":  {`^LaTeX Warning: Unused global option`},
+	"boxes":           {`^(Over|Under)full \\[hv]box`},
+}
+
+var (
+	silenceFilters   []string         // the --silence values: the names of the built-in filters
+	suppressWarnings []string         // the --suppress-warning values: the regexes of the harmless warnings
+	reSuppress       []*regexp.Regexp // the compiled --suppress-warning regexes
+)
+
+// filterNames return the sorted names of the built-in filters.
+func filterNames() []string {
+	names := make([]string, 0, len(warningFilters))
+	for name := range warningFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileSuppress compile the --suppress-warning regexes and the ones of the --silence filters.
+func compileSuppress() error {
+	reSuppress = nil
+	patterns := suppressWarnings
+	for _, name := range silenceFilters {
+		filter, ok := warningFilters[name]
+		if !ok {
+			return errors.New("Unknown --silence filter " + name + " (use " + strings.Join(filterNames(), ", ") + ").")
+		}
+		patterns = append(patterns[:len(patterns):len(patterns)], filter...)
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid --suppress-warning regex %s: %w", pattern, err)
+		}
+		reSuppress = append(reSuppress, re)
+	}
+	return nil
+}
+
+// isSuppressed check if the warning (or the log part) matches one of the --suppress-warning regexes.
+func isSuppressed(text string) bool {
+	for _, re := range reSuppress {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
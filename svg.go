@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+// the --svg value: "" for no SVG, single for the first page only (a figure), pages for a file by page
+var svgMode string
+
+// checkSVG check the --svg value and the presence of dvisvgm.
+func checkSVG() error {
+	switch svgMode {
+	case "":
+		return nil
+	case "single", "pages":
+	default:
+		return errors.New("Invalid --svg value " + svgMode + " (use single or pages).")
+	}
+	if _, err := exec.LookPath("dvisvgm"); err != nil {
+		return errors.New("Can't find dvisvgm in the current path (needed by --svg).")
+	}
+	return nil
+}
+
+// svgFiles return the SVG files made by exportSVG.
+// The pages are named after the output, followed by the page number (like cylinder-2.svg).
+func svgFiles() []string {
+	if svgMode == "single" {
+		return []string{outputBase + ".svg"}
+	}
+	folder := filepath.Dir(outputBase)
+	rePage := regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(outputBase)) + `-\d+\.svg$`)
+	entries, _ := os.ReadDir(folder)
+	pages := []string{}
+	for _, entry := range entries {
+		if rePage.MatchString(entry.Name()) {
+			pages = append(pages, filepath.Join(folder, entry.Name()))
+		}
+	}
+	return pages
+}
+
+// exportSVG convert the output to SVG with dvisvgm (if asked): the .dvi (or .xdv) with --output-format=dvi,
+// else the .pdf. The glyphs are converted to paths, as the browsers don't know the SVG fonts.
+func exportSVG() error {
+	if len(svgMode) == 0 {
+		return nil
+	}
+	input := outputBase + "." + outputExtension()
+	args := []string{"--no-fonts"}
+	if outputExtension() == "pdf" {
+		args = append(args, "--pdf")
+	}
+	if svgMode == "single" {
+		if pages := logPages(outBase + ".log"); pages > 1 && infoLevel >= infoErrors {
+			warning("Only the first of the %d pages is converted to SVG (see --svg=pages).", pages)
+		}
+		args = append(args, "--page=1", "--output="+outputBase+".svg")
+	} else {
+		// the pages of a longer previous version are outdated
+		for _, page := range svgFiles() {
+			os.Remove(page)
+		}
+		args = append(args, "--page=1-", "--output="+outputBase+"-%p.svg")
+	}
+	if err := runTool("Convert "+input+" to SVG", "dvisvgm", append(args, input)...); err != nil {
+		return atStage("svg", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gitCommand run git in the folder and return its output, without the final new line.
+func gitCommand(folder string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = folder
+	if tracing("exec") {
+		fmt.Println(delimit("command", "", quoteArgs(cmd.Args)))
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w\n%s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+// isSyncedFile check if the file should be pushed: the outputs, the intermediate files
+// and the files of latex-fast-compile are not.
+func isSyncedFile(fileName string) bool {
+	base := filepath.Base(fileName)
+	return !isGenerated(fileName) && !strings.HasSuffix(base, "."+stateExtension) && base != triggerFileName &&
+		!strings.HasSuffix(base, ".preamble.tex") && !strings.HasSuffix(base, ".body.tex")
+}
+
+// localChanges return the changed and the new files of the project that should be pushed.
+func localChanges(folder string) ([]string, error) {
+	output, err := gitCommand(folder, "status", "--porcelain", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	changes := []string{}
+	entries := strings.Split(output, "\x00")
+	for i := 0; i < len(entries); i++ {
+		if len(entries[i]) < 4 {
+			continue
+		}
+		status, fileName := entries[i][:2], entries[i][3:]
+		if strings.ContainsAny(status, "RC") {
+			// the original name of a renamed (or copied) file is the next entry
+			i++
+		}
+		if isSyncedFile(fileName) {
+			changes = append(changes, fileName)
+		}
+	}
+	return changes, nil
+}
+
+// pullProject pull the remote changes and tell if there were any.
+func pullProject(folder, remote string) (bool, error) {
+	before, _ := gitCommand(folder, "rev-parse", "HEAD")
+	if _, err := gitCommand(folder, "pull", "--rebase", "--autostash", remote); err != nil {
+		return false, err
+	}
+	after, err := gitCommand(folder, "rev-parse", "HEAD")
+	return before != after, err
+}
+
+// pushProject commit the local changes and push the local commits.
+func pushProject(folder, remote string, changes []string) error {
+	if len(changes) > 0 {
+		if _, err := gitCommand(folder, append([]string{"add", "--all", "--"}, changes...)...); err != nil {
+			return err
+		}
+		message := "Sync from latex-fast-compile on " + time.Now().Format("2006-01-02 15:04")
+		if _, err := gitCommand(folder, "commit", "--message="+message); err != nil {
+			return err
+		}
+	}
+	// the commits missing in the last fetched remote head
+	ahead, err := gitCommand(folder, "rev-list", "--count", "FETCH_HEAD..HEAD")
+	if err != nil || ahead == "0" {
+		return err
+	}
+	info(" push", ahead, "commit(s) to", remote)
+	_, err = gitCommand(folder, "push", remote, "HEAD")
+	return err
+}
+
+// compileProject compile the main file with this program, without watching.
+// The build is strict if it has no warnings, in the log found like the compilation does (see jobBase and jobFolder).
+// Without log nothing tells that there is no warning, so the build is not strict.
+func compileProject(options []string, source string) (success, strict bool) {
+	self, err := os.Executable()
+	if err != nil {
+		reportError(fmt.Errorf("Problem finding this program: %w", err))
+		return false, false
+	}
+	cmd := exec.Command(self, append(append(options, "--no-watch"), source)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if cmd.Run() != nil {
+		return false, false
+	}
+	mustNoNormalize = normalizeMode == "none"
+	logBase := jobBase(strings.TrimSuffix(source, ".tex"))
+	if folder := jobFolder(logBase); len(folder) > 0 {
+		logBase = filepath.Join(folder, logBase)
+	}
+	log, err := ioutil.ReadFile(logBase + ".log")
+	if err != nil {
+		if infoLevel >= infoErrors {
+			warning("Problem reading %s (%v), the build is not strict.", logBase+".log", err)
+		}
+		return true, false
+	}
+	return true, len(parseWarnings(log)) == 0
+}
+
+// syncProject is the `sync` subcommand. It keeps the project in sync with a git remote (like Overleaf):
+// the remote changes are pulled and compiled, and with --push the local changes
+// are pushed, but only after a successful compilation without warnings (a strict build).
+func syncProject(args []string) error {
+	remote, source := "", ""
+	every := time.Minute
+	mustPush, mustCompile, once, allowWarnings := false, true, false, false
+	options := []string{}
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "--remote":
+			remote = value
+		case "--every":
+			var err error
+			if every, err = time.ParseDuration(value); err != nil || every <= 0 {
+				return errors.New("Bad duration in " + arg + ".")
+			}
+		case "--push":
+			mustPush = true
+		case "--no-compile":
+			mustCompile = false
+		case "--allow-warnings":
+			allowWarnings = true
+		case "--once":
+			once = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				options = append(options, arg)
+			} else {
+				source = strings.TrimSuffix(arg, ".tex") + ".tex"
+			}
+		}
+	}
+	if len(remote) == 0 {
+		return errors.New("The --remote=<git url> option is needed.")
+	}
+	if len(source) == 0 {
+		return errors.New("You should provide the main .tex file of the project.")
+	}
+	// the strict builds ignore the --suppress-warning warnings
+	if err := parseOptions(options); err != nil {
+		return err
+	}
+	auxExtensions = defaultAuxExtensions
+
+	// clone the project in a new (or empty) folder
+	folder := filepath.Dir(source)
+	if isFolderMissing(filepath.Join(folder, ".git")) {
+		if entries, _ := os.ReadDir(folder); len(entries) > 0 {
+			return errors.New("The folder " + folder + " is not a git repository, and it is not empty.")
+		}
+		info("Clone", remote, "to", folder)
+		if _, err := gitCommand(".", "clone", remote, folder); err != nil {
+			return err
+		}
+	}
+
+	for first := true; ; first = false {
+		pulled, err := pullProject(folder, remote)
+		if err != nil {
+			reportError(atStage("pull", err))
+		} else if pulled {
+			info("New changes pulled from", remote)
+		}
+		changes, err := localChanges(folder)
+		if err != nil {
+			reportError(atStage("sync", err))
+		}
+		compiled := !mustCompile
+		if mustCompile && (first || pulled || len(changes) > 0) {
+			success, strict := compileProject(options, source)
+			compiled = success && (strict || allowWarnings)
+			if mustPush && !success {
+				info("The compilation failed, nothing is pushed.")
+			} else if mustPush && !compiled {
+				info("The compilation has warnings, nothing is pushed.")
+			}
+		}
+		if mustPush && compiled {
+			if err := pushProject(folder, remote, changes); err != nil {
+				reportError(atStage("push", err))
+			}
+		}
+		if once {
+			return nil
+		}
+		time.Sleep(every)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// usesTectonic check if the document is compiled by tectonic.
+// Tectonic can't dump a format: the whole source is always compiled,
+// and tectonic reruns the engine (and bibtex) by itself until the output is stable.
+func usesTectonic() bool {
+	return texCompiler == "tectonic"
+}
+
+// tectonicBase return the base name of the tectonic outputs.
+// Tectonic has no job name: its outputs are named after the compiled source.
+func tectonicBase() string {
+	return filepath.Join(outFolder, strings.TrimSuffix(filepath.Base(fullSourceName()), ".tex"))
+}
+
+// engineLog return the name of the log written by the engine.
+func engineLog() string {
+	if usesTectonic() {
+		return tectonicBase() + ".log"
+	}
+	return outBase + ".log"
+}
+
+// tectonicOptions return the tectonic command line (the V1 interface, known by all versions)
+// with the extra options given by --option and --compile-option.
+// The intermediate files are kept to be reused by the next compilation while watching.
+func tectonicOptions(extra []string) []string {
+	options := []string{"--keep-logs", "--keep-intermediates", "--chatter", "minimal"}
+	if !mustNotSync {
+		options = append(options, "--synctex")
+	}
+	if len(outFolder) > 0 {
+		options = append(options, "--outdir", outFolder)
+	}
+	// the shell escape is disabled by default, and there is no restricted variant
+	if mustNoShellEscape || mustShellRestrict || len(shellAllow) > 0 {
+		extra = removeShellOptions(extra)
+		if !mustNoShellEscape && infoLevel >= infoErrors {
+			warning("Tectonic has no restricted shell escape, it is disabled.")
+		}
+		options = append(options, distro.noShellEscape)
+	}
+	options = append(options, outputFormatOptions()...)
+	options = append(options, extra...)
+	return append(options, fullSourceName())
+}
+
+// collectTectonicOutput rename the tectonic outputs to the job name, like the other engines,
+// and decompress the .synctex.gz (tectonic can't write an uncompressed one).
+func collectTectonicOutput() error {
+	base := tectonicBase()
+	if base != outBase {
+		for _, ext := range []string{"." + outputExtension(), ".log"} {
+			if isFileMissing(base + ext) {
+				continue
+			}
+			info(" move", base+ext, "to", outBase+ext)
+			if err := moveFile(base+ext, outBase+ext); err != nil {
+				return err
+			}
+		}
+	}
+	if mustNotSync || isFileMissing(base+".synctex.gz") {
+		return nil
+	}
+	info(" decompress", base+".synctex.gz", "to", outBase+".synctex")
+	if err := gunzipFile(base+".synctex.gz", outBase+".synctex"); err != nil {
+		return fmt.Errorf("Problem decompressing %s: %w", base+".synctex.gz", err)
+	}
+	os.Remove(base + ".synctex.gz")
+	return nil
+}
+
+// gunzipFile decompress the src gzip file to dst.
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// clearTectonic clear the intermediate files kept by tectonic,
+// if they are not named after the job (see tectonicBase).
+func clearTectonic() {
+	if base := tectonicBase(); usesTectonic() && base != outBase {
+		clearFiles(base, safeExtensions(base, auxExtensions+",log"))
+	}
+}
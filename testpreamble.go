@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the trivial body compiled against the preamble: some text, a section and the cross references
+const testBody = `\begin{document}
+Test of the precompiled preamble, \today.
+\section{Section}\label{lfc-test-section}
+See section~\ref{lfc-test-section} on page~\pageref{lfc-test-section}.
+\end{document}
+`
+
+// the package (or class) of a warning
+var reWarningPackage = regexp.MustCompile(`^(?:Package|Class) (\S+) Warning:`)
+
+// the preamble lines loading packages
+var reLoadPackage = regexp.MustCompile(`\\(?:usepackage|RequirePackage)\s*(?:\[[^\]]*\])?\s*\{([^}]*)\}`)
+
+// testRun is the result of a compilation of the test document.
+type testRun struct {
+	success  bool
+	output   string   // the output of this program (with the errors)
+	pages    int      // -1 if unknown
+	text     string   // the text of the .pdf (if pdftotext is available)
+	warnings []string // the LaTeX, class and package warnings
+}
+
+// preambleTester compile the test documents in a hidden folder next to the source.
+type preambleTester struct {
+	self    string   // this program
+	folder  string   // the source folder, where the engine runs
+	tests   string   // the test folder, relative to the source folder
+	options []string // the options given to the compilations
+	count   int      // the number of test documents
+}
+
+// compile compile the preamble with the trivial body, with the precompiled preamble (fast) or without (plain).
+func (t *preambleTester) compile(preamble string, fast bool) (run testRun, err error) {
+	t.count++
+	base := filepath.Join(t.tests, fmt.Sprintf("test-%d", t.count))
+	if err := ioutil.WriteFile(filepath.Join(t.folder, base+".tex"), []byte(preamble+"\n"+testBody), 0644); err != nil {
+		return run, fmt.Errorf("Problem writing the test document: %w", err)
+	}
+	// two compilations resolve the cross references
+	args := append([]string{}, t.options...)
+	args = append(args, "--no-watch", "--no-synctex", "--clear=no", "--temp-folder=", "--compiles-at-start=2", "--info=errors")
+	if !fast {
+		args = append(args, "--skip-fmt")
+	}
+	cmd := exec.Command(t.self, append(args, base+".tex")...)
+	cmd.Dir = t.folder
+	output, runErr := cmd.CombinedOutput()
+	run.success, run.output = runErr == nil, strings.TrimSpace(string(output))
+	base = filepath.Join(t.folder, base)
+	run.pages = logPages(base + ".log")
+	if log, err := ioutil.ReadFile(base + ".log"); err == nil {
+		run.warnings = parseWarnings(log)
+	}
+	run.text, _ = pdfText(base + ".pdf")
+	return run, nil
+}
+
+// differ compile the test document with and without the precompiled preamble,
+// and return the first difference found (or "").
+func (t *preambleTester) differ(preamble string) (difference string, fast, plain testRun, err error) {
+	if fast, err = t.compile(preamble, true); err != nil {
+		return "", fast, plain, err
+	}
+	if plain, err = t.compile(preamble, false); err != nil {
+		return "", fast, plain, err
+	}
+	switch {
+	case fast.success != plain.success:
+		if fast.success {
+			return "the plain compilation fails, but not the fast one", fast, plain, nil
+		}
+		return "the fast compilation fails, but not the plain one", fast, plain, nil
+	case fast.pages != plain.pages:
+		return fmt.Sprintf("the fast output has %d pages, but the plain one has %d", fast.pages, plain.pages), fast, plain, nil
+	}
+	if line, fastLine, plainLine := firstDifference(fast.text, plain.text); line > 0 {
+		return fmt.Sprintf("the outputs differ at text line %d (fast: %q, plain: %q)", line, fastLine, plainLine), fast, plain, nil
+	}
+	return "", fast, plain, nil
+}
+
+// warningDifferences return the warnings of only one of the lists.
+func warningDifferences(warnings, others []string) (only []string) {
+	known := make(map[string]bool)
+	for _, warning := range others {
+		known[warning] = true
+	}
+	for _, warning := range warnings {
+		if !known[warning] {
+			only = append(only, warning)
+		}
+	}
+	return only
+}
+
+// warningPackages return the sorted packages (and classes) of the warnings.
+func warningPackages(warnings []string) (packages []string) {
+	seen := make(map[string]bool)
+	for _, warning := range warnings {
+		if match := reWarningPackage.FindStringSubmatch(warning); match != nil && !seen[match[1]] {
+			seen[match[1]] = true
+			packages = append(packages, match[1])
+		}
+	}
+	sort.Strings(packages)
+	return packages
+}
+
+// testPreamble is the `test-preamble` subcommand: it checks that the preamble can be trusted to be precompiled.
+// A trivial body is compiled with the precompiled preamble and with a plain compilation, and the outputs are compared.
+// If they differ, the first package line that makes them differ is searched by bisection.
+func testPreamble(args []string) error {
+	options := []string{}
+	source := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			options = append(options, arg)
+		} else {
+			source = strings.TrimSuffix(nativePath(arg), ".tex") + ".tex"
+		}
+	}
+	if len(source) == 0 {
+		return errors.New("You should provide the .tex file with the preamble to test.")
+	}
+	// the split pattern can be set by the configuration files and the options
+	if err := parseOptions(options); err != nil {
+		return err
+	}
+	if len(splitPattern) == 0 {
+		return errors.New("The preamble can't be tested without a --split pattern.")
+	}
+	reSplit, err := regexp.Compile(splitPattern)
+	if err != nil {
+		return fmt.Errorf("Invalid --split regex: %w", err)
+	}
+	texdata, err := ioutil.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", source, err)
+	}
+	loc := reSplit.FindIndex(texdata)
+	if loc == nil {
+		return errors.New("The end of the preamble is not found in " + source + ".")
+	}
+	preamble := strings.TrimRight(string(texdata[:loc[0]]), " \t\r\n")
+
+	tester := &preambleTester{options: options, folder: filepath.Dir(source)}
+	if tester.self, err = os.Executable(); err != nil {
+		return fmt.Errorf("Problem finding this program: %w", err)
+	}
+	tests, err := os.MkdirTemp(tester.folder, ".lfc-test-")
+	if err != nil {
+		return fmt.Errorf("Problem creating the test folder: %w", err)
+	}
+	defer os.RemoveAll(tests)
+	if tester.tests, err = filepath.Rel(tester.folder, tests); err != nil {
+		return err
+	}
+
+	info("Test the preamble of " + source + " with a trivial body.")
+	difference, fast, plain, err := tester.differ(preamble)
+	if err != nil {
+		return err
+	}
+	if !fast.success && !plain.success {
+		return fmt.Errorf("The test document can't be compiled:\n%s", fast.output)
+	}
+	if len(plain.text) == 0 && len(difference) == 0 {
+		info("pdftotext is not available: only the number of pages is compared.")
+	}
+	// the packages complaining only with (or only without) the precompiled preamble
+	fastOnly, plainOnly := warningDifferences(fast.warnings, plain.warnings), warningDifferences(plain.warnings, fast.warnings)
+	for _, only := range []struct {
+		warnings []string
+		message  string
+	}{{fastOnly, "Warnings only with the precompiled preamble:"}, {plainOnly, "Warnings only without the precompiled preamble:"}} {
+		if len(only.warnings) > 0 {
+			warning(only.message)
+			for _, w := range only.warnings {
+				fmt.Println(" ", w)
+			}
+		}
+	}
+	suspects := warningPackages(append(fastOnly, plainOnly...))
+
+	if len(difference) > 0 {
+		warning("With the precompiled preamble %s.", difference)
+		// the first package line that makes the outputs differ
+		lines := strings.Split(preamble, "\n")
+		packageLines := []int{}
+		for i, line := range lines {
+			if reLoadPackage.MatchString(line) {
+				packageLines = append(packageLines, i)
+			}
+		}
+		if len(packageLines) > 0 {
+			info(fmt.Sprintf("Search the package that makes the difference (among %d lines)...", len(packageLines)))
+			low, high := 0, len(packageLines)
+			for low < high {
+				middle := (low + high) / 2
+				d, _, _, err := tester.differ(strings.Join(lines[:packageLines[middle]+1], "\n"))
+				if err != nil {
+					return err
+				}
+				if len(d) > 0 {
+					high = middle
+				} else {
+					low = middle + 1
+				}
+			}
+			if low < len(packageLines) {
+				line := lines[packageLines[low]]
+				warning("The difference starts with the line %d: %s", packageLines[low]+1, strings.TrimSpace(line))
+				for _, name := range strings.Split(reLoadPackage.FindStringSubmatch(line)[1], ",") {
+					suspects = append(suspects, strings.TrimSpace(name))
+				}
+			} else {
+				warning("The difference is not made by a package line.")
+			}
+		}
+	}
+
+	if len(suspects) == 0 {
+		info("The fast and the plain outputs are the same: the precompiled preamble can be trusted.")
+		return nil
+	}
+	sort.Strings(suspects)
+	unique := suspects[:0]
+	for i, name := range suspects {
+		if i == 0 || name != suspects[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	if len(difference) == 0 {
+		warning("The outputs are the same, but the warnings differ.")
+	}
+	return fmt.Errorf("These packages behave differently when precompiled: %s (load them after the %% end preamble line).", strings.Join(unique, ", "))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+var (
+	themeSettings []string // the --theme values (key=value)
+	mustUseASCII  bool     // use only ASCII symbols
+)
+
+// the colors of the messages
+var (
+	themeAction  = color.New(color.Reset)   // the action lines ("::::::: Compile...")
+	themeSuccess = color.New(color.FgGreen) // the successful end of an action
+	themeError   = color.New(color.FgRed)   // the errors
+	themeWarning = color.New(color.FgYellow)
+	themeWatch   = color.New(color.FgCyan) // the watching banners
+)
+
+// the prefix of the action lines
+var actionPrefix = "::::::: "
+
+// the symbols of the build states (for the error reports and the status)
+var (
+	symbolSuccess = "✔"
+	symbolFailure = "✖"
+	symbolBusy    = "⟳"
+)
+
+// the color names accepted in the theme
+var colorNames = map[string]color.Attribute{
+	"black":     color.FgBlack,
+	"red":       color.FgRed,
+	"green":     color.FgGreen,
+	"yellow":    color.FgYellow,
+	"blue":      color.FgBlue,
+	"magenta":   color.FgMagenta,
+	"cyan":      color.FgCyan,
+	"white":     color.FgWhite,
+	"bold":      color.Bold,
+	"faint":     color.Faint,
+	"italic":    color.Italic,
+	"underline": color.Underline,
+	"none":      color.Reset,
+}
+
+// parseColor convert a list of color names (like "bold red") to a color.
+// The "hi-" prefix selects the high intensity variant (like "hi-red").
+func parseColor(value string) (*color.Color, error) {
+	var attributes []color.Attribute
+	for _, name := range strings.Fields(strings.ReplaceAll(strings.ToLower(value), "+", " ")) {
+		hi := strings.HasPrefix(name, "hi-")
+		attribute, ok := colorNames[strings.TrimPrefix(name, "hi-")]
+		if !ok {
+			return nil, errors.New("Unknown color " + name + ".")
+		}
+		if hi && attribute >= color.FgBlack && attribute <= color.FgWhite {
+			attribute += color.FgHiBlack - color.FgBlack
+		}
+		attributes = append(attributes, attribute)
+	}
+	if len(attributes) == 0 {
+		return nil, errors.New("Empty color.")
+	}
+	return color.New(attributes...), nil
+}
+
+// setTheme apply the --theme settings and the --ascii mode.
+func setTheme() error {
+	if mustUseASCII {
+		symbolSuccess, symbolFailure, symbolBusy = "OK", "X", "*"
+	}
+	colors := map[string]**color.Color{
+		"action":  &themeAction,
+		"success": &themeSuccess,
+		"error":   &themeError,
+		"warning": &themeWarning,
+		"watch":   &themeWatch,
+	}
+	symbols := map[string]*string{
+		"prefix": &actionPrefix,
+		"ok":     &symbolSuccess,
+		"fail":   &symbolFailure,
+		"busy":   &symbolBusy,
+	}
+	for _, setting := range themeSettings {
+		key, value, ok := strings.Cut(setting, "=")
+		key = strings.TrimSpace(key)
+		if !ok {
+			return errors.New("Bad theme setting " + setting + " (should be key=value).")
+		}
+		if c, ok := colors[key]; ok {
+			newColor, err := parseColor(value)
+			if err != nil {
+				return fmt.Errorf("Bad theme color for %s: %w", key, err)
+			}
+			*c = newColor
+			continue
+		}
+		if s, ok := symbols[key]; ok {
+			// the prefix and symbols can be quoted to keep the spaces
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if mustUseASCII && !isASCII(value) {
+				return errors.New("The theme " + key + " is not ASCII (--ascii is used).")
+			}
+			*s = value
+			continue
+		}
+		return errors.New("Unknown theme key " + key + ".")
+	}
+	return nil
+}
+
+// isASCII check if the string contains only ASCII characters.
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// warning print a colored warning message (with a new line).
+func warning(format string, a ...interface{}) {
+	themeWarning.Printf(format+"\n", a...)
+}
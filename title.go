@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+// the --set-title value: "" (do not set), "terminal" or "tmux" (terminal and tmux window)
+var titleMode string
+
+// is the title set (the flag is used and the output is a terminal)
+var mustSetTitle bool
+
+// the symbol and the state of the last title (restored at the end of a pause),
+// set by the jobs and read by the watch loop (see currentTitle)
+var (
+	lastTitleMu sync.Mutex
+	lastTitle   [2]string
+)
+
+// currentTitle return the symbol and the state of the last title.
+func currentTitle() [2]string {
+	lastTitleMu.Lock()
+	defer lastTitleMu.Unlock()
+	return lastTitle
+}
+
+// setTitleMode check the --set-title value, and save the current terminal title.
+func setTitleMode() error {
+	switch titleMode {
+	case "":
+		return nil
+	case "terminal", "tmux":
+	default:
+		return errors.New("Invalid --set-title value " + titleMode + ".")
+	}
+	mustSetTitle = isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd())
+	if mustSetTitle {
+		// push the current title on the xterm title stack, restored by restoreTitle
+		fmt.Print("\033[22;0t")
+	}
+	return nil
+}
+
+// setTitle display the build state (symbol and optional state) of the document in the terminal title
+// (and in the tmux window name if asked).
+func setTitle(symbol, state string) {
+	lastTitleMu.Lock()
+	lastTitle = [2]string{symbol, state}
+	lastTitleMu.Unlock()
+	if !mustSetTitle {
+		return
+	}
+	title := symbol + " " + inBaseOriginal + ".tex"
+	if len(state) > 0 {
+		title += " " + state
+	}
+	fmt.Print("\033]0;" + title + "\007")
+	if titleMode == "tmux" && len(os.Getenv("TMUX")) > 0 {
+		exec.Command("tmux", "rename-window", title).Run()
+	}
+}
+
+// titleResult display the result of the build in the title.
+func titleResult(err error) {
+	if err != nil {
+		setTitle(symbolFailure, "errors")
+	} else {
+		setTitle(symbolSuccess, "")
+	}
+}
+
+// restoreTitle restore the title saved by setTitleMode.
+func restoreTitle() {
+	if !mustSetTitle {
+		return
+	}
+	fmt.Print("\033[23;0t")
+	if titleMode == "tmux" && len(os.Getenv("TMUX")) > 0 {
+		exec.Command("tmux", "set-window-option", "automatic-rename", "on").Run()
+	}
+	mustSetTitle = false
+}
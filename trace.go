@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the trace categories, for focused debug logs (the debug info level traces all of them)
+var traceCategories = []struct {
+	name string
+	what string
+}{
+	{"watch", "the watched files and folders, and the file system events"},
+	{"exec", "the commands run, with the environment of the engine"},
+	{"split", "the split of the source and the changes made to the preamble and the body"},
+	{"synctex", "the moves and the changes of the .synctex"},
+}
+
+var (
+	traceFlag []string        // the --trace values
+	traced    map[string]bool // the traced categories
+)
+
+// traceNames return the names of the trace categories, for the help message.
+func traceNames() string {
+	names := []string{}
+	for _, c := range traceCategories {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, "|")
+}
+
+// setTrace check the --trace categories (all for every one).
+func setTrace() error {
+	traced = map[string]bool{}
+	for _, name := range traceFlag {
+		name = strings.TrimSpace(name)
+		known := name == "all"
+		for _, c := range traceCategories {
+			if name == c.name || name == "all" {
+				traced[c.name] = true
+				known = true
+			}
+		}
+		if !known {
+			return errors.New("Invalid --trace category " + name + " (use " + strings.ReplaceAll(traceNames(), "|", ", ") + " or all).")
+		}
+	}
+	return nil
+}
+
+// tracing check if the category is traced, by --trace or by the debug info level.
+func tracing(category string) bool {
+	return infoLevel == infoDebug || traced[category]
+}
+
+// trace print the message, prefixed by its category, if the category is traced.
+// The traces are printed whatever the info level.
+func trace(category string, message ...interface{}) {
+	if tracing(category) {
+		fmt.Println(append([]interface{}{"[" + category + "]"}, message...)...)
+	}
+}
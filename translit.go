@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// the letters that are not a Latin letter with marks, and their ASCII equivalents
+// (the Latin letters with marks are simply stripped by normalizeName)
+var translitTable = map[rune]string{
+	// Latin
+	'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ı': "i", 'ŋ': "ng", 'Ŋ': "Ng",
+	// Cyrillic
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'ґ': "g", 'д': "d", 'е': "e", 'ё': "yo", 'є': "ye",
+	'ж': "zh", 'з': "z", 'и': "i", 'і': "i", 'ї': "yi", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh",
+	'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e",
+	'ю': "yu", 'я': "ya",
+	// Greek
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// transliterate replace the letters of translitTable by their ASCII equivalents.
+// The letters with marks (like ό) are found by their base letter,
+// and the capital letters by their lower case (the result is then capitalized).
+func transliterate(name string) string {
+	var result strings.Builder
+	for _, r := range name {
+		if ascii, ok := translitLetter(r); ok {
+			result.WriteString(ascii)
+		} else if ascii, ok := translitLetter([]rune(norm.NFD.String(string(r)))[0]); ok {
+			result.WriteString(ascii)
+		} else {
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
+
+// translitLetter return the ASCII equivalent of the letter, if it is in translitTable.
+func translitLetter(r rune) (string, bool) {
+	if ascii, ok := translitTable[r]; ok {
+		return ascii, true
+	}
+	lower := unicode.ToLower(r)
+	ascii, ok := translitTable[lower]
+	if ok && lower != r && len(ascii) > 0 {
+		ascii = strings.ToUpper(ascii[:1]) + ascii[1:]
+	}
+	return ascii, ok
+}
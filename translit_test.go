@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"", ""},
+		{"main", "main"},
+		{"thèse", "thèse"}, // the marks are removed by normalizeName
+		{"Straße", "Strasse"},
+		{"ẞ", "SS"},
+		{"Œuvre", "OEuvre"},
+		{"Łódź", "Lódź"},
+		{"Москва", "Moskva"},
+		{"Щука", "Shchuka"},
+		{"объём", "obyom"},
+		{"Ёж", "Yozh"},
+		{"λόγος", "logos"},
+		{"Ψυχή", "Psychi"},
+		{"日本語", "日本語"},
+		{"a b-c.tex", "a b-c.tex"},
+	}
+	for _, test := range tests {
+		if got := transliterate(test.name); got != test.want {
+			t.Errorf("transliterate(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeNameTranslit(t *testing.T) {
+	defer func(mode string) { normalizeMode = mode }(normalizeMode)
+	normalizeMode = "translit"
+	tests := []struct {
+		name, want string
+	}{
+		{"thèse finale", "thesefinale"},
+		{"Łódź", "Lodz"},
+		{"Ελληνικά", "Ellinika"},
+	}
+	for _, test := range tests {
+		if got := normalizeName(test.name); got != test.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
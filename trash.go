@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the --clear-to-trash value: "" to remove the cleared files,
+// os to move them to the trash of the system, folder to move them to the trash folder
+var trashMode string
+
+// the trash folder, in the current folder, used when the trash of the system can't be
+const trashFolder = ".lfc-trash"
+
+// checkTrashMode check the --clear-to-trash value.
+func checkTrashMode() error {
+	switch trashMode {
+	case "", "os", "folder":
+		return nil
+	}
+	return errors.New("Invalid --clear-to-trash value " + trashMode + " (use os or folder).")
+}
+
+// removeFile remove a cleared file, or move it to the trash with --clear-to-trash.
+func removeFile(fileName string) {
+	if len(trashMode) == 0 {
+		if infoLevel >= infoActions {
+			info(" remove", fileName)
+		}
+		os.Remove(fileName)
+		return
+	}
+	if trashMode == "os" {
+		err := moveToSystemTrash(fileName)
+		if err == nil {
+			if infoLevel >= infoActions {
+				info(" trash", fileName)
+			}
+			return
+		}
+		if infoLevel >= infoDebug {
+			info(" no system trash for", fileName+":", err.Error())
+		}
+	}
+	trashed, err := moveToTrashFolder(fileName)
+	if err != nil {
+		if infoLevel >= infoErrors {
+			warning("Can't move %s to the trash, it is not cleared: %v", fileName, err)
+		}
+		return
+	}
+	if infoLevel >= infoActions {
+		info(" move", fileName, "to", trashed)
+	}
+}
+
+// moveToTrashFolder move the file to the trash folder, under a free name.
+func moveToTrashFolder(fileName string) (string, error) {
+	if err := os.MkdirAll(trashFolder, 0755); err != nil {
+		return "", err
+	}
+	trashed := freeName(trashFolder, filepath.Base(fileName))
+	if err := os.Rename(fileName, trashed); err == nil {
+		return trashed, nil
+	}
+	// the file is on another device (like a temp folder)
+	if err := copyFile(fileName, trashed); err != nil {
+		return "", err
+	}
+	return trashed, os.Remove(fileName)
+}
+
+// freeName return the path of a missing file in the folder: the name, or the name followed by .1, .2...
+func freeName(folder, name string) string {
+	path := filepath.Join(folder, name)
+	for i := 1; !isFileMissing(path); i++ {
+		path = filepath.Join(folder, name+"."+strconv.Itoa(i))
+	}
+	return path
+}
+
+// moveToSystemTrash move the file to the trash of the system:
+// the freedesktop.org trash of the user, the macOS ~/.Trash, or the Windows recycle bin.
+// The file is not copied: it must be on the same device as the trash.
+func moveToSystemTrash(fileName string) error {
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+	switch runtime.GOOS {
+	case "windows":
+		// the recycle bin is available only through the shell API
+		quoted := "'" + strings.ReplaceAll(absName, "'", "''") + "'"
+		script := "Add-Type -AssemblyName Microsoft.VisualBasic; [Microsoft.VisualBasic.FileIO.FileSystem]::DeleteFile(" + quoted + ", 'OnlyErrorDialogs', 'SendToRecycleBin')"
+		if output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		trash := filepath.Join(home, ".Trash")
+		if isFolderMissing(trash) {
+			return errors.New("no " + trash + " folder")
+		}
+		return os.Rename(absName, freeName(trash, filepath.Base(absName)))
+	}
+	return moveToFreedesktopTrash(absName)
+}
+
+// moveToFreedesktopTrash move the file to the trash of the user ($XDG_DATA_HOME/Trash),
+// with the .trashinfo file needed to restore it from the file managers.
+func moveToFreedesktopTrash(absName string) error {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if len(dataHome) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	trash := filepath.Join(dataHome, "Trash")
+	for _, folder := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(trash, folder), 0700); err != nil {
+			return err
+		}
+	}
+	// the .trashinfo is created first: it reserves the name
+	name := filepath.Base(absName)
+	for i := 1; ; i++ {
+		infoName := filepath.Join(trash, "info", name+".trashinfo")
+		infoFile, err := os.OpenFile(infoName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, os.ErrExist) || err == nil && !isFileMissing(filepath.Join(trash, "files", name)) {
+			if err == nil {
+				infoFile.Close()
+				os.Remove(infoName)
+			}
+			name = filepath.Base(absName) + "." + strconv.Itoa(i)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		path := (&url.URL{Path: filepath.ToSlash(absName)}).EscapedPath()
+		_, err = fmt.Fprintf(infoFile, "[Trash Info]\nPath=%s\nDeletionDate=%s\n", path, time.Now().Format("2006-01-02T15:04:05"))
+		infoFile.Close()
+		if err == nil {
+			err = os.Rename(absName, filepath.Join(trash, "files", name))
+		}
+		if err != nil {
+			os.Remove(infoName)
+		}
+		return err
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// the --var values (key=value), substituted to @@key@@ in the source
+var templateVars []string
+
+// the template variable names, and their placeholders
+var (
+	reVarKey      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	rePlaceholder = regexp.MustCompile(`@@([A-Za-z0-9_-]+)@@`)
+)
+
+// checkVars check that every --var value is key=value, with a valid key.
+func checkVars() error {
+	for _, v := range templateVars {
+		key, _, found := strings.Cut(v, "=")
+		if !found || !reVarKey.MatchString(key) {
+			return errors.New("Invalid --var value " + v + " (use key=value, the key made of letters, digits, - and _).")
+		}
+	}
+	return nil
+}
+
+// substituteVars replace the @@key@@ placeholders by the --var values.
+// The placeholders without value are left as they are (with a warning).
+func substituteVars(data []byte) []byte {
+	if len(templateVars) == 0 {
+		return data
+	}
+	values := make(map[string]string)
+	for _, v := range templateVars {
+		key, value, _ := strings.Cut(v, "=")
+		values[key] = value
+	}
+	missing := make(map[string]bool)
+	data = rePlaceholder.ReplaceAllFunc(data, func(placeholder []byte) []byte {
+		key := string(placeholder[2 : len(placeholder)-2])
+		value, ok := values[key]
+		if !ok {
+			if !missing[key] && infoLevel >= infoErrors {
+				warning("No --var value for %s.", placeholder)
+			}
+			missing[key] = true
+			return placeholder
+		}
+		return []byte(value)
+	})
+	return data
+}
+
+// fullSourceName return the name of the source compiled without the .fmt:
+// the source itself, its copy with a normalized name,
+// or its copy with the variables substituted, the metadata and the \includeonly added.
+func fullSourceName() string {
+	if len(templateVars) > 0 || hasMetadata() || len(documentMetadata) > 0 || len(includeOnly) > 0 {
+		return inBase + ".full.tex"
+	}
+	return inBase + ".tex"
+}
+
+// copySource copy the source to dst, with the variables substituted, the metadata and the \includeonly added.
+func copySource(dst string) error {
+	if len(templateVars) == 0 && !hasMetadata() && len(documentMetadata) == 0 && len(includeOnly) == 0 {
+		return copyFile(inBaseOriginal+".tex", dst)
+	}
+	data, err := ioutil.ReadFile(inBaseOriginal + ".tex")
+	if err != nil {
+		return fmt.Errorf("Problem reading %s: %w", inBaseOriginal+".tex", err)
+	}
+	info(" create", dst)
+	if err := ioutil.WriteFile(dst, addIncludeOnly(addMetadata(addDocumentMetadata(substituteVars(data)))), 0644); err != nil {
+		return fmt.Errorf("Problem while writing %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	verifyEvery int      // the --verify-against-full value (0 means never)
+	verifyCount int      // the number of builds since the last verification
+	fullOptions []string // the options of the plain compilation (without the job and the source)
+)
+
+// the number of pages of the output, as written at the end of the log
+var reOutputPages = regexp.MustCompile(`Output written on .*?\((\d+) pages?`)
+
+// logPages return the number of pages reported in the log, or -1 if it is not found.
+func logPages(logName string) int {
+	data, err := ioutil.ReadFile(logName)
+	if err != nil {
+		return -1
+	}
+	match := reOutputPages.FindSubmatch(unwrapLog(data))
+	if match == nil {
+		return -1
+	}
+	pages, _ := strconv.Atoi(string(match[1]))
+	return pages
+}
+
+// pdfText return the text of the pdf using pdftotext, or an error if it is not available.
+func pdfText(pdfName string) (string, error) {
+	output, err := exec.Command("pdftotext", "-q", pdfName, "-").Output()
+	return string(output), err
+}
+
+// firstDifference return the first line that differs between the two texts.
+func firstDifference(fast, full string) (line int, fastLine, fullLine string) {
+	fastLines, fullLines := strings.Split(fast, "\n"), strings.Split(full, "\n")
+	for i := 0; i < len(fastLines) || i < len(fullLines); i++ {
+		fastLine, fullLine = "", ""
+		if i < len(fastLines) {
+			fastLine = fastLines[i]
+		}
+		if i < len(fullLines) {
+			fullLine = fullLines[i]
+		}
+		if fastLine != fullLine {
+			return i + 1, fastLine, fullLine
+		}
+	}
+	return 0, "", ""
+}
+
+// isVerificationDue count the builds, and check if the output must be verified:
+// every verifyEvery builds, the first one included.
+func isVerificationDue() bool {
+	if verifyEvery <= 0 || mustCompileAll {
+		return false
+	}
+	verifyCount++
+	if verifyCount > 1 && verifyCount <= verifyEvery {
+		return false
+	}
+	verifyCount = 1
+	return true
+}
+
+// prepareScratch create in the scratch folder the folders of the source and of the included files
+// (the engine writes their .aux there, but can't create them), and copy the auxiliary files of the fast build.
+// So the single plain compilation resolves the references, the citations and the table of contents like the fast one.
+func prepareScratch(scratch, scratchBase string) error {
+	if err := os.MkdirAll(filepath.Dir(scratchBase), 0755); err != nil {
+		return err
+	}
+	for _, ext := range strings.Split(auxExtensions, ",") {
+		if ext = strings.TrimSpace(ext); len(ext) > 0 && ext != "fmt" {
+			// the missing ones are not needed
+			copyInput(outBase+"."+ext, scratchBase+"."+ext)
+		}
+	}
+	// the included files are relative to the folder of the engine, or to the source folder if the build is isolated
+	folder, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if len(isolatedDir) > 0 {
+		folder = sourceDir
+	}
+	for _, included := range inputFiles(inBaseOriginal+".tex", 0) {
+		absIncluded, err := filepath.Abs(included)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(folder, absIncluded)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(scratch, filepath.Dir(rel)), 0755); err != nil {
+			return err
+		}
+		auxName := strings.TrimSuffix(rel, filepath.Ext(rel)) + ".aux"
+		copyInput(filepath.Join(outFolder, auxName), filepath.Join(scratch, auxName))
+	}
+	return nil
+}
+
+// verifyAgainstFull compile the whole source (without the precompiled preamble) in a scratch folder,
+// and compare the output with the one of the fast compilation.
+// While watching it is a job of the lowest priority, cancelled by the next change (see compileJob).
+// The differences are only reported: the fast output is kept.
+func verifyAgainstFull() error {
+	scratch, err := os.MkdirTemp("", "latex-fast-compile-verify-")
+	if err != nil {
+		return fmt.Errorf("Problem creating the verification folder: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	// the source is copied to have a simple name, the inputs are still found from the current folder
+	scratchBase := filepath.Join(scratch, inBase)
+	if err := prepareScratch(scratch, scratchBase); err != nil {
+		return fmt.Errorf("Problem preparing the verification folder %s: %w", scratch, err)
+	}
+	if err := copySource(scratchBase + ".tex"); err != nil {
+		return fmt.Errorf("Problem copying the source to %s: %w", scratch, err)
+	}
+	options := append(append([]string{}, fullOptions...), "-output-directory="+texPath(scratch), "-jobname="+inBase, "&"+latexFormat+" "+texFileName(scratchBase+".tex"))
+	// the errors are read in the log of the plain compilation (see engineLog)
+	fastBase := outBase
+	outBase = scratchBase
+	err = run("Verify with a plain compilation", texCompiler, options...)
+	outBase = fastBase
+	if jobContext().Err() != nil {
+		return nil
+	}
+	if err != nil {
+		warning("The plain compilation failed, but not the fast one.")
+		return nil
+	}
+	if writesDVI() && outputFormat == "pdf" {
+		if err := dviToPDF(scratchBase); err != nil {
+			return fmt.Errorf("Problem converting the plain output: %w", err)
+		}
+	}
+
+	fastPages, fullPages := logPages(outBase+".log"), logPages(scratchBase+".log")
+	if fastPages != fullPages {
+		warning("The fast output has %d pages, but the plain one has %d.", fastPages, fullPages)
+		return nil
+	}
+	if outputFormat != "pdf" {
+		info("The output is not a .pdf: only the number of pages is compared.")
+		return nil
+	}
+	fastText, err := pdfText(outputBase + ".pdf")
+	if err != nil {
+		info("pdftotext is not available: only the number of pages is compared.")
+		return nil
+	}
+	fullText, err := pdfText(scratchBase + ".pdf")
+	if err != nil {
+		return errors.New("Problem reading the text of the plain output.")
+	}
+	if line, fastLine, fullLine := firstDifference(fastText, fullText); line > 0 {
+		warning("The fast and the plain outputs differ at text line %d:", line)
+		fmt.Println("  fast :", fastLine)
+		fmt.Println("  plain:", fullLine)
+		return nil
+	}
+	info("The fast and the plain outputs are the same.")
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// in watch mode, keep an engine waiting with the format already loaded
+var mustWarm bool
+
+// warmEngine is an engine process started in advance.
+// The format is loaded and the engine waits (with \read16) for the name of the file to compile.
+type warmEngine struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan error
+}
+
+// the waiting engine (if any)
+var warm *warmEngine
+
+// the first line given to the warm engine: wait for the file name on the terminal,
+// then compile this file in batch mode (the terminal is not needed any more)
+const warmFirstLine = `\read16 to\lfcfile \batchmode\input\lfcfile`
+
+// warmOptions return the compile options with the first line of the warm engine
+// in place of the body file name.
+func warmOptions() []string {
+	options := []string{}
+	// the last option is the name of the file to compile
+	for _, option := range compileOptions[:len(compileOptions)-1] {
+		// the interaction is needed to read the file name
+		if !strings.HasPrefix(option, "-interaction=") {
+			options = append(options, option)
+		}
+	}
+	if fmtMethod == "option" {
+		// the .fmt is given by the -fmt option
+		return append(options, warmFirstLine)
+	}
+	return append(options, "&"+inBase+" "+warmFirstLine)
+}
+
+// startWarm start a new engine that waits for the next compilation.
+// Nothing is done if there is already such engine, or if the body is not compiled alone.
+func startWarm() {
+	if !mustWarm || mustCompileAll || warm != nil || isFileMissing(outBase+".fmt") {
+		return
+	}
+	cmd := engineCommand(context.Background(), texCompiler, warmOptions()...)
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = startEngine(cmd)
+	}
+	if err != nil {
+		if infoLevel >= infoErrors {
+			warning("Can't start the warm engine: %v", err)
+		}
+		return
+	}
+	w := &warmEngine{cmd: cmd, stdin: stdin, done: make(chan error, 1)}
+	go func() { w.done <- cmd.Wait() }()
+	warm = w
+	trace("exec", "Warm engine started.")
+}
+
+// stopWarm kill the waiting engine (if any), for example because its format is outdated.
+func stopWarm() {
+	if warm == nil {
+		return
+	}
+	warm.cmd.Process.Kill()
+	<-warm.done
+	warm = nil
+	trace("exec", "Warm engine stopped.")
+}
+
+// runWarm compile the body with the waiting engine, like run does with a new one.
+// If there is no waiting engine a new one is run.
+func runWarm(info string) (err error) {
+	w := warm
+	if w == nil {
+		return run(info, texCompiler, compileOptions...)
+	}
+	warm = nil
+	startTime := printAction(info + " (warm)")
+	_, err = io.WriteString(w.stdin, texFileName(inBase+".body.tex")+"\n")
+	w.stdin.Close()
+	if err != nil {
+		// the engine is gone, we use a new one
+		w.cmd.Process.Kill()
+		<-w.done
+		if infoLevel >= infoActions {
+			themeError.Println("failed.")
+		}
+		return run(info, texCompiler, compileOptions...)
+	}
+	select {
+	case err = <-w.done:
+	case <-jobContext().Done():
+		w.cmd.Process.Kill()
+		err = <-w.done
+	}
+	err = runEnd(w.cmd, startTime, err)
+	if isCrash(err) {
+		// a new engine is the retry
+		noteRetry(err)
+		return run(info, texCompiler, compileOptions...)
+	}
+	if err != nil {
+		// the warm engine reads the body from its input, a new one is given it on the command line
+		printReproduction(w.cmd.Dir, append([]string{texCompiler}, compileOptions...))
+	}
+	return err
+}
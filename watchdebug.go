@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watcherBackend return the notification system used by fsnotify on this system.
+func watcherBackend() string {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return "inotify"
+	case "windows":
+		return "ReadDirectoryChangesW"
+	case "solaris", "illumos":
+		return "FEN"
+	}
+	return "kqueue"
+}
+
+// watchDebug is the `watch-debug` subcommand.
+// It watches the files like the watch mode, with the same options (--watch-also, --data...),
+// but it only prints every event received, to check that the editor and the system deliver them.
+func watchDebug(args []string) error {
+	options := []string{}
+	source := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			options = append(options, arg)
+		} else {
+			source = nativePath(arg)
+		}
+	}
+	if len(source) == 0 {
+		return errors.New("You should provide the .tex (or .md) file to watch.")
+	}
+	// the watched files depend on the configuration files and the options
+	if err := parseOptions(options); err != nil {
+		return err
+	}
+	inBaseOriginal = strings.TrimSuffix(strings.TrimSuffix(source, ".tex"), ".md")
+	inBase = inBaseOriginal
+	mustUsePandoc = len(viaPandoc) > 0 || strings.HasSuffix(source, ".md")
+	mustManual = false
+
+	watcher, watched, polled, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	files, folders := []string{}, map[string]bool{}
+	for fileName := range watched {
+		files = append(files, fileName)
+		folders[filepath.Dir(fileName)] = true
+	}
+	sort.Strings(files)
+	fmt.Printf("Watch %d folder(s) with %s, for the files:\n", len(folders)-len(polled), watcherBackend())
+	for _, folder := range polled {
+		fmt.Println("  poll", folder, "every", pollInterval, "(limit of the watched folders reached)")
+	}
+	for _, fileName := range files {
+		if isFileMissing(fileName) {
+			fmt.Println(" ", fileName, "(missing)")
+		} else {
+			fmt.Println(" ", fileName)
+		}
+	}
+	fmt.Println("Print every event received, nothing is compiled (to exit press Ctrl/Cmd-C).")
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	polledEvents := startPolling(polled)
+	received, changes := 0, 0
+	for {
+		var event fsnotify.Event
+		source := ""
+		select {
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			event = e
+		case event = <-polledEvents:
+			source = " (polled)"
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			themeError.Printf("%s error: %v\n", time.Now().Format("15:04:05.000"), err)
+			continue
+		case <-interrupt:
+			fmt.Printf("\n%d event(s) received, %d would rebuild the document.\n", received, changes)
+			return nil
+		}
+		received++
+		result := "ignored (not watched)"
+		if isWatched, isChange := watchedEvent(event, watched); isChange {
+			result = "rebuild"
+			changes++
+		} else if isWatched {
+			result = "ignored (" + event.Op.String() + ")"
+		}
+		fmt.Printf("%s %-12s %s: %s%s\n", time.Now().Format("15:04:05.000"), event.Op, event.Name, result, source)
+	}
+}
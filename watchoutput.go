@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mattn/go-isatty"
+)
+
+// with --watch-output the document is built by another tool (make, latexmk...),
+// and only the actions after the compilation are done when the .pdf changes
+var mustWatchOutput bool
+
+// the time without change of the .pdf before to consider it written
+const outputSettleDelay = 200 * time.Millisecond
+
+// checkWatchOutput check the options that can't be used with --watch-output.
+func checkWatchOutput() error {
+	if !mustWatchOutput {
+		return nil
+	}
+	if mustNoWatch || mustManual || mustIsolate || runsEngines() {
+		return errors.New("The --watch-output option can't be used with --no-watch, --manual, --isolated or --engines.")
+	}
+	// the intermediate files belong to the other tool
+	mustClear = false
+	return nil
+}
+
+// isCompletePDF check if the .pdf is completely written: it ends with %%EOF.
+func isCompletePDF(pdfName string) bool {
+	file, err := os.Open(pdfName)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	tail := make([]byte, 1024)
+	offset := info.Size() - int64(len(tail))
+	if offset < 0 {
+		offset = 0
+	}
+	n, _ := file.ReadAt(tail, offset)
+	return bytes.Contains(tail[:n], []byte("%%EOF"))
+}
+
+// submitOutputActions queue the actions done after a compilation of the other tool:
+// the post-steps (spellcheck, exports...), the terminal title and the bell.
+func submitOutputActions(reason string) {
+	jobs.cancel(priorityPostTool)
+	jobs.submit(job{name: "export", priority: priorityPostTool, run: func() error {
+		info(reason)
+		err := runPostSteps()
+		showResult(err)
+		return err
+	}})
+}
+
+// watchOutput is the watch loop of --watch-output: nothing is compiled,
+// and the actions after the compilation are done when the .pdf is written by the other tool.
+func watchOutput() error {
+	pdfName := filepath.Clean(outputBase + ".pdf")
+	themeWatch.Set()
+	info("Watching for " + pdfName + " changes...(to exit press Ctrl/Cmd-C).")
+	color.Unset()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return atStage("watch", fmt.Errorf("Problem creating the file watcher: %w", err))
+	}
+	defer watcher.Close()
+	defer close(watchDone)
+	// the .pdf is often removed and recreated, so its folder is watched
+	polled, err := addWatchedFolder(watcher, filepath.Dir(pdfName), nil)
+	if err != nil {
+		return err
+	}
+	changes := make(chan string)
+	go watchEvents(watcher, startPolling(polled), map[string]bool{pdfName: true}, changes)
+	if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		go readStdinRequests()
+	}
+	notifyRequestSignals()
+	if mustPauseSignals {
+		notifyPauseSignals()
+	}
+	startBatteryWatch()
+	if err := listenSocket(); err != nil {
+		return err
+	}
+	isRecompiling = true
+
+	// the .pdf is written in many steps, so the actions wait until it is unchanged and complete
+	var settle <-chan time.Time
+	var pause pauseState
+	missed := false
+	for {
+		select {
+		case <-changes:
+			if pause.paused() {
+				missed = true
+			} else {
+				settle = time.After(outputSettleDelay)
+			}
+		case <-settle:
+			settle = nil
+			if isCompletePDF(pdfName) {
+				submitOutputActions(pdfName + " changed.")
+			}
+		case command := <-watchCommands:
+			switch command {
+			case cmdRebuild, cmdPrecompile:
+				submitOutputActions("Actions requested.")
+			case cmdQuit:
+				return nil
+			case cmdPause, cmdBatteryPause:
+				if pause.apply(command) {
+					info("Paused: the changes of " + pdfName + " are ignored until resume.")
+				}
+			case cmdResume, cmdBatteryResume:
+				if pause.apply(command) {
+					if missed {
+						missed = false
+						submitOutputActions("Resumed, " + pdfName + " changed while paused.")
+					} else {
+						info("Resumed.")
+					}
+				}
+			}
+		}
+	}
+}